@@ -0,0 +1,228 @@
+package redicluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Per-node circuit breaking. The circuit of a node opens after CircuitFailures consecutive failures (dial or I/O
+// errors, not redis error replies), and the requests to it fail fast with *CircuitOpenError. After
+// CircuitOpenTimeout the circuit becomes half-open and allows one trial request, which is usually a PING from the
+// background probing, the circuit closes if the trial succeeds, otherwise it opens again.
+
+const (
+	defaultCircuitOpenTimeout   = 5 * time.Second
+	defaultCircuitProbeInterval = time.Second
+)
+
+// CircuitState is the state of the circuit breaker of a node
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// MarshalText encodes the state as its name, e.g. in the JSON of ClusterStats
+func (s CircuitState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes the state from its name
+func (s *CircuitState) UnmarshalText(text []byte) error {
+	for _, st := range []CircuitState{CircuitClosed, CircuitOpen, CircuitHalfOpen} {
+		if st.String() == string(text) {
+			*s = st
+			return nil
+		}
+	}
+	return fmt.Errorf("redicluster: unknown circuit state %q", text)
+}
+
+// ErrCircuitOpen matches *CircuitOpenError by errors.Is
+var ErrCircuitOpen = errors.New("redicluster: circuit open")
+
+// CircuitOpenError is returned when a request is sent to a node whose circuit is open
+type CircuitOpenError struct {
+	Addr string
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("redicluster: circuit open for %s", e.Addr)
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+
+	// trial indicates that the trial request of half-open state is in flight since trialAt, a trial without
+	// result in openTimeout, e.g. the conn is borrowed but never used, is given up
+	trial   bool
+	trialAt time.Time
+}
+
+// trialPending reports if there is a trial in flight. b.mu must be held by the caller
+func (b *circuitBreaker) trialPending(openTimeout time.Duration) bool {
+	return b.trial && time.Since(b.trialAt) < openTimeout
+}
+
+// allow reports if a request can be sent, it turns an expired open circuit into half-open
+func (b *circuitBreaker) allow(openTimeout time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < openTimeout {
+			return false
+		}
+		b.state = CircuitHalfOpen
+	case CircuitHalfOpen:
+		if b.trialPending(openTimeout) {
+			return false
+		}
+	default:
+		return true
+	}
+	b.trial = true
+	b.trialAt = time.Now()
+	return true
+}
+
+// rejects reports if a request would be rejected, without changing the state
+func (b *circuitBreaker) rejects(openTimeout time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		return time.Since(b.openedAt) < openTimeout
+	case CircuitHalfOpen:
+		return b.trialPending(openTimeout)
+	}
+	return false
+}
+
+// onResult records the result of a request, and returns the state before it and the new state
+func (b *circuitBreaker) onResult(ok bool, threshold int) (from, to CircuitState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	from = b.state
+	if ok {
+		b.state = CircuitClosed
+		b.failures = 0
+		b.trial = false
+		return from, b.state
+	}
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= threshold {
+		b.state = CircuitOpen
+		b.openedAt = time.Now()
+		b.trial = false
+	}
+	return from, b.state
+}
+
+func (b *circuitBreaker) getState() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// isNodeFailure reports if the error indicates the node is unhealthy. Redis error replies and the errors caused by
+// the caller, like context cancellation and pool exhaustion, are not failures of the node
+func isNodeFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(redis.Error); ok {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, redis.ErrPoolExhausted) || errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrAuth) {
+		return false
+	}
+	// other errors from redigo are I/O or protocol errors
+	return true
+}
+
+func (cp *ClusterPool) circuitOpenTimeout() time.Duration {
+	if cp.CircuitOpenTimeout > 0 {
+		return cp.CircuitOpenTimeout
+	}
+	return defaultCircuitOpenTimeout
+}
+
+// allowRequest reports if a request can be sent to the node by its circuit
+func (cp *ClusterPool) allowRequest(ns *nodeState) bool {
+	return cp.CircuitFailures <= 0 || ns.breaker.allow(cp.circuitOpenTimeout())
+}
+
+// onResult records the result of a request for the circuit of the node
+func (cp *ClusterPool) onResult(addr string, ns *nodeState, err error) {
+	failed := isNodeFailure(err)
+	if failed {
+		cp.log(LogWarn, "redicluster: node failure", "addr", addr, "err", err)
+	}
+	if cp.CircuitFailures <= 0 || (err != nil && !failed) {
+		return
+	}
+	from, to := ns.breaker.onResult(!failed, cp.CircuitFailures)
+	if from == to {
+		return
+	}
+	switch to {
+	case CircuitOpen:
+		cp.log(LogError, "redicluster: circuit opened", "addr", addr, "err", err)
+		cp.recordEvent(EventCircuitOpened, addr, err.Error())
+	case CircuitClosed:
+		cp.log(LogInfo, "redicluster: circuit closed", "addr", addr)
+		cp.recordEvent(EventCircuitClosed, addr, "")
+	}
+}
+
+// circuitRejects reports if the requests to the node are rejected by its circuit
+func (cp *ClusterPool) circuitRejects(addr string) bool {
+	if cp.CircuitFailures <= 0 {
+		return false
+	}
+	ns := cp.lookupNodeState(addr)
+	return ns != nil && ns.breaker.rejects(cp.circuitOpenTimeout())
+}
+
+// probeOpenCircuits PINGs the nodes whose circuit is ready for a trial
+func (cp *ClusterPool) probeOpenCircuits() {
+	timeout := cp.circuitOpenTimeout()
+	var addrs []string
+	cp.rangeNodeStates(func(addr string, ns *nodeState) bool {
+		if ns.breaker.getState() != CircuitClosed && !ns.breaker.rejects(timeout) {
+			addrs = append(addrs, addr)
+		}
+		return true
+	})
+	for _, addr := range addrs {
+		cp.ping(addr, timeout)
+	}
+}
@@ -0,0 +1,60 @@
+package redicluster
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var b circuitBreaker
+	timeout := 50 * time.Millisecond
+	b.onResult(false, 2)
+	assert.Equal(t, CircuitClosed, b.getState())
+	b.onResult(false, 2)
+	assert.Equal(t, CircuitOpen, b.getState())
+	assert.False(t, b.allow(timeout))
+	assert.True(t, b.rejects(timeout))
+
+	time.Sleep(timeout)
+	assert.False(t, b.rejects(timeout))
+	assert.True(t, b.allow(timeout))
+	assert.Equal(t, CircuitHalfOpen, b.getState())
+	// only one trial in half-open
+	assert.False(t, b.allow(timeout))
+	b.onResult(false, 2)
+	assert.Equal(t, CircuitOpen, b.getState())
+
+	time.Sleep(timeout)
+	assert.True(t, b.allow(timeout))
+	b.onResult(true, 2)
+	assert.Equal(t, CircuitClosed, b.getState())
+	assert.True(t, b.allow(timeout))
+}
+
+func TestNodeFailure(t *testing.T) {
+	assert.True(t, isNodeFailure(io.EOF))
+	assert.False(t, isNodeFailure(redis.Error("ERR wrong type")))
+	assert.False(t, isNodeFailure(context.Canceled))
+	assert.False(t, isNodeFailure(nil))
+}
+
+func TestCircuitOpenFailFast(t *testing.T) {
+	// nothing listens on port 1
+	cp := &ClusterPool{CircuitFailures: 1, CircuitOpenTimeout: time.Minute}
+	_, err := cp.getRedisConnByAddrContext(context.Background(), "127.0.0.1:1")
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, ErrCircuitOpen))
+
+	_, err = cp.getRedisConnByAddrContext(context.Background(), "127.0.0.1:1")
+	var ce *CircuitOpenError
+	require.True(t, errors.As(err, &ce))
+	assert.Equal(t, "127.0.0.1:1", ce.Addr)
+	assert.Equal(t, CircuitOpen, cp.NodeStats()["127.0.0.1:1"].Circuit)
+}
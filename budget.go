@@ -0,0 +1,140 @@
+package redicluster
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// Cluster-wide connection budget. At most MaxTotalActive connections can be borrowed from all nodes at the same
+// time, the borrowers wait in a FIFO queue once the budget is used up. Every node is guaranteed MinActivePerNode
+// connections, which are reserved from the budget, so a hot node can't starve the others.
+
+type budgetWaiter struct {
+	addr    string
+	granted chan struct{}
+}
+
+type connBudget struct {
+	mu sync.Mutex
+
+	// count of borrowed connections, in total and by node
+	total   int
+	perNode map[string]int
+
+	// count of the nodes in cluster, and the count of reserved connections in use
+	nodes        int
+	reservedUsed int
+
+	waiters list.List
+}
+
+// setNodes updates the count of nodes in cluster, which decides the count of reserved connections
+func (b *connBudget) setNodes(n int) {
+	b.mu.Lock()
+	b.nodes = n
+	b.mu.Unlock()
+}
+
+// grantable reports if the node can borrow one more connection. b.mu must be held by the caller
+func (b *connBudget) grantable(addr string, max, min int) (ok bool, reserved bool) {
+	if b.perNode[addr] < min {
+		return true, true
+	}
+	unused := min*b.nodes - b.reservedUsed
+	if unused < 0 {
+		unused = 0
+	}
+	return b.total+unused < max, false
+}
+
+// grant takes one connection of the node from the budget. b.mu must be held by the caller
+func (b *connBudget) grant(addr string, min int) {
+	if b.perNode == nil {
+		b.perNode = make(map[string]int)
+	}
+	if b.perNode[addr] < min {
+		b.reservedUsed++
+	}
+	b.perNode[addr]++
+	b.total++
+}
+
+// acquire takes one connection of the node from the budget, it waits in the FIFO queue until a connection is
+// released or ctx is done
+func (b *connBudget) acquire(ctx context.Context, addr string, max, min int) error {
+	b.mu.Lock()
+	ok, reserved := b.grantable(addr, max, min)
+	// the reserved connections don't need to wait, the others wait behind the earlier waiters
+	if ok && (reserved || b.waiters.Len() == 0) {
+		b.grant(addr, min)
+		b.mu.Unlock()
+		return nil
+	}
+	w := &budgetWaiter{addr: addr, granted: make(chan struct{})}
+	e := b.waiters.PushBack(w)
+	b.mu.Unlock()
+
+	select {
+	case <-w.granted:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		select {
+		case <-w.granted:
+			// granted while ctx is done, give it back
+			b.mu.Unlock()
+			b.release(addr, max, min)
+		default:
+			b.waiters.Remove(e)
+			b.mu.Unlock()
+		}
+		return ctx.Err()
+	}
+}
+
+// release gives one connection of the node back to the budget, and grants the waiters in order
+func (b *connBudget) release(addr string, max, min int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.perNode[addr]--
+	if b.perNode[addr] < min {
+		b.reservedUsed--
+	}
+	if b.perNode[addr] == 0 {
+		delete(b.perNode, addr)
+	}
+	b.total--
+
+	// the waiters for shared connections are granted in order, the ones for reserved connections are granted
+	// regardless of the order
+	sharedBlocked := false
+	for e := b.waiters.Front(); e != nil; {
+		next := e.Next()
+		w := e.Value.(*budgetWaiter)
+		ok, reserved := b.grantable(w.addr, max, min)
+		if ok && (reserved || !sharedBlocked) {
+			b.waiters.Remove(e)
+			b.grant(w.addr, min)
+			close(w.granted)
+		} else if !ok {
+			sharedBlocked = true
+		}
+		e = next
+	}
+}
+
+// acquireBudget takes a connection of the node from the cluster-wide budget if MaxTotalActive is set
+func (cp *ClusterPool) acquireBudget(ctx context.Context, addr string) error {
+	if cp.MaxTotalActive <= 0 {
+		return nil
+	}
+	return cp.budget.acquire(ctx, addr, cp.MaxTotalActive, cp.MinActivePerNode)
+}
+
+func (cp *ClusterPool) releaseBudget(addr string) {
+	if cp.MaxTotalActive <= 0 {
+		return
+	}
+	cp.budget.release(addr, cp.MaxTotalActive, cp.MinActivePerNode)
+}
@@ -0,0 +1,108 @@
+package redicluster
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnBudgetFIFO(t *testing.T) {
+	var b connBudget
+	ctx := context.Background()
+	require.NoError(t, b.acquire(ctx, "a", 2, 0))
+	require.NoError(t, b.acquire(ctx, "a", 2, 0))
+
+	order := make(chan string, 2)
+	for _, addr := range []string{"b", "c"} {
+		go func(addr string) {
+			if b.acquire(ctx, addr, 2, 0) == nil {
+				order <- addr
+			}
+		}(addr)
+		// make sure the waiters are queued in order
+		assert.Eventually(t, func() bool {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			return b.waiters.Len() > 0 && b.waiters.Back().Value.(*budgetWaiter).addr == addr
+		}, time.Second, time.Millisecond)
+	}
+	b.release("a", 2, 0)
+	assert.Equal(t, "b", <-order)
+	b.release("a", 2, 0)
+	assert.Equal(t, "c", <-order)
+}
+
+func TestConnBudgetReserved(t *testing.T) {
+	var b connBudget
+	b.setNodes(2)
+	ctx := context.Background()
+	// 1 reserved for "b", so "a" can take 3 at most
+	for i := 0; i < 3; i++ {
+		require.NoError(t, b.acquire(ctx, "a", 4, 1))
+	}
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, b.acquire(tctx, "a", 4, 1), context.DeadlineExceeded)
+	require.NoError(t, b.acquire(ctx, "b", 4, 1))
+	assert.Equal(t, 4, b.total)
+	assert.Equal(t, 0, b.waiters.Len())
+}
+
+func TestConnBudgetSpanMasters(t *testing.T) {
+	c := newTestCluster(t)
+	cp := NewClusterPool(c.Addrs(), WithConnBudget(2, 0))
+	defer cp.Close()
+	require.NoError(t, cp.ReloadSlotMapping())
+	conn := cp.Get()
+
+	// the keys span all of the 3 masters, more than the budget
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 50; i++ {
+		_, err := redis.DoContext(conn, ctx, "SET", fmt.Sprintf("k%d", i), i)
+		require.NoError(t, err)
+	}
+	require.NoError(t, conn.Close())
+	cp.budget.mu.Lock()
+	defer cp.budget.mu.Unlock()
+	assert.Equal(t, 0, cp.budget.total)
+}
+
+func TestConnBudgetSingle(t *testing.T) {
+	c := newTestCluster(t)
+	cp := NewClusterPool(c.Addrs(), WithConnBudget(1, 0))
+	defer cp.Close()
+	require.NoError(t, cp.ReloadSlotMapping())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn := cp.GetWithDefaultContext(ctx)
+	defer conn.Close()
+
+	// the commands and the pipeline go to all of the 3 masters with a single connection of budget
+	keys := []string{"a", "b", "foo"}
+	for _, k := range keys {
+		_, err := conn.Do("SET", k, "v-"+k)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"v-a", "v-b", "v-foo"}, getAll(t, conn, keys...))
+
+	// the connection of the old owner is returned before following MOVED
+	slot := Slot("foo")
+	owner := c.Owner(slot)
+	for _, m := range c.Masters() {
+		if m != owner {
+			require.NoError(t, c.MoveSlots(slot, slot, m))
+			break
+		}
+	}
+	v, err := redis.String(conn.Do("GET", "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, "v-foo", v)
+	require.NoError(t, c.MoveSlots(slot, slot, owner))
+	assert.Equal(t, []string{"v-a", "v-b", "v-foo"}, getAll(t, conn, keys...))
+}
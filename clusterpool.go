@@ -2,11 +2,15 @@ package redicluster
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"math/rand"
+	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -18,14 +22,38 @@ const (
 	TotalSlots = 16384
 )
 
-type nodeInfo struct {
+// NodeInfo is the metadata of a node in cluster
+type NodeInfo struct {
 	Addr string
 	Id   string
+
+	// Role is "master" or "replica", empty if the node is not in the slot mapping yet
+	Role string
+
+	// Shard is the node id of the master that the node belongs to
+	Shard string
+
+	// Zone is the availability zone of the node, empty if unknown
+	Zone string
+
+	// Hostname is the hostname announced by the node, empty if unknown
+	Hostname string
+
+	// IP is the IP address of the node, empty if unknown. It's reported by INFO replication on the master
+	IP string
+}
+
+// nodePool is the connection pool of a node
+type nodePool struct {
+	pool *redis.Pool
+
+	// node is the node metadata when the pool is created
+	node NodeInfo
 }
 
 type slotInfo struct {
 	Start, End int
-	Nodes      []*nodeInfo
+	Nodes      []*NodeInfo
 	Addrs      []string
 }
 
@@ -36,52 +64,203 @@ type ClusterPool struct {
 	// Dial options for case without pool(CreateConnPool is nil)
 	DialOptionsWithoutPool []redis.DialOption
 
+	// Credentials supplies the username and password of every node, which are sent by AUTH once connected. The idle
+	// connections of the pools created by NewClusterPool are authenticated again on borrowing if they change.
+	// The pools created by CreateConnPool or CreateNodePool should authenticate by themselves
+	Credentials CredentialsProvider
+
+	// TLSConfig enables TLS for the connections to all nodes if it's not nil, including the entry nodes and the
+	// redirect targets. The tls-port announced by CLUSTER SHARDS is used if present. Set Certificates for mTLS.
+	// The server name is set per node by TLSServerName
+	TLSConfig *tls.Config
+
+	// TLSServerName returns the server name for verifying the certificate of the node address, hostname is the one
+	// announced by the node. By default it's TLSConfig.ServerName if set, otherwise the announced hostname, otherwise
+	// the host of the address
+	TLSServerName func(addr, hostname string) string
+
+	// ClientName is the name set by CLIENT SETNAME on every connection to nodes, so the connections can be told by
+	// CLIENT LIST. The placeholder {addr} is replaced by the node address, e.g. "billing-{addr}". Empty means no name
+	ClientName string
+
+	// LibName and LibVersion are set by CLIENT SETINFO on every connection to nodes if they are not empty, they
+	// are ignored by the nodes before redis 7.2
+	LibName    string
+	LibVersion string
+
+	// Hooks are called around the commands, pipelines, redirects and reloads, see Hook
+	Hooks []Hook
+
+	// Logger receives the records of the cluster events at LogLevel or above: the reloads with the topology
+	// changes, redirects, node failures, pool creation and removal, pipeline batch errors and pubsub reconnects.
+	// Nil disables logging
+	Logger   Logger
+	LogLevel LogLevel
+
 	// Defualt timeout for the connection pool
 	DefaultPoolTimeout time.Duration
 
+	// PipelineBatchTimeout is the timeout of every batch of a pipeline, which is a real pipeline request to a node.
+	// Zero means no timeout other than the context of Flush
+	PipelineBatchTimeout time.Duration
+
 	// Function for creating connection pool, which would be invoked when the caller acquires conn by Getxx func
 	// if the node has not pool in connPools. By this func, you can control the pool behavior based on your demand
 	CreateConnPool func(ctx context.Context, addr string) (*redis.Pool, error)
 
-	// protect the following members
-	mu sync.Mutex
+	// CreateNodePool is like CreateConnPool but receives the node metadata, it takes precedence over CreateConnPool.
+	// The pool of a node is closed and created again if the role of the node changes, e.g. after failover
+	CreateNodePool func(ctx context.Context, node NodeInfo) (*redis.Pool, error)
+
+	// ClientZone is the availability zone the client runs in. Replica reads prefer the replicas in this zone if set
+	ClientZone string
+
+	// ZoneOf returns the availability zone of a node address. It overrides the availability-zone reported
+	// by CLUSTER SHARDS if it returns a non-empty zone
+	ZoneOf func(addr string) string
+
+	// ZoneFallback is the order of zones tried for replica reads if there is no replica in ClientZone, AnyZone
+	// matches replicas in any zone. The master is used if no replica matches. Nil means []string{AnyZone}, set it
+	// to an empty slice to fall back to the master directly
+	ZoneFallback []string
+
+	// LatencyRouting makes replica reads pick the replica with the lowest round-trip time among the eligible ones
+	LatencyRouting bool
+
+	// LatencyProbeInterval is the interval to PING the nodes that have no requests in the last interval, so their
+	// latency measurements keep fresh. Zero disables probing
+	LatencyProbeInterval time.Duration
+
+	// ReplicationCheckInterval is the interval to collect the replication offsets of shards, which is required by
+	// the MaxLag options of GetReadonlyConnWithOptions. Zero disables collecting
+	ReplicationCheckInterval time.Duration
+
+	// CircuitFailures is the count of consecutive failures that opens the circuit of a node, the requests to the node
+	// fail fast with *CircuitOpenError while the circuit is open. Zero disables circuit breaking
+	CircuitFailures int
+
+	// CircuitOpenTimeout is how long the circuit stays open before a trial request is allowed, 5s by default
+	CircuitOpenTimeout time.Duration
+
+	// CircuitProbeInterval is the interval to PING the nodes whose circuit is ready for a trial, 1s by default
+	CircuitProbeInterval time.Duration
+
+	// MaxTotalActive is the maximum count of connections borrowed from all nodes at the same time, the borrowers
+	// wait in FIFO order once it's reached, bound by their context and DefaultPoolTimeout. The idle connections
+	// are bounded by the per-node pools. Zero means no limit
+	MaxTotalActive int
+
+	// MinActivePerNode is the count of connections reserved from MaxTotalActive for every node, so a hot node can't
+	// starve the others. MaxTotalActive should be greater than MinActivePerNode times the count of nodes
+	MinActivePerNode int
 
-	// slot mapping, slot -> addrs, the 0 index address is the master
-	slotAddrMap [TotalSlots][]string
+	// PrewarmConns is the count of connections established to every master in parallel after the slot mapping
+	// is loaded, so the first requests don't pay for dialing. It takes effect only with the pools created by
+	// CreateConnPool or CreateNodePool. Zero disables pre-warming
+	PrewarmConns int
 
-	// slot info, including slot range and corresponding nodes address and roles
-	slots []*slotInfo
+	// PrewarmReplicas pre-warms the replicas as well
+	PrewarmReplicas bool
 
-	// connections pool for nodes in cluster
-	connPools map[string]*redis.Pool
+	// Faults injects latency, dropped connections and synthetic error replies into the connections to nodes for
+	// resilience testing, see FaultInjector. Nil disables fault injection. The connections of the pools created by
+	// CreateConnPool or CreateNodePool are not injected unless they dial by the managed pools
+	Faults *FaultInjector
+
+	// config of the managed per-node pools by role, see NewClusterPool
+	poolCfg         poolConfig
+	replicaPoolCfg  poolConfig
+	poolOpts        []PoolOption
+	masterPoolOpts  []PoolOption
+	replicaPoolOpts []PoolOption
+
+	// current topology snapshot, see topology
+	topo atomic.Pointer[topology]
+
+	// connections pool for nodes in cluster, addr -> *nodePool
+	connPools sync.Map
+
+	// poolMu serializes creating and removing the pools, so a node never gets two pools
+	poolMu sync.Mutex
+
+	// runtime state of nodes, addr -> *nodeState
+	states sync.Map
+
+	// cluster-wide connection budget by MaxTotalActive
+	budget connBudget
+
+	// statistics of the slot mapping reloads
+	reloadStats reloadStats
+
+	// recent topology events, see TopologyEvents
+	events eventRing
+
+	// closed indicates the pool is closed by Close or Shutdown
+	closed atomic.Bool
+
+	// count of in-flight requests
+	inflight atomic.Int64
+
+	// protect the borrowed node connections and drained, for draining on Shutdown
+	drainMu  sync.Mutex
+	borrowed map[*nodeConn]struct{}
+
+	// drained is closed when there is no in-flight request or borrowed connection after Shutdown
+	drained chan struct{}
+
+	// protect the following members
+	mu sync.Mutex
 
 	// reloading indicates that the slot mapping is reloading
 	reloading bool
+
+	// ready is closed once the slot mapping is loaded and pools are pre-warmed
+	ready       chan struct{}
+	readyClosed bool
+
+	// bgCtx is cancelled to stop the background goroutines
+	bgCtx     context.Context
+	bgCancel  context.CancelFunc
+	bgStarted bool
+	bgClosed  bool
+	bgWg      sync.WaitGroup
 }
 
 // Slot returns the hash Slot of the key
 func Slot(key string) int {
+	if tag := hashTag(key); len(tag) > 0 {
+		key = tag
+	}
+	return int(crc16(key) % TotalSlots)
+}
+
+// hashTag returns the part of the key between the first "{" and the next "}", which is hashed instead of the whole
+// key if it's not empty
+func hashTag(key string) string {
 	if start := strings.Index(key, "{"); start >= 0 {
 		if end := strings.Index(key[start+1:], "}"); end > 0 {
-			end += start + 1
-			key = key[start+1 : end]
+			return key[start+1 : start+1+end]
 		}
 	}
-	return int(crc16(key) % TotalSlots)
+	return ""
 }
 
-// CmdSlot returns the hash slot of the command
-func CmdSlot(cmd string, args ...interface{}) int {
-	// -1 when args is nil, a random slot should be taken for invoker like GetAddrsBySlots
-	slot := -1
-	sk := 0
-
+// routingKeyIndex returns the index of the argument that the slot of the command is computed from
+func routingKeyIndex(cmd string) int {
 	// for script command, use the first key to calculate slot, so we can do a script with only one key handling
 	// NOTE: you should not handle muliple keys in one script command in a redis cluster
 	switch cmd {
 	case "EVAL", "EVAL_RO", "EVALSHA", "EVALSHA_RO":
-		sk = 2
+		return 2
 	}
+	return 0
+}
+
+// CmdSlot returns the hash slot of the command
+func CmdSlot(cmd string, args ...interface{}) int {
+	// -1 when args is nil, a random slot should be taken for invoker like GetAddrsBySlots
+	slot := -1
+	sk := routingKeyIndex(cmd)
 	if len(args) > sk {
 		key := fmt.Sprintf("%s", args[sk])
 		slot = Slot(key)
@@ -96,62 +275,105 @@ func (cp *ClusterPool) Get() redis.Conn {
 	return &redirconn{cp: cp, redir: true, readOnly: false}
 }
 
-// GetContext gets the redis.Conn interface that handles the redirecting automatically
+// GetContext gets the redis.Conn interface that handles the redirecting automatically. Like redis.Pool.GetContext,
+// ctx is only used for getting the conn: the slot mapping is loaded with ctx if it's not loaded yet, and a conn
+// returning the error is returned if ctx is done or the loading fails. See GetWithDefaultContext
 func (cp *ClusterPool) GetContext(ctx context.Context) redis.Conn {
+	if err := ctx.Err(); err != nil {
+		return errorConn{err}
+	}
+	if len(cp.topology().slots) == 0 {
+		if err := cp.ReloadSlotMappingContext(ctx); err != nil {
+			return errorConn{err}
+		}
+	}
 	return &redirconn{cp: cp, redir: true, readOnly: false}
 }
 
-// Stats gets the redis.PoolStats of the current cluster
+// GetWithDefaultContext gets the redis.Conn interface that handles the redirecting automatically, ctx is used by
+// the requests without context on the conn, like Do and Flush
+func (cp *ClusterPool) GetWithDefaultContext(ctx context.Context) redis.Conn {
+	return &redirconn{cp: cp, redir: true, readOnly: false, ctx: ctx}
+}
+
+// errorConn is the conn returned by GetContext if it fails, every request returns the error
+type errorConn struct{ err error }
+
+func (ec errorConn) Do(string, ...interface{}) (interface{}, error) { return nil, ec.err }
+func (ec errorConn) DoContext(context.Context, string, ...interface{}) (interface{}, error) {
+	return nil, ec.err
+}
+func (ec errorConn) DoWithTimeout(time.Duration, string, ...interface{}) (interface{}, error) {
+	return nil, ec.err
+}
+func (ec errorConn) Send(string, ...interface{}) error                     { return ec.err }
+func (ec errorConn) Err() error                                            { return ec.err }
+func (ec errorConn) Close() error                                          { return ec.err }
+func (ec errorConn) Flush() error                                          { return ec.err }
+func (ec errorConn) FlushContext(context.Context) error                    { return ec.err }
+func (ec errorConn) Receive() (interface{}, error)                         { return nil, ec.err }
+func (ec errorConn) ReceiveContext(context.Context) (interface{}, error)   { return nil, ec.err }
+func (ec errorConn) ReceiveWithTimeout(time.Duration) (interface{}, error) { return nil, ec.err }
+
+// Stats gets the redis.PoolStats of the current cluster, the circuit states and the other statistics of the nodes
+// are reported by NodeStats
 func (cp *ClusterPool) Stats() map[string]redis.PoolStats {
 	ps := make(map[string]redis.PoolStats)
-	cp.mu.Lock()
-	for k, p := range cp.connPools {
-		ps[k] = p.Stats()
-	}
-	cp.mu.Unlock()
+	cp.rangePools(func(k string, np *nodePool) bool {
+		ps[k] = np.pool.Stats()
+		return true
+	})
 	return ps
 }
 
-// Close closes the connections and clear the slot mapping of the cluster pool
+// NodeStats gets the statistics of the nodes in the current cluster, see ClusterStats for the totals
+func (cp *ClusterPool) NodeStats() map[string]NodeStats {
+	ps := make(map[string]NodeStats)
+	cp.rangePools(func(k string, np *nodePool) bool {
+		ps[k] = NodeStats{PoolStats: np.pool.Stats()}
+		return true
+	})
+	cp.rangeNodeStates(func(k string, ns *nodeState) bool {
+		st := ps[k]
+		ns.fillStats(&st)
+		ps[k] = st
+		return true
+	})
+	return ps
+}
+
+// Close closes the connections and clear the slot mapping of the cluster pool immediately, the borrowed connections
+// are closed as well. The requests after Close fail with ErrPoolClosed. See Shutdown for closing gracefully
 func (cp *ClusterPool) Close() {
-	cp.mu.Lock()
-	defer cp.mu.Unlock()
-	for k, p := range cp.connPools {
-		p.Close()
-		delete(cp.connPools, k)
-	}
-	cp.slots = nil
-	for i := range cp.slotAddrMap {
-		cp.slotAddrMap[i] = nil
-	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cp.Shutdown(ctx)
 }
 
 // ActiveCount returns the total active connection count in the cluster pool
 func (cp *ClusterPool) ActiveCount() int {
 	n := 0
-	cp.mu.Lock()
-	defer cp.mu.Unlock()
-	for _, p := range cp.connPools {
-		n += p.ActiveCount()
-	}
+	cp.rangePools(func(_ string, np *nodePool) bool {
+		n += np.pool.ActiveCount()
+		return true
+	})
 	return n
 }
 
 // IdleCount returns the total idle connection count in the cluster pool
 func (cp *ClusterPool) IdleCount() int {
 	n := 0
-	cp.mu.Lock()
-	defer cp.mu.Unlock()
-	for _, p := range cp.connPools {
-		n += p.IdleCount()
-	}
+	cp.rangePools(func(_ string, np *nodePool) bool {
+		n += np.pool.IdleCount()
+		return true
+	})
 	return n
 }
 
 /* redis.Pool compatible APIs end */
 
 func (cp *ClusterPool) GetRandomRealConn() (redis.Conn, error) {
-	return cp.getRedisConnBySlot(-1)
+	return cp.getRedisConnBySlot(context.Background(), -1)
 }
 
 // GetNoRedirConn gets the redis.Conn interface without redirecting handling, which allows
@@ -187,13 +409,16 @@ func (cp *ClusterPool) GetShardedPubSubConn() (*ShardedPubSubConn, error) {
 // VerbosSlots returns the slot mapping of the cluster with a readable string
 func (cp *ClusterPool) VerbosSlotMapping() string {
 	var s []string
-	for i, si := range cp.slots {
+	for i, si := range cp.topology().slots {
 		s = append(s, fmt.Sprintf("%d) Slot Range: %d - %d", i+1, si.Start, si.End))
 		for j, ni := range si.Nodes {
 			role := ""
 			if j == 0 {
 				role = "(master)"
 			}
+			if len(ni.Zone) > 0 {
+				role += fmt.Sprintf(" zone=%s", ni.Zone)
+			}
 			s = append(s, fmt.Sprintf("   Node %d: %s, %s%s", j+1, ni.Addr, ni.Id, role))
 		}
 	}
@@ -202,7 +427,12 @@ func (cp *ClusterPool) VerbosSlotMapping() string {
 
 // ReloadSlots reloads the slot mapping
 func (cp *ClusterPool) ReloadSlotMapping() error {
-	return cp.reloadSlotMaping()
+	return cp.reloadSlotMaping(context.Background())
+}
+
+// ReloadSlotMappingContext reloads the slot mapping with context
+func (cp *ClusterPool) ReloadSlotMappingContext(ctx context.Context) error {
+	return cp.reloadSlotMaping(ctx)
 }
 
 // a *rand.Rand is not safe for concurrent access
@@ -211,9 +441,14 @@ var rnd = struct {
 	*rand.Rand
 }{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))} //nolint:gosec
 
+// GetAddrsBySlots returns the node addresses of the slots, a replica is picked for every slot if readOnly is true
 func (cp *ClusterPool) GetAddrsBySlots(slots []int, readOnly bool) ([]string, error) {
-	cp.mu.Lock()
-	defer cp.mu.Unlock()
+	return cp.getAddrsBySlots(slots, readOnly, nil)
+}
+
+// getAddrsBySlots is like GetAddrsBySlots, only the replicas that eligible reports true are picked if it's not nil
+func (cp *ClusterPool) getAddrsBySlots(slots []int, readOnly bool, eligible func(replica, master string) bool) ([]string, error) {
+	t := cp.topology()
 	var addrs []string
 	for _, sl := range slots {
 		if sl >= TotalSlots {
@@ -223,20 +458,13 @@ func (cp *ClusterPool) GetAddrsBySlots(slots []int, readOnly bool) ([]string, er
 			sl = rnd.Intn(TotalSlots)
 			rnd.Unlock()
 		}
-		sa := cp.slotAddrMap[sl]
+		sa := t.addrs(sl)
 		if len(sa) == 0 {
 			return nil, errors.New("bad slot mapping")
 		}
 		addr := sa[0]
 		if readOnly {
-			if len(sa) == 2 {
-				addr = sa[1]
-			} else {
-				rnd.Lock()
-				ix := rnd.Intn(len(sa) - 1)
-				rnd.Unlock()
-				addr = addrs[ix+1]
-			}
+			addr = cp.pickReplica(t, sa, eligible)
 		}
 		addrs = append(addrs, addr)
 	}
@@ -251,65 +479,117 @@ func (cp *ClusterPool) onRedir(ri *RedirInfo) bool {
 	// so we don't need to reload the slot mapping
 	// ASK spec: https://redis.io/docs/reference/cluster-spec/#ask-redirection
 	if ri != nil && ri.Kind == "MOVED" {
-		if ri.Slot < TotalSlots {
-			curAddr := cp.slotAddrMap[ri.Slot]
-
+		if ri.Slot >= 0 && ri.Slot < TotalSlots {
 			// Reload only if ri.Addr is not equal to the corresponding addr in the slot mapping.
 			// MOVED occurs and redirects to the master as a request is sent to a replica, so we don't need to
 			// reload the slot mapping if the ri.Addr is same as the addr in the slot mapping
-			if len(curAddr) == 0 || curAddr[0] != ri.Addr {
-				cp.slotAddrMap[ri.Slot] = []string{ri.Addr}
-				doReload = true
-			}
+			doReload = cp.redirectSlot(ri.Slot, ri.Addr)
 		}
 	}
 	if doReload {
 		// reload concurrently for future requests, and the trigger routine should try again with the addr in the RedirInfo
-		go cp.reloadSlotMaping()
+		cp.goBackground(func(ctx context.Context) {
+			cp.reloadSlotMaping(ctx)
+		})
 	}
 	return doReload
 }
 
-func (cp *ClusterPool) getRedisConnByAddr(addr string) (redis.Conn, error) {
+// getRedisConnByAddr gets the conn of the node address, the borrowing is bound by DefaultPoolTimeout as well as ctx
+func (cp *ClusterPool) getRedisConnByAddr(ctx context.Context, addr string) (redis.Conn, error) {
 	if cp.DefaultPoolTimeout > 0 {
-		ctx, cancel := context.WithTimeout(context.Background(), cp.DefaultPoolTimeout)
+		ctx, cancel := context.WithTimeout(ctx, cp.DefaultPoolTimeout)
 		defer cancel()
 		return cp.getRedisConnByAddrContext(ctx, addr)
 	}
-	return cp.getRedisConnByAddrContext(context.Background(), addr)
+	return cp.getRedisConnByAddrContext(ctx, addr)
 }
 
 func (cp *ClusterPool) getRedisConnByAddrContext(ctx context.Context, addr string) (redis.Conn, error) {
-	var (
-		np  *redis.Pool
-		err error
-	)
 	if len(addr) == 0 {
 		return nil, errors.New("invalid addr")
 	}
-	cp.mu.Lock()
-	if cp.connPools == nil {
-		cp.connPools = make(map[string]*redis.Pool)
+	if cp.closed.Load() {
+		return nil, ErrPoolClosed
 	}
-	if cp.connPools[addr] == nil {
-		if cp.CreateConnPool == nil {
-			cp.mu.Unlock()
-			return cp.defaultDial(ctx, addr)
-		}
-		np, err = cp.CreateConnPool(ctx, addr)
-		if err != nil {
-			cp.mu.Unlock()
+	ns := cp.nodeState(addr)
+	if !cp.allowRequest(ns) {
+		err := &CircuitOpenError{Addr: addr}
+		ns.counters.connectFailed(err)
+		return nil, err
+	}
+	np := cp.lookupPool(addr)
+	if np == nil && (cp.CreateConnPool != nil || cp.CreateNodePool != nil) {
+		var err error
+		if np, err = cp.createPool(ctx, addr); err != nil {
+			ns.counters.connectFailed(err)
 			return nil, err
 		}
-		cp.connPools[addr] = np
+	}
+
+	if err := cp.acquireBudget(ctx, addr); err != nil {
+		ns.counters.connectFailed(err)
+		return nil, err
+	}
+	var (
+		conn redis.Conn
+		err  error
+	)
+	if np == nil {
+		conn, err = cp.defaultDial(ctx, addr)
 	} else {
-		np = cp.connPools[addr]
+		conn, err = np.pool.GetContext(ctx)
 	}
-	cp.mu.Unlock()
-	return np.GetContext(ctx)
+	if err != nil {
+		cp.releaseBudget(addr)
+		cp.onResult(addr, ns, err)
+		ns.counters.connectFailed(err)
+		return nil, err
+	}
+	return cp.wrapNodeConn(ns, addr, conn)
+}
+
+// createPool creates the pool of the node address by CreateNodePool or CreateConnPool, the existing one is returned
+// if it's created concurrently
+func (cp *ClusterPool) createPool(ctx context.Context, addr string) (*nodePool, error) {
+	cp.poolMu.Lock()
+	defer cp.poolMu.Unlock()
+	if np := cp.lookupPool(addr); np != nil {
+		return np, nil
+	}
+	if cp.closed.Load() {
+		return nil, ErrPoolClosed
+	}
+	node := cp.nodeInfo(addr)
+	var (
+		pool *redis.Pool
+		err  error
+	)
+	if cp.CreateNodePool != nil {
+		pool, err = cp.CreateNodePool(ctx, node)
+	} else {
+		pool, err = cp.CreateConnPool(ctx, addr)
+	}
+	if err != nil {
+		cp.log(LogWarn, "redicluster: pool creation failed", "addr", addr, "err", err)
+		return nil, err
+	}
+	np := &nodePool{pool: pool, node: node}
+	cp.connPools.Store(addr, np)
+	cp.log(LogInfo, "redicluster: pool created", "addr", addr, "role", node.Role)
+	cp.recordEvent(EventPoolCreated, addr, node.Role)
+	return np, nil
+}
+
+// nodeInfo returns the metadata of the node address, only Addr is set if it's not in the slot mapping
+func (cp *ClusterPool) nodeInfo(addr string) NodeInfo {
+	if n := cp.topology().nodes[addr]; n != nil {
+		return *n
+	}
+	return NodeInfo{Addr: addr, Zone: cp.zoneOf(addr, "")}
 }
 
-func (cp *ClusterPool) getRedisConnBySlot(slot int) (redis.Conn, error) {
+func (cp *ClusterPool) getRedisConnBySlot(ctx context.Context, slot int) (redis.Conn, error) {
 	if slot >= TotalSlots {
 		return nil, errors.New("invalid slot")
 	}
@@ -318,28 +598,22 @@ func (cp *ClusterPool) getRedisConnBySlot(slot int) (redis.Conn, error) {
 		slot = rnd.Intn(TotalSlots)
 		rnd.Unlock()
 	}
-	cp.mu.Lock()
-	if len(cp.slotAddrMap[slot]) > 0 {
-		addr := cp.slotAddrMap[slot][0]
-		cp.mu.Unlock()
-		return cp.getRedisConnByAddr(addr)
+	if sa := cp.topology().addrs(slot); len(sa) > 0 {
+		return cp.getRedisConnByAddr(ctx, sa[0])
 	}
-	cp.mu.Unlock()
-	cp.reloadSlotMaping()
+	cp.reloadSlotMaping(ctx)
 
-	cp.mu.Lock()
-	if len(cp.slotAddrMap[slot]) == 0 {
-		cp.mu.Unlock()
+	sa := cp.topology().addrs(slot)
+	if len(sa) == 0 {
 		return nil, errors.New("no slots")
 	}
-	addr := cp.slotAddrMap[slot][0]
-	cp.mu.Unlock()
-	return cp.getRedisConnByAddr(addr)
+	return cp.getRedisConnByAddr(ctx, sa[0])
 }
 
-func (cp *ClusterPool) reloadSlotMaping() error {
+func (cp *ClusterPool) reloadSlotMaping(ctx context.Context) error {
 	cp.mu.Lock()
 	if cp.reloading {
+		cp.mu.Unlock()
 		return nil
 	}
 	cp.reloading = true
@@ -350,25 +624,55 @@ func (cp *ClusterPool) reloadSlotMaping() error {
 		cp.mu.Unlock()
 	}()
 
+	start := time.Now()
+	addr, err := cp.loadSlotMapping(ctx)
+	d := time.Since(start)
+	cp.reloadStats.record(d, err)
+	if err != nil {
+		cp.log(LogWarn, "redicluster: slot mapping reload failed", "err", err, "duration", d)
+		cp.recordEvent(EventReloadFailed, "", err.Error())
+	} else {
+		cp.log(LogDebug, "redicluster: slot mapping reloaded", "addr", addr, "duration", d)
+	}
+	if len(cp.Hooks) > 0 {
+		cp.hookReload(ctx, &ReloadInfo{Addr: addr, Err: err, Duration: d})
+	}
+	return err
+}
+
+// loadSlotMapping loads the slot mapping from the nodes in turn, and returns the address of the node it's loaded from
+func (cp *ClusterPool) loadSlotMapping(ctx context.Context) (string, error) {
 	nodes := cp.getNodes(true)
 	if len(nodes) == 0 {
-		return errors.New("empty node")
+		return "", errors.New("empty node")
 	}
 	for _, addr := range nodes {
-		conn, err := cp.getRedisConnByAddr(addr)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		conn, err := cp.getRedisConnByAddr(ctx, addr)
 		if err != nil || conn == nil {
 			continue
 		}
-		rep, err := conn.Do("CLUSTER", "SLOTS")
-		conn.Close()
+		// CLUSTER SHARDS is available since redis 7.0 and carries more node details, like role and
+		// availability zone, fall back to CLUSTER SLOTS for the former versions
+		rep, err := connDoContext(conn, ctx, "CLUSTER", "SHARDS")
+		if err == nil {
+			err = cp.updateShardMap(rep)
+		}
 		if err != nil {
-			continue
+			rep, err = connDoContext(conn, ctx, "CLUSTER", "SLOTS")
+			if err == nil {
+				err = cp.updateSlotMap(rep)
+			}
 		}
-		if cp.updateSlotMap(rep) == nil {
-			return nil
+		conn.Close()
+		if err == nil {
+			cp.goBackground(cp.prewarm)
+			return addr, nil
 		}
 	}
-	return errors.New("all nodes failed")
+	return "", errors.New("all nodes failed")
 }
 
 func (cp *ClusterPool) updateSlotMap(rep interface{}) error {
@@ -395,39 +699,313 @@ func (cp *ClusterPool) updateSlotMap(rep interface{}) error {
 			if err != nil {
 				return err
 			}
-			_, err = redis.Scan(fs, &a, &p, &id)
+			meta, err := redis.Scan(fs, &a, &p, &id)
 			if err != nil {
 				return err
 			}
+			// redis 7 appends the metadata of the node, e.g. hostname, and ip if the endpoint is not the IP
+			var hostname, ip string
+			if net.ParseIP(a) != nil {
+				ip = a
+			}
+			if len(meta) > 0 {
+				if m, err := redis.StringMap(meta[0], nil); err == nil {
+					hostname = m["hostname"]
+					if len(m["ip"]) > 0 {
+						ip = m["ip"]
+					}
+				}
+			}
 			addr := fmt.Sprintf("%s:%d", a, p)
-			psi.Nodes = append(psi.Nodes, &nodeInfo{
-				Addr: addr,
-				Id:   id,
+			role := "replica"
+			if len(psi.Nodes) == 0 {
+				role = "master"
+			}
+			psi.Nodes = append(psi.Nodes, &NodeInfo{
+				Addr:     addr,
+				Id:       id,
+				Role:     role,
+				Hostname: hostname,
+				IP:       ip,
+				Zone:     cp.zoneOf(addr, ""),
 			})
 			psi.Addrs = append(psi.Addrs, addr)
 		}
 		sis = append(sis, psi)
 	}
+	cp.setSlots(sis)
+	return nil
+}
+
+// updateShardMap updates the slot mapping by the reply of CLUSTER SHARDS
+func (cp *ClusterPool) updateShardMap(rep interface{}) error {
+	shards, err := redis.Values(rep, nil)
+	if err != nil {
+		return err
+	}
+
+	var sis []*slotInfo
+	for _, sh := range shards {
+		fields, err := redis.Values(sh, nil)
+		if err != nil {
+			return err
+		}
+		var ranges []int
+		var nodes []*NodeInfo
+		for i := 0; i+1 < len(fields); i += 2 {
+			name, _ := redis.String(fields[i], nil)
+			switch name {
+			case "slots":
+				if ranges, err = redis.Ints(fields[i+1], nil); err != nil {
+					return err
+				}
+			case "nodes":
+				nis, err := redis.Values(fields[i+1], nil)
+				if err != nil {
+					return err
+				}
+				for _, ni := range nis {
+					n, err := cp.parseShardNode(ni)
+					if err != nil {
+						return err
+					}
+					if n == nil {
+						continue
+					}
+					// the master is always at index 0, the same as CLUSTER SLOTS
+					if n.Role == "master" {
+						nodes = append([]*NodeInfo{n}, nodes...)
+					} else {
+						nodes = append(nodes, n)
+					}
+				}
+			}
+		}
+		if len(ranges)%2 != 0 {
+			return errors.New("invalid slot ranges")
+		}
+		if len(nodes) == 0 || nodes[0].Role != "master" {
+			// a shard without master or slots can't serve requests
+			continue
+		}
+		var addrs []string
+		for _, n := range nodes {
+			addrs = append(addrs, n.Addr)
+		}
+		for i := 0; i < len(ranges); i += 2 {
+			sis = append(sis, &slotInfo{
+				Start: ranges[i],
+				End:   ranges[i+1],
+				Nodes: nodes,
+				Addrs: addrs,
+			})
+		}
+	}
+	if len(sis) == 0 {
+		return errors.New("no slots")
+	}
+	cp.setSlots(sis)
+	return nil
+}
+
+// parseShardNode parses a node of CLUSTER SHARDS reply, nil is returned if the node is not available
+func (cp *ClusterPool) parseShardNode(rep interface{}) (*NodeInfo, error) {
+	fs, err := redis.Values(rep, nil)
+	if err != nil {
+		return nil, err
+	}
+	// the values are bulk strings or integers, e.g. port and replication-offset
+	m := make(map[string]string, len(fs)/2)
+	for i := 0; i+1 < len(fs); i += 2 {
+		k, err := redis.String(fs[i], nil)
+		if err != nil {
+			return nil, err
+		}
+		if v, ok := fs[i+1].(int64); ok {
+			m[k] = strconv.FormatInt(v, 10)
+		} else {
+			m[k], _ = redis.String(fs[i+1], nil)
+		}
+	}
+	if m["health"] == "fail" {
+		return nil, nil
+	}
+	host := m["endpoint"]
+	if len(host) == 0 || host == "?" {
+		host = m["ip"]
+	}
+	// the TLS port is preferred with TLS, the plaintext port is absent if the node listens on TLS only
+	port := m["port"]
+	if tlsPort := m["tls-port"]; len(tlsPort) > 0 && tlsPort != "0" && (len(port) == 0 || cp.TLSConfig != nil) {
+		port = tlsPort
+	}
+	if len(host) == 0 || len(port) == 0 {
+		return nil, nil
+	}
+	role := m["role"]
+	if role != "master" {
+		role = "replica"
+	}
+	addr := host + ":" + port
+	return &NodeInfo{
+		Addr:     addr,
+		Id:       m["id"],
+		Role:     role,
+		Hostname: m["hostname"],
+		IP:       m["ip"],
+		Zone:     cp.zoneOf(addr, m["availability-zone"]),
+	}, nil
+}
+
+// setSlots replaces the slot mapping and nodes with the slot infos
+func (cp *ClusterPool) setSlots(sis []*slotInfo) {
+	t := newTopology(sis)
+	old := cp.topo.Swap(t)
+	if old == nil {
+		old = emptyTopology
+	}
+	if d := diffTopology(old, t); !d.empty() {
+		cp.log(LogInfo, "redicluster: topology changed", d.args()...)
+		cp.recordEvent(EventTopologyChanged, "", d.String())
+	}
+	stale := cp.removeStalePools(t)
+	cp.removeStaleStates(t)
+	cp.budget.setNodes(len(t.nodes))
+	for _, np := range stale {
+		np.pool.Close()
+	}
+	cp.startBackground()
+}
+
+// removeStalePools removes the pools of the nodes that leave the cluster, and the pools created by CreateNodePool
+// of the nodes whose role changes, so they will be created again with the new role
+func (cp *ClusterPool) removeStalePools(t *topology) []*nodePool {
+	cp.poolMu.Lock()
+	defer cp.poolMu.Unlock()
+	var stale []*nodePool
+	cp.rangePools(func(addr string, np *nodePool) bool {
+		n := t.nodes[addr]
+		if n == nil && !cp.isEntryAddr(addr) {
+			cp.log(LogInfo, "redicluster: pool removed", "addr", addr, "reason", "node left")
+			cp.recordEvent(EventPoolRemoved, addr, "node left")
+		} else if n != nil && cp.CreateNodePool != nil && np.node.Role != n.Role &&
+			(len(np.node.Role) > 0 || n.Role == "replica") {
+			// the pools created before the role is known, e.g. of the entry nodes, are kept unless they must be
+			// READONLY
+			cp.log(LogInfo, "redicluster: pool removed", "addr", addr, "reason", "role changed", "role", n.Role)
+			cp.recordEvent(EventPoolRemoved, addr, "role changed to "+n.Role)
+		} else {
+			return true
+		}
+		stale = append(stale, np)
+		cp.connPools.Delete(addr)
+		return true
+	})
+	return stale
+}
+
+func (cp *ClusterPool) isEntryAddr(addr string) bool {
+	for _, ea := range cp.EntryAddrs {
+		if ea == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// startBackground starts the background goroutines once the topology is loaded
+func (cp *ClusterPool) startBackground() {
 	cp.mu.Lock()
-	cp.slots = sis
-	for _, si := range sis {
-		for i := si.Start; i <= si.End; i++ {
-			cp.slotAddrMap[i] = si.Addrs
+	defer cp.mu.Unlock()
+	if cp.bgStarted || cp.bgClosed {
+		return
+	}
+	cp.bgStarted = true
+	if cp.LatencyProbeInterval > 0 {
+		cp.goEvery(cp.LatencyProbeInterval, cp.probeIdleNodes)
+	}
+	if cp.ReplicationCheckInterval > 0 {
+		cp.goEvery(cp.ReplicationCheckInterval, cp.collectReplication)
+	}
+	if cp.CircuitFailures > 0 {
+		interval := cp.CircuitProbeInterval
+		if interval <= 0 {
+			interval = defaultCircuitProbeInterval
+		}
+		cp.goEvery(interval, cp.probeOpenCircuits)
+	}
+}
+
+// goEvery runs fn every interval in a goroutine until the background is stopped. cp.mu must be held by the caller
+func (cp *ClusterPool) goEvery(interval time.Duration, fn func()) {
+	done := cp.backgroundContext().Done()
+	cp.bgWg.Add(1)
+	go func() {
+		defer cp.bgWg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fn()
+			}
 		}
+	}()
+}
+
+// goBackground runs fn in a goroutine with the context cancelled by stopBackground, which waits it returning
+func (cp *ClusterPool) goBackground(fn func(ctx context.Context)) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.bgClosed {
+		return
+	}
+	ctx := cp.backgroundContext()
+	cp.bgWg.Add(1)
+	go func() {
+		defer cp.bgWg.Done()
+		fn(ctx)
+	}()
+}
+
+// backgroundContext returns the context of the background goroutines. cp.mu must be held by the caller
+func (cp *ClusterPool) backgroundContext() context.Context {
+	if cp.bgCtx == nil {
+		cp.bgCtx, cp.bgCancel = context.WithCancel(context.Background())
+	}
+	return cp.bgCtx
+}
+
+// stopBackground stops the background goroutines and waits them returning, they will not be started again
+func (cp *ClusterPool) stopBackground() {
+	cp.mu.Lock()
+	cp.bgClosed = true
+	if cp.bgCancel != nil {
+		cp.bgCancel()
 	}
 	cp.mu.Unlock()
-	return nil
+	cp.bgWg.Wait()
 }
 
 func (cp *ClusterPool) defaultDial(ctx context.Context, addr string) (redis.Conn, error) {
-	return redis.Dial("tcp", addr, cp.DialOptionsWithoutPool...)
+	// the bytes are counted only without DialOptionsWithoutPool, the counting dialer would override their connect
+	// timeout and keep-alive
+	var d *net.Dialer
+	if len(cp.DialOptionsWithoutPool) == 0 {
+		d = defaultDialer()
+	}
+	conn, err := cp.dial(ctx, addr, d, cp.DialOptionsWithoutPool)
+	if err != nil {
+		return nil, err
+	}
+	return cp.injectFaults(addr, conn), nil
 }
 
 func (cp *ClusterPool) getNodes(replica bool) []string {
 	var nodes []string
-	cp.mu.Lock()
-	defer cp.mu.Unlock()
-	for _, sl := range cp.slots {
+	for _, sl := range cp.topology().slots {
 		for i, n := range sl.Nodes {
 			if i > 0 && !replica {
 				continue
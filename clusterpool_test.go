@@ -6,16 +6,24 @@ import (
 	"time"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/rmker/redicluster/clustertest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-// To run these testing, you should launch a local redis cluster in advance
+// newTestCluster starts an in-memory cluster of 3 masters with a replica each, which is closed with the test
+func newTestCluster(t *testing.T) *clustertest.Cluster {
+	c, err := clustertest.NewCluster(3, 1)
+	require.NoError(t, err)
+	t.Cleanup(c.Close)
+	return c
+}
 
 func WithoutPool(t *testing.T) *ClusterPool {
 	cp := &ClusterPool{
-		EntryAddrs: []string{"127.0.0.1:6379"},
+		EntryAddrs: newTestCluster(t).Addrs()[:1],
 	}
+	t.Cleanup(cp.Close)
 	err := cp.ReloadSlotMapping()
 	assert.NoError(t, err, "ReloadSlotMapping failed")
 	return cp
@@ -54,9 +62,10 @@ func WithPool(t *testing.T) *ClusterPool {
 		}, nil
 	}
 	cp := &ClusterPool{
-		EntryAddrs:     []string{"127.0.0.1:6379"},
+		EntryAddrs:     newTestCluster(t).Addrs()[:1],
 		CreateConnPool: createConnPool,
 	}
+	t.Cleanup(cp.Close)
 	err := cp.ReloadSlotMapping()
 	assert.NoError(t, err, "ReloadSlotMapping failed")
 	return cp
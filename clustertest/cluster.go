@@ -0,0 +1,530 @@
+// Package clustertest provides an in-memory redis cluster for tests. NewCluster starts the nodes as RESP servers on
+// loopback, which serve a subset of the redis commands plus CLUSTER SLOTS, SHARDS and NODES, and redirect the keys
+// they don't own by MOVED and ASK like a real cluster. The tests can script slot migration, failover, node death and
+// latency, so the redirect and pipeline handling of clients can be tested without a real cluster.
+//
+// The replicas of a shard share the dataset with the master, so the writes are visible on them immediately.
+package clustertest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TotalSlots is the count of slots of the cluster
+const TotalSlots = 16384
+
+// Cluster is an in-memory redis cluster
+type Cluster struct {
+	// mu protects all the state of the cluster, its nodes and clients
+	mu    sync.Mutex
+	nodes []*Node
+
+	// owners are the masters serving the slots
+	owners [TotalSlots]*Node
+
+	// migrating are the masters that the slots are migrating to
+	migrating map[int]*Node
+
+	// subscribers of the channels by SUBSCRIBE and SSUBSCRIBE
+	subs  map[string]map[*client]bool
+	ssubs map[string]map[*client]bool
+
+	closed bool
+}
+
+// Node is a node of the Cluster
+type Node struct {
+	// ID is the node id in the cluster, Addr is the address it listens on
+	ID   string
+	Addr string
+
+	c       *Cluster
+	ln      net.Listener
+	master  *Node
+	db      *keyspace
+	latency time.Duration
+	down    bool
+	clients map[*client]bool
+}
+
+// NewCluster starts a cluster of masters, each of which has the count of replicas. The slots are split evenly
+// among the masters
+func NewCluster(masters, replicas int) (*Cluster, error) {
+	if masters <= 0 || replicas < 0 {
+		return nil, errors.New("clustertest: invalid count of nodes")
+	}
+	c := &Cluster{
+		migrating: make(map[int]*Node),
+		subs:      make(map[string]map[*client]bool),
+		ssubs:     make(map[string]map[*client]bool),
+	}
+	for i := 0; i < masters*(1+replicas); i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		n := &Node{
+			ID:      fmt.Sprintf("%040x", i+1),
+			Addr:    ln.Addr().String(),
+			c:       c,
+			ln:      ln,
+			clients: make(map[*client]bool),
+		}
+		if i < masters {
+			n.db = newKeyspace()
+			for s := i * TotalSlots / masters; s < (i+1)*TotalSlots/masters; s++ {
+				c.owners[s] = n
+			}
+		} else {
+			n.master = c.nodes[(i-masters)%masters]
+			n.db = n.master.db
+		}
+		c.nodes = append(c.nodes, n)
+	}
+	for _, n := range c.nodes {
+		go n.serve(n.ln)
+	}
+	return c, nil
+}
+
+// Close stops all the nodes
+func (c *Cluster) Close() {
+	c.mu.Lock()
+	c.closed = true
+	nodes := c.nodes
+	c.mu.Unlock()
+	for _, n := range nodes {
+		n.stop()
+	}
+}
+
+// Addrs returns the addresses of the nodes that are up, the masters first
+func (c *Cluster) Addrs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var addrs []string
+	for _, master := range []bool{true, false} {
+		for _, n := range c.nodes {
+			if !n.down && (n.master == nil) == master {
+				addrs = append(addrs, n.Addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// Nodes returns all the nodes
+func (c *Cluster) Nodes() []*Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*Node(nil), c.nodes...)
+}
+
+// Masters returns the masters
+func (c *Cluster) Masters() []*Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var masters []*Node
+	for _, n := range c.nodes {
+		if n.master == nil {
+			masters = append(masters, n)
+		}
+	}
+	return masters
+}
+
+// Node returns the node of the address, nil if there is none
+func (c *Cluster) Node(addr string) *Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, n := range c.nodes {
+		if n.Addr == addr {
+			return n
+		}
+	}
+	return nil
+}
+
+// Owner returns the master serving the slot
+func (c *Cluster) Owner(slot int) *Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.owners[slot]
+}
+
+// OwnerOf returns the master serving the key
+func (c *Cluster) OwnerOf(key string) *Node {
+	return c.Owner(Slot(key))
+}
+
+// MoveSlots moves the slots from start to end inclusively and their keys to the master at once, the requests of
+// the slots to the former owners are redirected by MOVED
+func (c *Cluster) MoveSlots(start, end int, to *Node) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if to.master != nil {
+		return fmt.Errorf("clustertest: %s is not a master", to.Addr)
+	}
+	for slot := start; slot <= end; slot++ {
+		if from := c.owners[slot]; from != to {
+			from.db.moveSlot(to.db, slot, nil)
+		}
+		c.owners[slot] = to
+		delete(c.migrating, slot)
+	}
+	return nil
+}
+
+// DelSlots unassigns the slots from start to end inclusively like CLUSTER DELSLOTS, the requests of the slots fail
+// with CLUSTERDOWN. The keys are kept on the former owners
+func (c *Cluster) DelSlots(start, end int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for slot := start; slot <= end; slot++ {
+		c.owners[slot] = nil
+		delete(c.migrating, slot)
+	}
+}
+
+// BeginMigration starts migrating the slot to the master, the slot is migrating on its owner and importing on the
+// master. The requests of the keys that have been moved by MigrateKeys are redirected by ASK
+func (c *Cluster) BeginMigration(slot int, to *Node) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if to.master != nil || c.owners[slot] == to {
+		return fmt.Errorf("clustertest: can't migrate slot %d to %s", slot, to.Addr)
+	}
+	c.migrating[slot] = to
+	return nil
+}
+
+// MigrateKeys moves the keys of the migrating slot to the importing master, or all the keys of the slot if no
+// key is given
+func (c *Cluster) MigrateKeys(slot int, keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	to := c.migrating[slot]
+	if to == nil {
+		return fmt.Errorf("clustertest: slot %d is not migrating", slot)
+	}
+	c.owners[slot].db.moveSlot(to.db, slot, keys)
+	return nil
+}
+
+// FinishMigration moves the remaining keys of the migrating slot, and makes the importing master its owner
+func (c *Cluster) FinishMigration(slot int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	to := c.migrating[slot]
+	if to == nil {
+		return fmt.Errorf("clustertest: slot %d is not migrating", slot)
+	}
+	c.owners[slot].db.moveSlot(to.db, slot, nil)
+	c.owners[slot] = to
+	delete(c.migrating, slot)
+	return nil
+}
+
+// Failover promotes the first replica of the master that is up, the master becomes a replica of it. The new
+// master is returned
+func (c *Cluster) Failover(master *Node) (*Node, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if master.master != nil {
+		return nil, fmt.Errorf("clustertest: %s is not a master", master.Addr)
+	}
+	var promoted *Node
+	for _, n := range c.nodes {
+		if n.master == master && !n.down {
+			promoted = n
+			break
+		}
+	}
+	if promoted == nil {
+		return nil, fmt.Errorf("clustertest: %s has no replica to promote", master.Addr)
+	}
+	for _, n := range c.nodes {
+		if n.master == master {
+			n.master = promoted
+		}
+	}
+	promoted.master = nil
+	master.master = promoted
+	for slot, owner := range c.owners {
+		if owner == master {
+			c.owners[slot] = promoted
+		}
+	}
+	for slot, to := range c.migrating {
+		if to == master {
+			c.migrating[slot] = promoted
+		}
+	}
+	return promoted, nil
+}
+
+// Kill stops the node, its connections are closed and it's reported as failed by CLUSTER SHARDS and NODES
+func (n *Node) Kill() {
+	n.c.mu.Lock()
+	n.down = true
+	n.c.mu.Unlock()
+	n.stop()
+}
+
+// Revive starts the killed node on its address again
+func (n *Node) Revive() error {
+	ln, err := net.Listen("tcp", n.Addr)
+	if err != nil {
+		return err
+	}
+	n.c.mu.Lock()
+	defer n.c.mu.Unlock()
+	n.down = false
+	n.ln = ln
+	go n.serve(ln)
+	return nil
+}
+
+// SetLatency delays every reply of the node by d
+func (n *Node) SetLatency(d time.Duration) {
+	n.c.mu.Lock()
+	defer n.c.mu.Unlock()
+	n.latency = d
+}
+
+// Clients returns the count of the connections to the node
+func (n *Node) Clients() int {
+	n.c.mu.Lock()
+	defer n.c.mu.Unlock()
+	return len(n.clients)
+}
+
+// IsMaster reports if the node is a master
+func (n *Node) IsMaster() bool {
+	n.c.mu.Lock()
+	defer n.c.mu.Unlock()
+	return n.master == nil
+}
+
+// Master returns the master of the replica, nil if the node is a master
+func (n *Node) Master() *Node {
+	n.c.mu.Lock()
+	defer n.c.mu.Unlock()
+	return n.master
+}
+
+// Replicas returns the replicas of the master
+func (n *Node) Replicas() []*Node {
+	n.c.mu.Lock()
+	defer n.c.mu.Unlock()
+	return n.replicas()
+}
+
+// replicas returns the replicas of the master. c.mu must be held by the caller
+func (n *Node) replicas() []*Node {
+	var rs []*Node
+	for _, r := range n.c.nodes {
+		if r.master == n {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+// shard returns the master of the shard the node belongs to. c.mu must be held by the caller
+func (n *Node) shard() *Node {
+	if n.master != nil {
+		return n.master
+	}
+	return n
+}
+
+// stop closes the listener and the connections of the node
+func (n *Node) stop() {
+	n.c.mu.Lock()
+	ln := n.ln
+	clients := n.clients
+	n.clients = make(map[*client]bool)
+	n.c.mu.Unlock()
+	ln.Close()
+	for cl := range clients {
+		cl.conn.Close()
+	}
+}
+
+func (n *Node) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		cl := newClient(n, conn)
+		n.c.mu.Lock()
+		if n.down || n.c.closed {
+			n.c.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		n.clients[cl] = true
+		n.c.mu.Unlock()
+		go cl.serve()
+	}
+}
+
+func (n *Node) hostPort() (string, int) {
+	host, port, _ := net.SplitHostPort(n.Addr)
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
+// slotRange is a range of slots served by a master
+type slotRange struct {
+	start, end int
+	master     *Node
+}
+
+// slotRanges returns the ranges of the slots ordered by the start slot. c.mu must be held by the caller
+func (c *Cluster) slotRanges() []slotRange {
+	var srs []slotRange
+	for slot, owner := range c.owners {
+		if owner == nil {
+			continue
+		}
+		if last := len(srs) - 1; last >= 0 && srs[last].master == owner && srs[last].end == slot-1 {
+			srs[last].end = slot
+			continue
+		}
+		srs = append(srs, slotRange{start: slot, end: slot, master: owner})
+	}
+	return srs
+}
+
+// clusterSlots returns the reply of CLUSTER SLOTS, the failed replicas are excluded. c.mu must be held by the
+// caller
+func (c *Cluster) clusterSlots() []interface{} {
+	var reply []interface{}
+	for _, sr := range c.slotRanges() {
+		item := []interface{}{int64(sr.start), int64(sr.end)}
+		for _, n := range append([]*Node{sr.master}, sr.master.replicas()...) {
+			if n.down && n.master != nil {
+				continue
+			}
+			host, port := n.hostPort()
+			item = append(item, []interface{}{host, int64(port), n.ID})
+		}
+		reply = append(reply, item)
+	}
+	return reply
+}
+
+// clusterShards returns the reply of CLUSTER SHARDS. c.mu must be held by the caller
+func (c *Cluster) clusterShards() []interface{} {
+	ranges := make(map[*Node][]interface{})
+	for _, sr := range c.slotRanges() {
+		ranges[sr.master] = append(ranges[sr.master], int64(sr.start), int64(sr.end))
+	}
+	var reply []interface{}
+	for _, m := range c.nodes {
+		if m.master != nil {
+			continue
+		}
+		var nodes []interface{}
+		for _, n := range append([]*Node{m}, m.replicas()...) {
+			host, port := n.hostPort()
+			role, health := "master", "online"
+			if n.master != nil {
+				role = "replica"
+			}
+			if n.down {
+				health = "fail"
+			}
+			nodes = append(nodes, []interface{}{
+				"id", n.ID, "port", int64(port), "ip", host, "endpoint", host, "role", role,
+				"replication-offset", m.db.offset, "health", health,
+			})
+		}
+		slots := ranges[m]
+		if slots == nil {
+			slots = []interface{}{}
+		}
+		reply = append(reply, []interface{}{"slots", slots, "nodes", nodes})
+	}
+	return reply
+}
+
+// clusterNodes returns the reply of CLUSTER NODES to the node. c.mu must be held by the caller
+func (c *Cluster) clusterNodes(myself *Node) string {
+	ranges := make(map[*Node][]string)
+	for _, sr := range c.slotRanges() {
+		r := strconv.Itoa(sr.start)
+		if sr.end > sr.start {
+			r += "-" + strconv.Itoa(sr.end)
+		}
+		ranges[sr.master] = append(ranges[sr.master], r)
+	}
+	var sb strings.Builder
+	for _, n := range c.nodes {
+		var flags []string
+		if n == myself {
+			flags = append(flags, "myself")
+		}
+		master := "-"
+		if n.master == nil {
+			flags = append(flags, "master")
+		} else {
+			flags = append(flags, "slave")
+			master = n.master.ID
+		}
+		link := "connected"
+		if n.down {
+			flags = append(flags, "fail")
+			link = "disconnected"
+		}
+		_, port := n.hostPort()
+		fmt.Fprintf(&sb, "%s %s@%d %s %s 0 0 0 %s", n.ID, n.Addr, port+10000, strings.Join(flags, ","), master, link)
+		for _, r := range ranges[n] {
+			sb.WriteString(" " + r)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// clusterInfo returns the reply of CLUSTER INFO. c.mu must be held by the caller
+func (c *Cluster) clusterInfo() string {
+	assigned, masters := 0, 0
+	for _, owner := range c.owners {
+		if owner != nil {
+			assigned++
+		}
+	}
+	for _, n := range c.nodes {
+		if n.master == nil {
+			masters++
+		}
+	}
+	state := "ok"
+	if assigned < TotalSlots {
+		state = "fail"
+	}
+	return fmt.Sprintf("cluster_state:%s\r\ncluster_slots_assigned:%d\r\ncluster_slots_ok:%d\r\n"+
+		"cluster_known_nodes:%d\r\ncluster_size:%d\r\n", state, assigned, assigned, len(c.nodes), masters)
+}
+
+// subscribers returns the clients subscribing the channel, ordered for deterministic delivery
+func subscribers(subs map[string]map[*client]bool, channel string) []*client {
+	var cls []*client
+	for cl := range subs[channel] {
+		cls = append(cls, cl)
+	}
+	sort.Slice(cls, func(i, j int) bool { return cls[i].id < cls[j].id })
+	return cls
+}
@@ -0,0 +1,305 @@
+package clustertest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCluster(t *testing.T, masters, replicas int) *Cluster {
+	c, err := NewCluster(masters, replicas)
+	require.NoError(t, err)
+	t.Cleanup(c.Close)
+	return c
+}
+
+func dial(t *testing.T, n *Node) redis.Conn {
+	conn, err := redis.Dial("tcp", n.Addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestSlot(t *testing.T) {
+	assert.Equal(t, 15495, Slot("a"))
+	assert.Equal(t, 3300, Slot("b"))
+	assert.Equal(t, 12182, Slot("foo"))
+	assert.Equal(t, Slot("bar"), Slot("{bar}.baz"))
+	assert.Equal(t, Slot("{}.baz"), Slot("{}.baz"))
+	assert.NotEqual(t, Slot("bar"), Slot("{}bar"))
+}
+
+func TestMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+	} {
+		assert.Equal(t, c.want, match(c.pattern, c.s), "%s %s", c.pattern, c.s)
+	}
+}
+
+func TestTopology(t *testing.T) {
+	c := newCluster(t, 3, 1)
+	assert.Len(t, c.Addrs(), 6)
+	masters := c.Masters()
+	require.Len(t, masters, 3)
+	require.Len(t, masters[0].Replicas(), 1)
+
+	conn := dial(t, masters[0])
+	slots, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	require.NoError(t, err)
+	require.Len(t, slots, 3)
+	var start, end int
+	var nodes []interface{}
+	_, err = redis.Scan(slots[1].([]interface{}), &start, &end)
+	require.NoError(t, err)
+	assert.Equal(t, []int{5461, 10921}, []int{start, end})
+	nodes = slots[1].([]interface{})[2:]
+	require.Len(t, nodes, 2)
+	assert.Equal(t, masters[1].ID, string(nodes[0].([]interface{})[2].([]byte)))
+
+	shards, err := redis.Values(conn.Do("CLUSTER", "SHARDS"))
+	require.NoError(t, err)
+	require.Len(t, shards, 3)
+
+	text, err := redis.String(conn.Do("CLUSTER", "NODES"))
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	require.Len(t, lines, 6)
+	assert.Contains(t, lines[0], "myself,master - 0 0 0 connected 0-5460")
+	assert.Contains(t, lines[3], "slave "+masters[0].ID)
+
+	c.DelSlots(0, 99)
+	slots, err = redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	require.NoError(t, err)
+	_, err = redis.Scan(slots[0].([]interface{}), &start, &end)
+	require.NoError(t, err)
+	assert.Equal(t, []int{100, 5460}, []int{start, end})
+}
+
+func TestRedirects(t *testing.T) {
+	c := newCluster(t, 2, 1)
+	owner := c.OwnerOf("foo")
+	var other *Node
+	for _, m := range c.Masters() {
+		if m != owner {
+			other = m
+		}
+	}
+	conn := dial(t, other)
+	_, err := conn.Do("SET", "foo", "1")
+	assert.EqualError(t, err, fmt.Sprintf("MOVED %d %s", Slot("foo"), owner.Addr))
+	_, err = conn.Do("MGET", "a", "b")
+	assert.Contains(t, err.Error(), "CROSSSLOT")
+
+	oc := dial(t, owner)
+	_, err = oc.Do("SET", "foo", "1")
+	require.NoError(t, err)
+
+	// the replica redirects the reads to the master until READONLY
+	rc := dial(t, owner.Replicas()[0])
+	_, err = rc.Do("GET", "foo")
+	assert.EqualError(t, err, fmt.Sprintf("MOVED %d %s", Slot("foo"), owner.Addr))
+	_, err = rc.Do("READONLY")
+	require.NoError(t, err)
+	v, err := redis.String(rc.Do("GET", "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, "1", v)
+	_, err = rc.Do("SET", "foo", "2")
+	assert.Error(t, err)
+
+	// migration
+	slot := Slot("foo")
+	require.NoError(t, c.BeginMigration(slot, other))
+	v, err = redis.String(oc.Do("GET", "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, "1", v)
+	_, err = oc.Do("GET", "{foo}.missing")
+	assert.EqualError(t, err, fmt.Sprintf("ASK %d %s", slot, other.Addr))
+
+	require.NoError(t, c.MigrateKeys(slot))
+	_, err = oc.Do("GET", "foo")
+	assert.EqualError(t, err, fmt.Sprintf("ASK %d %s", slot, other.Addr))
+	_, err = conn.Do("GET", "foo")
+	assert.EqualError(t, err, fmt.Sprintf("MOVED %d %s", slot, owner.Addr), "ASKING is required")
+	_, err = conn.Do("ASKING")
+	require.NoError(t, err)
+	v, err = redis.String(conn.Do("GET", "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, "1", v)
+
+	require.NoError(t, c.FinishMigration(slot))
+	assert.Equal(t, other, c.Owner(slot))
+	_, err = oc.Do("GET", "foo")
+	assert.EqualError(t, err, fmt.Sprintf("MOVED %d %s", slot, other.Addr))
+	v, err = redis.String(conn.Do("GET", "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, "1", v)
+
+	require.NoError(t, c.MoveSlots(slot, slot, owner))
+	v, err = redis.String(oc.Do("GET", "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, "1", v)
+}
+
+func TestFailoverAndKill(t *testing.T) {
+	c := newCluster(t, 1, 2)
+	master := c.Masters()[0]
+	conn := dial(t, master)
+	_, err := conn.Do("SET", "k", "v")
+	require.NoError(t, err)
+
+	replicas := master.Replicas()
+	replicas[0].Kill()
+	_, err = redis.Dial("tcp", replicas[0].Addr)
+	assert.Error(t, err)
+	assert.Len(t, c.Addrs(), 2)
+
+	promoted, err := c.Failover(master)
+	require.NoError(t, err)
+	assert.Equal(t, replicas[1], promoted)
+	assert.True(t, promoted.IsMaster())
+	assert.Equal(t, promoted, master.Master())
+	assert.Equal(t, promoted, replicas[0].Master())
+
+	pc := dial(t, promoted)
+	v, err := redis.String(pc.Do("GET", "k"))
+	require.NoError(t, err)
+	assert.Equal(t, "v", v)
+	_, err = conn.Do("SET", "k", "v2")
+	assert.EqualError(t, err, fmt.Sprintf("MOVED %d %s", Slot("k"), promoted.Addr))
+
+	text, err := redis.String(pc.Do("CLUSTER", "NODES"))
+	require.NoError(t, err)
+	assert.Contains(t, text, "slave,fail")
+
+	require.NoError(t, replicas[0].Revive())
+	rc := dial(t, replicas[0])
+	_, err = rc.Do("PING")
+	assert.NoError(t, err)
+}
+
+func TestLatency(t *testing.T) {
+	c := newCluster(t, 1, 0)
+	n := c.Masters()[0]
+	conn := dial(t, n)
+	n.SetLatency(50 * time.Millisecond)
+	start := time.Now()
+	_, err := conn.Do("PING")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestCommands(t *testing.T) {
+	c := newCluster(t, 1, 0)
+	conn := dial(t, c.Masters()[0])
+	for i := 0; i < 15; i++ {
+		_, err := conn.Do("SET", fmt.Sprintf("user:%02d", i), i)
+		require.NoError(t, err)
+	}
+	_, err := conn.Do("HSET", "user:h", "f1", "v1", "f2", "v2")
+	require.NoError(t, err)
+	_, err = conn.Do("GET", "user:h")
+	assert.EqualError(t, err, "WRONGTYPE Operation against a key holding the wrong kind of value")
+
+	var keys []string
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", "user:*", "COUNT", 4, "TYPE", "string"))
+		require.NoError(t, err)
+		cursor, _ = redis.Int(reply[0], nil)
+		ks, _ := redis.Strings(reply[1], nil)
+		keys = append(keys, ks...)
+		if cursor == 0 {
+			break
+		}
+	}
+	assert.Len(t, keys, 15)
+
+	n, err := redis.Int(conn.Do("INCRBY", "counter", 5))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	_, err = conn.Do("SET", "tmp", "v", "PX", 20)
+	require.NoError(t, err)
+	ttl, err := redis.Int(conn.Do("PTTL", "tmp"))
+	require.NoError(t, err)
+	assert.Greater(t, ttl, 0)
+	time.Sleep(30 * time.Millisecond)
+	exists, err := redis.Int(conn.Do("EXISTS", "tmp"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, exists)
+
+	h, err := redis.StringMap(conn.Do("HGETALL", "user:h"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"f1": "v1", "f2": "v2"}, h)
+	_, err = conn.Do("NOSUCH")
+	assert.EqualError(t, err, "ERR unknown command 'NOSUCH'")
+}
+
+func TestPubSub(t *testing.T) {
+	c := newCluster(t, 2, 0)
+	masters := c.Masters()
+	sub := redis.PubSubConn{Conn: dial(t, masters[0])}
+	require.NoError(t, sub.Subscribe("chn"))
+	assert.Equal(t, redis.Subscription{Kind: "subscribe", Channel: "chn", Count: 1}, sub.Receive())
+
+	pub := dial(t, masters[1])
+	n, err := redis.Int(pub.Do("PUBLISH", "chn", "hi"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, redis.Message{Channel: "chn", Data: []byte("hi")}, sub.Receive())
+}
+
+func TestTransaction(t *testing.T) {
+	c := newCluster(t, 1, 0)
+	conn := dial(t, c.Masters()[0])
+	_, err := conn.Do("EXEC")
+	assert.EqualError(t, err, "ERR EXEC without MULTI")
+
+	require.NoError(t, conn.Send("MULTI"))
+	require.NoError(t, conn.Send("SET", "k", "v"))
+	require.NoError(t, conn.Send("INCR", "n"))
+	require.NoError(t, conn.Send("EXEC"))
+	replies, err := redis.Values(conn.Do(""))
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"OK", "QUEUED", "QUEUED", []interface{}{"OK", int64(1)}}, replies)
+
+	// the rejected command aborts the transaction
+	_, err = conn.Do("MULTI")
+	require.NoError(t, err)
+	_, err = conn.Do("SET", "k")
+	assert.Error(t, err)
+	_, err = conn.Do("INCR", "n")
+	require.NoError(t, err)
+	_, err = conn.Do("EXEC")
+	assert.EqualError(t, err, "EXECABORT Transaction discarded because of previous errors.")
+	n, err := redis.Int(conn.Do("GET", "n"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	_, err = conn.Do("MULTI")
+	require.NoError(t, err)
+	_, err = conn.Do("INCR", "n")
+	require.NoError(t, err)
+	_, err = conn.Do("DISCARD")
+	require.NoError(t, err)
+	n, err = redis.Int(conn.Do("GET", "n"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
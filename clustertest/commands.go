@@ -0,0 +1,863 @@
+package clustertest
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// command is a command served by the nodes
+type command struct {
+	fn func(cl *client, args [][]byte) interface{}
+
+	// arity is the exact count of arguments including the command name if it's positive, or the minimum count
+	// if it's negative, the same as COMMAND INFO
+	arity int
+
+	// keys returns the keys of the command, nil for the commands without key
+	keys func(args [][]byte) [][]byte
+
+	// write indicates the command modifies the dataset, which is redirected to the master by replicas
+	write bool
+
+	// pubsub indicates the command is allowed in the subscribed state
+	pubsub bool
+
+	// tx indicates the command is executed immediately in a transaction instead of being queued
+	tx bool
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"PING":      {fn: cmdPing, arity: -1, pubsub: true},
+		"ECHO":      {fn: cmdEcho, arity: 2},
+		"QUIT":      {fn: cmdOK, arity: 1, pubsub: true},
+		"SELECT":    {fn: cmdSelect, arity: 2},
+		"READONLY":  {fn: cmdReadOnly, arity: 1},
+		"READWRITE": {fn: cmdReadWrite, arity: 1},
+		"ASKING":    {fn: cmdAsking, arity: 1},
+		"CLIENT":    {fn: cmdClient, arity: -2},
+		"INFO":      {fn: cmdInfo, arity: -1},
+		"CLUSTER":   {fn: cmdCluster, arity: -2},
+		"WAIT":      {fn: cmdWait, arity: 3},
+		"DBSIZE":    {fn: cmdDBSize, arity: 1},
+		"FLUSHALL":  {fn: cmdFlush, arity: -1, write: true},
+		"FLUSHDB":   {fn: cmdFlush, arity: -1, write: true},
+		"KEYS":      {fn: cmdKeys, arity: 2},
+		"MULTI":     {fn: cmdMulti, arity: 1, tx: true},
+		"EXEC":      {fn: cmdExec, arity: 1, tx: true},
+		"DISCARD":   {fn: cmdDiscard, arity: 1, tx: true},
+		"WATCH":     {fn: cmdWatch, arity: -2, keys: allKeys, tx: true},
+		"UNWATCH":   {fn: cmdOK, arity: 1, tx: true},
+		"SCAN":      {fn: cmdScan, arity: -2},
+
+		"GET":     {fn: cmdGet, arity: 2, keys: firstKey},
+		"SET":     {fn: cmdSet, arity: -3, keys: firstKey, write: true},
+		"INCR":    {fn: cmdIncr, arity: 2, keys: firstKey, write: true},
+		"INCRBY":  {fn: cmdIncr, arity: 3, keys: firstKey, write: true},
+		"DECR":    {fn: cmdIncr, arity: 2, keys: firstKey, write: true},
+		"DECRBY":  {fn: cmdIncr, arity: 3, keys: firstKey, write: true},
+		"APPEND":  {fn: cmdAppend, arity: 3, keys: firstKey, write: true},
+		"STRLEN":  {fn: cmdStrlen, arity: 2, keys: firstKey},
+		"MGET":    {fn: cmdMget, arity: -2, keys: allKeys},
+		"MSET":    {fn: cmdMset, arity: -3, keys: pairKeys, write: true},
+		"DEL":     {fn: cmdDel, arity: -2, keys: allKeys, write: true},
+		"UNLINK":  {fn: cmdDel, arity: -2, keys: allKeys, write: true},
+		"EXISTS":  {fn: cmdExists, arity: -2, keys: allKeys},
+		"EXPIRE":  {fn: cmdExpire, arity: 3, keys: firstKey, write: true},
+		"PEXPIRE": {fn: cmdExpire, arity: 3, keys: firstKey, write: true},
+		"PERSIST": {fn: cmdPersist, arity: 2, keys: firstKey, write: true},
+		"TTL":     {fn: cmdTTL, arity: 2, keys: firstKey},
+		"PTTL":    {fn: cmdTTL, arity: 2, keys: firstKey},
+		"TYPE":    {fn: cmdType, arity: 2, keys: firstKey},
+
+		"HSET":    {fn: cmdHset, arity: -4, keys: firstKey, write: true},
+		"HGET":    {fn: cmdHget, arity: 3, keys: firstKey},
+		"HDEL":    {fn: cmdHdel, arity: -3, keys: firstKey, write: true},
+		"HGETALL": {fn: cmdHgetall, arity: 2, keys: firstKey},
+		"HLEN":    {fn: cmdHlen, arity: 2, keys: firstKey},
+
+		"LPUSH":  {fn: cmdPush, arity: -3, keys: firstKey, write: true},
+		"RPUSH":  {fn: cmdPush, arity: -3, keys: firstKey, write: true},
+		"LRANGE": {fn: cmdLrange, arity: 4, keys: firstKey},
+		"LLEN":   {fn: cmdLlen, arity: 2, keys: firstKey},
+
+		"SADD":      {fn: cmdSadd, arity: -3, keys: firstKey, write: true},
+		"SMEMBERS":  {fn: cmdSmembers, arity: 2, keys: firstKey},
+		"SCARD":     {fn: cmdScard, arity: 2, keys: firstKey},
+		"SISMEMBER": {fn: cmdSismember, arity: 3, keys: firstKey},
+
+		"PUBLISH":      {fn: cmdPublish, arity: 3},
+		"SUBSCRIBE":    {fn: cmdSubscribe, arity: -2, pubsub: true},
+		"UNSUBSCRIBE":  {fn: cmdUnsubscribe, arity: -1, pubsub: true},
+		"SPUBLISH":     {fn: cmdPublish, arity: 3, keys: firstKey},
+		"SSUBSCRIBE":   {fn: cmdSubscribe, arity: -2, keys: allKeys, pubsub: true},
+		"SUNSUBSCRIBE": {fn: cmdUnsubscribe, arity: -1, pubsub: true},
+	}
+}
+
+func firstKey(args [][]byte) [][]byte {
+	return args[1:2]
+}
+
+func allKeys(args [][]byte) [][]byte {
+	return args[1:]
+}
+
+// pairKeys returns the keys of the key value pairs
+func pairKeys(args [][]byte) [][]byte {
+	var keys [][]byte
+	for i := 1; i < len(args); i += 2 {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+func cmdName(args [][]byte) string {
+	return strings.ToUpper(string(args[0]))
+}
+
+func cmdOK(cl *client, args [][]byte) interface{} {
+	return okStatus
+}
+
+func cmdPing(cl *client, args [][]byte) interface{} {
+	if len(cl.subs)+len(cl.ssubs) > 0 {
+		data := ""
+		if len(args) > 1 {
+			data = string(args[1])
+		}
+		return []interface{}{"pong", data}
+	}
+	if len(args) > 1 {
+		return args[1]
+	}
+	return status("PONG")
+}
+
+func cmdEcho(cl *client, args [][]byte) interface{} {
+	return args[1]
+}
+
+func cmdSelect(cl *client, args [][]byte) interface{} {
+	if string(args[1]) != "0" {
+		return respError("ERR SELECT is not allowed in cluster mode")
+	}
+	return okStatus
+}
+
+func cmdReadOnly(cl *client, args [][]byte) interface{} {
+	cl.readOnly = true
+	return okStatus
+}
+
+func cmdReadWrite(cl *client, args [][]byte) interface{} {
+	cl.readOnly = false
+	return okStatus
+}
+
+func cmdAsking(cl *client, args [][]byte) interface{} {
+	cl.asking = true
+	return okStatus
+}
+
+func cmdClient(cl *client, args [][]byte) interface{} {
+	switch strings.ToUpper(string(args[1])) {
+	case "SETNAME":
+		if len(args) != 3 {
+			return syntaxErr
+		}
+		cl.name = string(args[2])
+	case "GETNAME":
+		if len(cl.name) == 0 {
+			return nil
+		}
+		return cl.name
+	case "ID":
+		return cl.id
+	}
+	return okStatus
+}
+
+func cmdMulti(cl *client, args [][]byte) interface{} {
+	if cl.multi {
+		return respError("ERR MULTI calls can not be nested")
+	}
+	cl.multi = true
+	return okStatus
+}
+
+// cmdExec executes the queued commands, the replies of the commands are returned in an array
+func cmdExec(cl *client, args [][]byte) interface{} {
+	if !cl.multi {
+		return respError("ERR EXEC without MULTI")
+	}
+	queued, aborted := cl.queued, cl.aborted
+	cl.multi, cl.aborted, cl.queued = false, false, nil
+	if aborted {
+		return respError("EXECABORT Transaction discarded because of previous errors.")
+	}
+	replies := make([]interface{}, len(queued))
+	for i, args := range queued {
+		replies[i] = cl.run(commands[cmdName(args)], args, false)
+	}
+	return replies
+}
+
+func cmdDiscard(cl *client, args [][]byte) interface{} {
+	if !cl.multi {
+		return respError("ERR DISCARD without MULTI")
+	}
+	cl.multi, cl.aborted, cl.queued = false, false, nil
+	return okStatus
+}
+
+// cmdWatch is accepted outside of transactions only, the transactions are not aborted by the changes of the
+// watched keys
+func cmdWatch(cl *client, args [][]byte) interface{} {
+	if cl.multi {
+		return respError("ERR WATCH inside MULTI is not allowed")
+	}
+	return okStatus
+}
+
+func cmdInfo(cl *client, args [][]byte) interface{} {
+	n := cl.n
+	var sb strings.Builder
+	section := "all"
+	if len(args) > 1 {
+		section = strings.ToLower(string(args[1]))
+	}
+	all := section == "all" || section == "everything" || section == "default"
+	if all || section == "server" {
+		sb.WriteString("# Server\r\nredis_version:7.2.0\r\nredis_mode:cluster\r\n")
+	}
+	if all || section == "replication" {
+		sb.WriteString("# Replication\r\n")
+		if n.master == nil {
+			replicas := n.replicas()
+			fmt.Fprintf(&sb, "role:master\r\nconnected_slaves:%d\r\n", len(replicas))
+			for i, r := range replicas {
+				host, port := r.hostPort()
+				state := "online"
+				if r.down {
+					state = "wait_bgsave"
+				}
+				fmt.Fprintf(&sb, "slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=0\r\n", i, host, port, state, n.db.offset)
+			}
+			fmt.Fprintf(&sb, "master_repl_offset:%d\r\n", n.db.offset)
+		} else {
+			host, port := n.master.hostPort()
+			fmt.Fprintf(&sb, "role:slave\r\nmaster_host:%s\r\nmaster_port:%d\r\nmaster_link_status:up\r\n"+
+				"slave_repl_offset:%d\r\nmaster_repl_offset:%d\r\n", host, port, n.db.offset, n.db.offset)
+		}
+	}
+	return sb.String()
+}
+
+func cmdCluster(cl *client, args [][]byte) interface{} {
+	c := cl.n.c
+	switch strings.ToUpper(string(args[1])) {
+	case "SLOTS":
+		return c.clusterSlots()
+	case "SHARDS":
+		return c.clusterShards()
+	case "NODES":
+		return c.clusterNodes(cl.n)
+	case "INFO":
+		return c.clusterInfo()
+	case "MYID":
+		return cl.n.ID
+	case "KEYSLOT":
+		if len(args) != 3 {
+			return syntaxErr
+		}
+		return Slot(string(args[2]))
+	case "COUNTKEYSINSLOT":
+		if len(args) != 3 {
+			return syntaxErr
+		}
+		slot, err := strconv.Atoi(string(args[2]))
+		if err != nil || slot < 0 || slot >= TotalSlots {
+			return respError("ERR Invalid slot")
+		}
+		count := 0
+		for _, k := range cl.n.db.sortedKeys() {
+			if Slot(k) == slot {
+				count++
+			}
+		}
+		return count
+	}
+	return respError(fmt.Sprintf("ERR unknown subcommand '%s'", args[1]))
+}
+
+func cmdWait(cl *client, args [][]byte) interface{} {
+	count := 0
+	for _, r := range cl.n.shard().replicas() {
+		if !r.down {
+			count++
+		}
+	}
+	return count
+}
+
+func cmdDBSize(cl *client, args [][]byte) interface{} {
+	return len(cl.n.db.sortedKeys())
+}
+
+func cmdFlush(cl *client, args [][]byte) interface{} {
+	if cl.n.master != nil {
+		return respError("READONLY You can't write against a read only replica.")
+	}
+	cl.n.db.keys = make(map[string]*entry)
+	return okStatus
+}
+
+func cmdKeys(cl *client, args [][]byte) interface{} {
+	keys := []string{}
+	for _, k := range cl.n.db.sortedKeys() {
+		if match(string(args[1]), k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// cmdScan iterates the keys in order, the cursor is the index of the next key
+func cmdScan(cl *client, args [][]byte) interface{} {
+	cursor, err := strconv.Atoi(string(args[1]))
+	if err != nil || cursor < 0 {
+		return respError("ERR invalid cursor")
+	}
+	pattern, typ, count := "*", "", 10
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return syntaxErr
+		}
+		v := string(args[i+1])
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = v
+		case "COUNT":
+			if count, err = strconv.Atoi(v); err != nil || count < 1 {
+				return syntaxErr
+			}
+		case "TYPE":
+			typ = strings.ToLower(v)
+		default:
+			return syntaxErr
+		}
+	}
+	db := cl.n.db
+	all := db.sortedKeys()
+	keys := []string{}
+	next := cursor
+	for ; next < len(all) && next < cursor+count; next++ {
+		k := all[next]
+		if match(pattern, k) && (len(typ) == 0 || db.lookup(k).typeName() == typ) {
+			keys = append(keys, k)
+		}
+	}
+	if next >= len(all) {
+		next = 0
+	}
+	return []interface{}{strconv.Itoa(next), keys}
+}
+
+// lookupType returns the entry of the key, and wrongType if it holds a value other than the type of v
+func lookupType(cl *client, key []byte, v interface{}) (*entry, interface{}) {
+	e := cl.n.db.lookup(string(key))
+	if e == nil {
+		return nil, nil
+	}
+	if fmt.Sprintf("%T", e.value) != fmt.Sprintf("%T", v) {
+		return nil, wrongType
+	}
+	return e, nil
+}
+
+func cmdGet(cl *client, args [][]byte) interface{} {
+	e, errReply := lookupType(cl, args[1], "")
+	if e == nil {
+		return errReply
+	}
+	return e.value.(string)
+}
+
+func cmdSet(cl *client, args [][]byte) interface{} {
+	db := cl.n.db
+	key := string(args[1])
+	var expireAt time.Time
+	nx, xx := false, false
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				return syntaxErr
+			}
+			v, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || v <= 0 {
+				return respError("ERR invalid expire time in 'set' command")
+			}
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			expireAt = time.Now().Add(time.Duration(v) * unit)
+			i++
+		default:
+			return syntaxErr
+		}
+	}
+	exists := db.lookup(key) != nil
+	if (nx && exists) || (xx && !exists) {
+		return nil
+	}
+	db.keys[key] = &entry{value: string(args[2]), expireAt: expireAt}
+	return okStatus
+}
+
+func cmdIncr(cl *client, args [][]byte) interface{} {
+	e, errReply := lookupType(cl, args[1], "")
+	if errReply != nil {
+		return errReply
+	}
+	delta := int64(1)
+	if len(args) > 2 {
+		var err error
+		if delta, err = strconv.ParseInt(string(args[2]), 10, 64); err != nil {
+			return notInt
+		}
+	}
+	if strings.HasPrefix(cmdName(args), "DECR") {
+		delta = -delta
+	}
+	var v int64
+	if e != nil {
+		var err error
+		if v, err = strconv.ParseInt(e.value.(string), 10, 64); err != nil {
+			return notInt
+		}
+	} else {
+		e = &entry{}
+		cl.n.db.keys[string(args[1])] = e
+	}
+	if (delta > 0 && v > math.MaxInt64-delta) || (delta < 0 && v < math.MinInt64-delta) {
+		return respError("ERR increment or decrement would overflow")
+	}
+	v += delta
+	e.value = strconv.FormatInt(v, 10)
+	return v
+}
+
+func cmdAppend(cl *client, args [][]byte) interface{} {
+	e, errReply := lookupType(cl, args[1], "")
+	if errReply != nil {
+		return errReply
+	}
+	if e == nil {
+		e = &entry{value: ""}
+		cl.n.db.keys[string(args[1])] = e
+	}
+	e.value = e.value.(string) + string(args[2])
+	return len(e.value.(string))
+}
+
+func cmdStrlen(cl *client, args [][]byte) interface{} {
+	e, errReply := lookupType(cl, args[1], "")
+	if e == nil {
+		if errReply != nil {
+			return errReply
+		}
+		return 0
+	}
+	return len(e.value.(string))
+}
+
+func cmdMget(cl *client, args [][]byte) interface{} {
+	values := make([]interface{}, 0, len(args)-1)
+	for _, k := range args[1:] {
+		var v interface{}
+		if e := cl.n.db.lookup(string(k)); e != nil {
+			if s, ok := e.value.(string); ok {
+				v = s
+			}
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func cmdMset(cl *client, args [][]byte) interface{} {
+	if len(args)%2 == 0 {
+		return respError("ERR wrong number of arguments for 'mset' command")
+	}
+	for i := 1; i < len(args); i += 2 {
+		cl.n.db.keys[string(args[i])] = &entry{value: string(args[i+1])}
+	}
+	return okStatus
+}
+
+func cmdDel(cl *client, args [][]byte) interface{} {
+	count := 0
+	for _, k := range args[1:] {
+		if cl.n.db.lookup(string(k)) != nil {
+			delete(cl.n.db.keys, string(k))
+			count++
+		}
+	}
+	return count
+}
+
+func cmdExists(cl *client, args [][]byte) interface{} {
+	count := 0
+	for _, k := range args[1:] {
+		if cl.n.db.lookup(string(k)) != nil {
+			count++
+		}
+	}
+	return count
+}
+
+func cmdExpire(cl *client, args [][]byte) interface{} {
+	v, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return notInt
+	}
+	e := cl.n.db.lookup(string(args[1]))
+	if e == nil {
+		return 0
+	}
+	unit := time.Second
+	if cmdName(args) == "PEXPIRE" {
+		unit = time.Millisecond
+	}
+	if v <= 0 {
+		delete(cl.n.db.keys, string(args[1]))
+		return 1
+	}
+	e.expireAt = time.Now().Add(time.Duration(v) * unit)
+	return 1
+}
+
+func cmdPersist(cl *client, args [][]byte) interface{} {
+	e := cl.n.db.lookup(string(args[1]))
+	if e == nil || e.expireAt.IsZero() {
+		return 0
+	}
+	e.expireAt = time.Time{}
+	return 1
+}
+
+func cmdTTL(cl *client, args [][]byte) interface{} {
+	e := cl.n.db.lookup(string(args[1]))
+	switch {
+	case e == nil:
+		return -2
+	case e.expireAt.IsZero():
+		return -1
+	}
+	ttl := time.Until(e.expireAt)
+	if cmdName(args) == "PTTL" {
+		return int64(ttl / time.Millisecond)
+	}
+	return int64((ttl + time.Second/2) / time.Second)
+}
+
+func cmdType(cl *client, args [][]byte) interface{} {
+	e := cl.n.db.lookup(string(args[1]))
+	if e == nil {
+		return status("none")
+	}
+	return status(e.typeName())
+}
+
+func cmdHset(cl *client, args [][]byte) interface{} {
+	if len(args)%2 != 0 {
+		return respError("ERR wrong number of arguments for 'hset' command")
+	}
+	e, errReply := lookupType(cl, args[1], map[string]string(nil))
+	if errReply != nil {
+		return errReply
+	}
+	if e == nil {
+		e = &entry{value: make(map[string]string)}
+		cl.n.db.keys[string(args[1])] = e
+	}
+	h := e.value.(map[string]string)
+	added := 0
+	for i := 2; i < len(args); i += 2 {
+		if _, ok := h[string(args[i])]; !ok {
+			added++
+		}
+		h[string(args[i])] = string(args[i+1])
+	}
+	return added
+}
+
+func cmdHget(cl *client, args [][]byte) interface{} {
+	e, errReply := lookupType(cl, args[1], map[string]string(nil))
+	if e == nil {
+		return errReply
+	}
+	if v, ok := e.value.(map[string]string)[string(args[2])]; ok {
+		return v
+	}
+	return nil
+}
+
+func cmdHdel(cl *client, args [][]byte) interface{} {
+	e, errReply := lookupType(cl, args[1], map[string]string(nil))
+	if e == nil {
+		if errReply != nil {
+			return errReply
+		}
+		return 0
+	}
+	h := e.value.(map[string]string)
+	count := 0
+	for _, f := range args[2:] {
+		if _, ok := h[string(f)]; ok {
+			delete(h, string(f))
+			count++
+		}
+	}
+	if len(h) == 0 {
+		delete(cl.n.db.keys, string(args[1]))
+	}
+	return count
+}
+
+func cmdHgetall(cl *client, args [][]byte) interface{} {
+	e, errReply := lookupType(cl, args[1], map[string]string(nil))
+	if errReply != nil {
+		return errReply
+	}
+	fields := []string{}
+	if e != nil {
+		h := e.value.(map[string]string)
+		for f := range h {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		kvs := make([]string, 0, 2*len(fields))
+		for _, f := range fields {
+			kvs = append(kvs, f, h[f])
+		}
+		fields = kvs
+	}
+	return fields
+}
+
+func cmdHlen(cl *client, args [][]byte) interface{} {
+	e, errReply := lookupType(cl, args[1], map[string]string(nil))
+	if e == nil {
+		if errReply != nil {
+			return errReply
+		}
+		return 0
+	}
+	return len(e.value.(map[string]string))
+}
+
+func cmdPush(cl *client, args [][]byte) interface{} {
+	e, errReply := lookupType(cl, args[1], []string(nil))
+	if errReply != nil {
+		return errReply
+	}
+	if e == nil {
+		e = &entry{value: []string(nil)}
+		cl.n.db.keys[string(args[1])] = e
+	}
+	l := e.value.([]string)
+	for _, v := range args[2:] {
+		if cmdName(args) == "LPUSH" {
+			l = append([]string{string(v)}, l...)
+		} else {
+			l = append(l, string(v))
+		}
+	}
+	e.value = l
+	return len(l)
+}
+
+func cmdLrange(cl *client, args [][]byte) interface{} {
+	e, errReply := lookupType(cl, args[1], []string(nil))
+	if errReply != nil {
+		return errReply
+	}
+	start, err1 := strconv.Atoi(string(args[2]))
+	stop, err2 := strconv.Atoi(string(args[3]))
+	if err1 != nil || err2 != nil {
+		return notInt
+	}
+	if e == nil {
+		return []string{}
+	}
+	l := e.value.([]string)
+	if start < 0 {
+		start += len(l)
+	}
+	if stop < 0 {
+		stop += len(l)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= len(l) {
+		stop = len(l) - 1
+	}
+	if start > stop {
+		return []string{}
+	}
+	return l[start : stop+1]
+}
+
+func cmdLlen(cl *client, args [][]byte) interface{} {
+	e, errReply := lookupType(cl, args[1], []string(nil))
+	if e == nil {
+		if errReply != nil {
+			return errReply
+		}
+		return 0
+	}
+	return len(e.value.([]string))
+}
+
+func cmdSadd(cl *client, args [][]byte) interface{} {
+	e, errReply := lookupType(cl, args[1], map[string]struct{}(nil))
+	if errReply != nil {
+		return errReply
+	}
+	if e == nil {
+		e = &entry{value: make(map[string]struct{})}
+		cl.n.db.keys[string(args[1])] = e
+	}
+	s := e.value.(map[string]struct{})
+	added := 0
+	for _, m := range args[2:] {
+		if _, ok := s[string(m)]; !ok {
+			s[string(m)] = struct{}{}
+			added++
+		}
+	}
+	return added
+}
+
+func cmdSmembers(cl *client, args [][]byte) interface{} {
+	e, errReply := lookupType(cl, args[1], map[string]struct{}(nil))
+	if errReply != nil {
+		return errReply
+	}
+	members := []string{}
+	if e != nil {
+		for m := range e.value.(map[string]struct{}) {
+			members = append(members, m)
+		}
+		sort.Strings(members)
+	}
+	return members
+}
+
+func cmdScard(cl *client, args [][]byte) interface{} {
+	e, errReply := lookupType(cl, args[1], map[string]struct{}(nil))
+	if e == nil {
+		if errReply != nil {
+			return errReply
+		}
+		return 0
+	}
+	return len(e.value.(map[string]struct{}))
+}
+
+func cmdSismember(cl *client, args [][]byte) interface{} {
+	e, errReply := lookupType(cl, args[1], map[string]struct{}(nil))
+	if e == nil {
+		if errReply != nil {
+			return errReply
+		}
+		return 0
+	}
+	if _, ok := e.value.(map[string]struct{})[string(args[2])]; ok {
+		return 1
+	}
+	return 0
+}
+
+// cmdPublish delivers the message to the subscribers on all the nodes by PUBLISH, or on the nodes of the shard
+// by SPUBLISH
+func cmdPublish(cl *client, args [][]byte) interface{} {
+	c := cl.n.c
+	channel := string(args[1])
+	kind, subs := "message", c.subs
+	sharded := cmdName(args) == "SPUBLISH"
+	if sharded {
+		kind, subs = "smessage", c.ssubs
+	}
+	count := 0
+	for _, sub := range subscribers(subs, channel) {
+		if sharded && sub.n.shard() != cl.n.shard() {
+			continue
+		}
+		cl.pushes = append(cl.pushes, push{to: sub, msg: []interface{}{kind, channel, args[2]}})
+		count++
+	}
+	return count
+}
+
+func cmdSubscribe(cl *client, args [][]byte) interface{} {
+	c := cl.n.c
+	kind, mine, subs := "subscribe", cl.subs, c.subs
+	if cmdName(args) == "SSUBSCRIBE" {
+		kind, mine, subs = "ssubscribe", cl.ssubs, c.ssubs
+	}
+	var replies multiReply
+	for _, ch := range args[1:] {
+		channel := string(ch)
+		mine[channel] = true
+		if subs[channel] == nil {
+			subs[channel] = make(map[*client]bool)
+		}
+		subs[channel][cl] = true
+		replies = append(replies, []interface{}{kind, channel, len(mine)})
+	}
+	return replies
+}
+
+func cmdUnsubscribe(cl *client, args [][]byte) interface{} {
+	c := cl.n.c
+	kind, mine, subs := "unsubscribe", cl.subs, c.subs
+	if cmdName(args) == "SUNSUBSCRIBE" {
+		kind, mine, subs = "sunsubscribe", cl.ssubs, c.ssubs
+	}
+	var channels []string
+	for _, ch := range args[1:] {
+		channels = append(channels, string(ch))
+	}
+	if len(channels) == 0 {
+		for ch := range mine {
+			channels = append(channels, ch)
+		}
+		sort.Strings(channels)
+	}
+	if len(channels) == 0 {
+		return []interface{}{kind, nil, 0}
+	}
+	var replies multiReply
+	for _, channel := range channels {
+		delete(mine, channel)
+		delete(subs[channel], cl)
+		replies = append(replies, []interface{}{kind, channel, len(mine)})
+	}
+	return replies
+}
@@ -0,0 +1,159 @@
+package clustertest
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Slot returns the hash slot of the key
+func Slot(key string) int {
+	if start := strings.Index(key, "{"); start >= 0 {
+		if end := strings.Index(key[start+1:], "}"); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % TotalSlots)
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum used by redis cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// entry is a value in the keyspace, which is a string, hash, list or set
+type entry struct {
+	value    interface{}
+	expireAt time.Time
+}
+
+func (e *entry) typeName() string {
+	switch e.value.(type) {
+	case string:
+		return "string"
+	case map[string]string:
+		return "hash"
+	case []string:
+		return "list"
+	case map[string]struct{}:
+		return "set"
+	}
+	return "none"
+}
+
+// keyspace is the dataset of a shard
+type keyspace struct {
+	keys map[string]*entry
+
+	// offset is the replication offset, it grows with the writes
+	offset int64
+}
+
+func newKeyspace() *keyspace {
+	return &keyspace{keys: make(map[string]*entry)}
+}
+
+// lookup returns the entry of the key, nil if it doesn't exist or expires
+func (db *keyspace) lookup(key string) *entry {
+	e := db.keys[key]
+	if e != nil && !e.expireAt.IsZero() && !time.Now().Before(e.expireAt) {
+		delete(db.keys, key)
+		return nil
+	}
+	return e
+}
+
+// sortedKeys returns the keys that don't expire in order
+func (db *keyspace) sortedKeys() []string {
+	keys := make([]string, 0, len(db.keys))
+	for k := range db.keys {
+		if db.lookup(k) != nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// moveSlot moves the keys of the slot to the keyspace, all the keys of the slot are moved if keys is nil
+func (db *keyspace) moveSlot(to *keyspace, slot int, keys []string) {
+	if keys == nil {
+		for k := range db.keys {
+			if Slot(k) == slot {
+				keys = append(keys, k)
+			}
+		}
+	}
+	for _, k := range keys {
+		if e := db.lookup(k); e != nil && Slot(k) == slot {
+			to.keys[k] = e
+			delete(db.keys, k)
+		}
+	}
+}
+
+// match reports if the string matches the glob-style pattern of KEYS and SCAN
+func match(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if match(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 || len(s) == 0 {
+				return false
+			}
+			set := pattern[1 : end+1]
+			negate := len(set) > 0 && set[0] == '^'
+			if negate {
+				set = set[1:]
+			}
+			matched := false
+			for i := 0; i < len(set); i++ {
+				if i+2 < len(set) && set[i+1] == '-' {
+					if set[i] <= s[0] && s[0] <= set[i+2] {
+						matched = true
+					}
+					i += 2
+				} else if set[i] == s[0] {
+					matched = true
+				}
+			}
+			if matched == negate {
+				return false
+			}
+			pattern = pattern[end+1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
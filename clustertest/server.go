@@ -0,0 +1,272 @@
+package clustertest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// status is a simple string reply
+type status string
+
+// respError is an error reply
+type respError string
+
+// multiReply is sent as the replies in order, e.g. the confirmations of SUBSCRIBE with multiple channels
+type multiReply []interface{}
+
+var (
+	okStatus  = status("OK")
+	wrongType = respError("WRONGTYPE Operation against a key holding the wrong kind of value")
+	notInt    = respError("ERR value is not an integer or out of range")
+	syntaxErr = respError("ERR syntax error")
+)
+
+var clientIDs int64
+
+// client is a connection to a node
+type client struct {
+	id   int64
+	n    *Node
+	conn net.Conn
+
+	// wmu serializes the replies and the pushed messages
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	// the following members are protected by Cluster.mu
+	name     string
+	readOnly bool
+	asking   bool
+	subs     map[string]bool
+	ssubs    map[string]bool
+
+	// multi is set by MULTI, the commands are queued until EXEC. aborted is set if a queued command is rejected
+	multi   bool
+	aborted bool
+	queued  [][][]byte
+
+	// pushes are the messages published by the command to deliver after it's executed
+	pushes []push
+}
+
+// push is a message to deliver to a subscriber
+type push struct {
+	to  *client
+	msg []interface{}
+}
+
+func newClient(n *Node, conn net.Conn) *client {
+	return &client{
+		id:    atomic.AddInt64(&clientIDs, 1),
+		n:     n,
+		conn:  conn,
+		w:     bufio.NewWriter(conn),
+		subs:  make(map[string]bool),
+		ssubs: make(map[string]bool),
+	}
+}
+
+func (cl *client) serve() {
+	defer cl.close()
+	rc := redis.NewConn(cl.conn, 0, 0)
+	for {
+		args, err := redis.ByteSlices(rc.Receive())
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		reply, pushes, latency := cl.exec(args)
+		if latency > 0 {
+			time.Sleep(latency)
+		}
+		if err := cl.write(reply); err != nil {
+			return
+		}
+		for _, p := range pushes {
+			p.to.write(p.msg)
+		}
+		if strings.EqualFold(string(args[0]), "QUIT") {
+			return
+		}
+	}
+}
+
+// close closes the connection and removes its subscriptions
+func (cl *client) close() {
+	cl.conn.Close()
+	c := cl.n.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(cl.n.clients, cl)
+	for ch := range cl.subs {
+		delete(c.subs[ch], cl)
+	}
+	for ch := range cl.ssubs {
+		delete(c.ssubs[ch], cl)
+	}
+}
+
+// exec executes the command, and returns the reply, the messages to push to the subscribers and the latency of
+// the node
+func (cl *client) exec(args [][]byte) (interface{}, []push, time.Duration) {
+	c := cl.n.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	latency := cl.n.latency
+	name := strings.ToUpper(string(args[0]))
+	asking := cl.asking
+	cl.asking = false
+	cmd, found := commands[name]
+	var rejected interface{}
+	switch {
+	case !found:
+		rejected = respError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	case (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity):
+		rejected = respError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+	case len(cl.subs)+len(cl.ssubs) > 0 && !cmd.pubsub:
+		rejected = respError(fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / "+
+			"QUIT / RESET are allowed in this context", strings.ToLower(name)))
+	}
+	if rejected != nil {
+		// the transaction is aborted by the rejected commands
+		cl.aborted = cl.multi
+		return rejected, nil, latency
+	}
+	if cl.multi && !cmd.tx {
+		if e := cl.check(cmd, args, asking); e != nil {
+			cl.aborted = true
+			return e, nil, latency
+		}
+		cl.queued = append(cl.queued, args)
+		return status("QUEUED"), nil, latency
+	}
+	reply := cl.run(cmd, args, asking)
+	pushes := cl.pushes
+	cl.pushes = nil
+	return reply, pushes, latency
+}
+
+// check returns the error reply if the command can't be executed by the node, nil if it can
+func (cl *client) check(cmd *command, args [][]byte, asking bool) interface{} {
+	if cmd.keys != nil {
+		return cl.route(cmd, cmd.keys(args), asking)
+	}
+	return nil
+}
+
+// run executes the command, the replication offset grows with the writes
+func (cl *client) run(cmd *command, args [][]byte, asking bool) interface{} {
+	if e := cl.check(cmd, args, asking); e != nil {
+		return e
+	}
+	reply := cmd.fn(cl, args)
+	if cmd.write {
+		db := cl.n.db
+		for _, a := range args {
+			db.offset += int64(len(a))
+		}
+	}
+	return reply
+}
+
+// route returns the redirect or error reply if the keys can't be served by the node, nil if they can
+func (cl *client) route(cmd *command, keys [][]byte, asking bool) interface{} {
+	if len(keys) == 0 {
+		return nil
+	}
+	slot := -1
+	for _, k := range keys {
+		s := Slot(string(k))
+		if slot >= 0 && s != slot {
+			return respError("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+		slot = s
+	}
+	c, n := cl.n.c, cl.n
+	shard := n.shard()
+	owner := c.owners[slot]
+	switch {
+	case owner == shard && n != shard:
+		// a replica serves the reads after READONLY only
+		if cmd.write || !cl.readOnly {
+			return movedTo(slot, shard)
+		}
+	case owner == shard:
+		if to := c.migrating[slot]; to != nil {
+			for _, k := range keys {
+				if shard.db.lookup(string(k)) == nil {
+					return respError(fmt.Sprintf("ASK %d %s", slot, to.Addr))
+				}
+			}
+		}
+	case asking && n == shard && c.migrating[slot] == shard:
+		// the keys have been migrated to the importing node
+	case owner == nil:
+		return respError("CLUSTERDOWN Hash slot not served")
+	default:
+		return movedTo(slot, owner)
+	}
+	return nil
+}
+
+func movedTo(slot int, n *Node) respError {
+	return respError(fmt.Sprintf("MOVED %d %s", slot, n.Addr))
+}
+
+// write sends the reply to the client
+func (cl *client) write(reply interface{}) error {
+	cl.wmu.Lock()
+	defer cl.wmu.Unlock()
+	if mr, ok := reply.(multiReply); ok {
+		for _, r := range mr {
+			writeReply(cl.w, r)
+		}
+	} else {
+		writeReply(cl.w, reply)
+	}
+	return cl.w.Flush()
+}
+
+// writeReply encodes the reply in RESP2
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch r := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case status:
+		w.WriteString("+" + string(r) + "\r\n")
+	case respError:
+		w.WriteString("-" + string(r) + "\r\n")
+	case int:
+		w.WriteString(":" + strconv.Itoa(r) + "\r\n")
+	case int64:
+		w.WriteString(":" + strconv.FormatInt(r, 10) + "\r\n")
+	case string:
+		w.WriteString("$" + strconv.Itoa(len(r)) + "\r\n" + r + "\r\n")
+	case []byte:
+		w.WriteString("$" + strconv.Itoa(len(r)) + "\r\n")
+		w.Write(r)
+		w.WriteString("\r\n")
+	case []string:
+		w.WriteString("*" + strconv.Itoa(len(r)) + "\r\n")
+		for _, s := range r {
+			writeReply(w, s)
+		}
+	case []interface{}:
+		w.WriteString("*" + strconv.Itoa(len(r)) + "\r\n")
+		for _, v := range r {
+			writeReply(w, v)
+		}
+	default:
+		panic(fmt.Sprintf("clustertest: unexpected reply type %T", reply))
+	}
+}
@@ -0,0 +1,108 @@
+package redicluster
+
+import (
+	"fmt"
+	"strings"
+)
+
+// readOnlyCommands are the commands that don't modify the dataset, which can be served by replicas
+var readOnlyCommands = map[string]bool{
+	"BITCOUNT": true, "BITFIELD_RO": true, "BITPOS": true, "DBSIZE": true, "DUMP": true, "ECHO": true,
+	"EVAL_RO": true, "EVALSHA_RO": true, "EXISTS": true, "EXPIRETIME": true, "FCALL_RO": true,
+	"GEODIST": true, "GEOHASH": true, "GEOPOS": true, "GEORADIUS_RO": true, "GEORADIUSBYMEMBER_RO": true,
+	"GEOSEARCH": true, "GET": true, "GETBIT": true, "GETRANGE": true, "HEXISTS": true, "HGET": true,
+	"HGETALL": true, "HKEYS": true, "HLEN": true, "HMGET": true, "HRANDFIELD": true, "HSCAN": true,
+	"HSTRLEN": true, "HVALS": true, "KEYS": true, "LCS": true, "LINDEX": true, "LLEN": true, "LPOS": true,
+	"LRANGE": true, "MGET": true, "PEXPIRETIME": true, "PFCOUNT": true, "PING": true, "PTTL": true,
+	"RANDOMKEY": true, "SCAN": true, "SCARD": true, "SDIFF": true, "SINTER": true, "SINTERCARD": true,
+	"SISMEMBER": true, "SMEMBERS": true, "SMISMEMBER": true, "SORT_RO": true, "SRANDMEMBER": true,
+	"SSCAN": true, "STRLEN": true, "SUBSTR": true, "SUNION": true, "TOUCH": true, "TTL": true, "TYPE": true,
+	"XINFO": true, "XLEN": true, "XPENDING": true, "XRANGE": true, "XREAD": true, "XREVRANGE": true,
+	"ZCARD": true, "ZCOUNT": true, "ZDIFF": true, "ZINTER": true, "ZINTERCARD": true, "ZLEXCOUNT": true,
+	"ZMSCORE": true, "ZRANDMEMBER": true, "ZRANGE": true, "ZRANGEBYLEX": true, "ZRANGEBYSCORE": true,
+	"ZRANK": true, "ZREVRANGE": true, "ZREVRANGEBYLEX": true, "ZREVRANGEBYSCORE": true, "ZREVRANK": true,
+	"ZSCAN": true, "ZSCORE": true, "ZUNION": true,
+}
+
+// isReadOnlyCommand reports if the command doesn't modify the dataset
+func isReadOnlyCommand(cmd string) bool {
+	return readOnlyCommands[strings.ToUpper(cmd)]
+}
+
+// nonWriteCommands are the commands other than readOnlyCommands that don't modify the dataset, e.g. the connection,
+// transaction and server commands
+var nonWriteCommands = map[string]bool{
+	"ASKING": true, "AUTH": true, "CLIENT": true, "CLUSTER": true, "COMMAND": true, "CONFIG": true,
+	"DISCARD": true, "EXEC": true, "HELLO": true, "INFO": true, "LASTSAVE": true, "LATENCY": true, "MEMORY": true,
+	"MULTI": true, "OBJECT": true, "PSUBSCRIBE": true, "PUBLISH": true, "PUNSUBSCRIBE": true, "QUIT": true,
+	"READONLY": true, "READWRITE": true, "RESET": true, "ROLE": true, "SELECT": true, "SLOWLOG": true,
+	"SPUBLISH": true, "SSUBSCRIBE": true, "SUBSCRIBE": true, "SUNSUBSCRIBE": true, "TIME": true,
+	"UNSUBSCRIBE": true, "UNWATCH": true, "WAIT": true, "WAITAOF": true, "WATCH": true,
+}
+
+// isWriteCommand reports if the command may modify the dataset
+func isWriteCommand(cmd string) bool {
+	cmd = strings.ToUpper(cmd)
+	return !readOnlyCommands[cmd] && !nonWriteCommands[cmd]
+}
+
+// blockingCommands are the commands that may block until a timeout or an event, see isBlockingCommand
+var blockingCommands = map[string]bool{
+	"BLMOVE": true, "BLMPOP": true, "BLPOP": true, "BRPOP": true, "BRPOPLPUSH": true, "BZMPOP": true,
+	"BZPOPMAX": true, "BZPOPMIN": true, "WAIT": true, "WAITAOF": true,
+}
+
+// isBlockingCommand reports if the reply of the command may be delayed by the node on purpose, so its round-trip
+// time isn't the latency of the node. XREAD and XREADGROUP block with the BLOCK option
+func isBlockingCommand(cmd string, args []interface{}) bool {
+	cmd = strings.ToUpper(cmd)
+	if cmd == "XREAD" || cmd == "XREADGROUP" {
+		for _, arg := range args {
+			switch strings.ToUpper(fmt.Sprintf("%s", arg)) {
+			case "BLOCK":
+				return true
+			case "STREAMS":
+				return false
+			}
+		}
+		return false
+	}
+	return blockingCommands[cmd]
+}
+
+// isSubscribeCommand reports if the command subscribes the connection, which receives the messages since then
+func isSubscribeCommand(cmd string) bool {
+	switch strings.ToUpper(cmd) {
+	case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE":
+		return true
+	}
+	return false
+}
+
+// txState tracks the transaction of a connection, the writes queued between MULTI and EXEC take effect on EXEC
+type txState struct {
+	multi  bool
+	writes bool
+}
+
+// wrote updates the state by the command sent on the connection, and reports if the dataset is modified once the
+// command succeeds: true for the writes outside of transactions, and EXEC of the transactions with writes
+func (ts *txState) wrote(cmd string) bool {
+	switch strings.ToUpper(cmd) {
+	case "MULTI":
+		ts.multi, ts.writes = true, false
+		return false
+	case "EXEC":
+		writes := ts.multi && ts.writes
+		*ts = txState{}
+		return writes
+	case "DISCARD", "RESET":
+		*ts = txState{}
+		return false
+	}
+	if ts.multi {
+		ts.writes = ts.writes || isWriteCommand(cmd)
+		return false
+	}
+	return isWriteCommand(cmd)
+}
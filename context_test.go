@@ -0,0 +1,82 @@
+package redicluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the node accepts connections but never replies
+func hangingClusterPool(t *testing.T) *ClusterPool {
+	ln := listenLoopback(t)
+	t.Cleanup(func() { ln.Close() })
+	cp := &ClusterPool{}
+	addr := ln.Addr().String()
+	cp.setSlots([]*slotInfo{{
+		Start: 0,
+		End:   TotalSlots - 1,
+		Nodes: []*NodeInfo{{Addr: addr, Role: "master"}},
+		Addrs: []string{addr},
+	}})
+	t.Cleanup(cp.Close)
+	return cp
+}
+
+func TestGetWithDefaultContextDeadline(t *testing.T) {
+	cp := hangingClusterPool(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	conn := cp.GetWithDefaultContext(ctx)
+	defer conn.Close()
+
+	start := time.Now()
+	_, err := conn.Do("GET", "abc")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestGetContext(t *testing.T) {
+	cp := NewClusterPool(newTestCluster(t).Addrs()[:1])
+	defer cp.Close()
+
+	// the done ctx fails getting the conn
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	conn := cp.GetContext(ctx)
+	assert.ErrorIs(t, conn.Err(), context.Canceled)
+	_, err := conn.Do("GET", "abc")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// the slot mapping is loaded on getting the conn, and ctx isn't used by the requests
+	ctx, cancel = context.WithCancel(context.Background())
+	conn = cp.GetContext(ctx)
+	defer conn.Close()
+	require.NoError(t, conn.Err())
+	assert.NotEmpty(t, cp.topology().slots)
+	cancel()
+	_, err = conn.Do("SET", "abc", "v")
+	assert.NoError(t, err)
+	require.NoError(t, conn.Send("GET", "abc"))
+	require.NoError(t, conn.Flush())
+	v, err := conn.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v"), v)
+}
+
+func TestFlushContext(t *testing.T) {
+	cp := hangingClusterPool(t)
+	cp.PipelineBatchTimeout = 20 * time.Millisecond
+	conn := cp.Get()
+	defer conn.Close()
+
+	require.NoError(t, conn.Send("GET", "abc"))
+	require.NoError(t, conn.Send("GET", "efg"))
+	start := time.Now()
+	require.NoError(t, conn.(ConnWithFlushContext).FlushContext(context.Background()))
+	assert.Less(t, time.Since(start), time.Second)
+	_, err := conn.Receive()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
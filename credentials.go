@@ -0,0 +1,158 @@
+package redicluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Per-node authentication. The connections dialed by the cluster pool are authenticated with the credentials of
+// Credentials, and the idle connections of the managed pools are authenticated again on borrowing once the
+// credentials rotate.
+
+// CredentialsProvider supplies the credentials for connecting to the nodes. It's called on every dial and every
+// borrowing from the managed pools, so it should be cheap, e.g. return the cached credentials
+type CredentialsProvider interface {
+	// Credentials returns the username and password for the node address, the username is empty for the default
+	// user, and no AUTH is sent if the password is empty
+	Credentials(ctx context.Context, addr string) (username, password string, err error)
+}
+
+// CredentialsFunc is a function implementing CredentialsProvider
+type CredentialsFunc func(ctx context.Context, addr string) (username, password string, err error)
+
+func (f CredentialsFunc) Credentials(ctx context.Context, addr string) (string, string, error) {
+	return f(ctx, addr)
+}
+
+// WithCredentials authenticates the connections to nodes by the credentials provider. See ClusterPool.Credentials
+func WithCredentials(p CredentialsProvider) Option {
+	return optionFunc(func(cp *ClusterPool) {
+		cp.Credentials = p
+	})
+}
+
+// ErrAuth matches *AuthError by errors.Is
+var ErrAuth = errors.New("redicluster: authentication failed")
+
+// AuthError is returned when a node rejects the credentials by WRONGPASS, or requires authentication by NOAUTH
+type AuthError struct {
+	Addr string
+
+	// Kind is "WRONGPASS" or "NOAUTH"
+	Kind string
+
+	// Err is the error reply of the node
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("redicluster: authentication failed for %s: %v", e.Addr, e.Err)
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+func (e *AuthError) Is(target error) bool {
+	return target == ErrAuth
+}
+
+// authErr converts the WRONGPASS and NOAUTH error replies of the node to *AuthError, other errors are returned as is
+func authErr(addr string, err error) error {
+	re, ok := err.(redis.Error)
+	if !ok {
+		return err
+	}
+	for _, kind := range []string{"WRONGPASS", "NOAUTH"} {
+		if strings.HasPrefix(string(re), kind) {
+			return &AuthError{Addr: addr, Kind: kind, Err: err}
+		}
+	}
+	return err
+}
+
+// authConn is a connection authenticated with the credentials, so it can be authenticated again on borrowing if the
+// credentials rotate
+type authConn struct {
+	redis.Conn
+	addr     string
+	username string
+	password string
+}
+
+// authenticate sends AUTH with the credentials of the node address if Credentials is set, the connection is wrapped
+// in *authConn then. The connection is closed if it fails
+func (cp *ClusterPool) authenticate(ctx context.Context, conn redis.Conn, addr string) (redis.Conn, error) {
+	if cp.Credentials == nil {
+		return conn, nil
+	}
+	ac := &authConn{Conn: conn, addr: addr}
+	if err := ac.auth(ctx, cp.Credentials); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ac, nil
+}
+
+// reauthenticate authenticates the connection again if the credentials of its node rotate, it's called on borrowing
+// from the managed pools
+func (cp *ClusterPool) reauthenticate(conn redis.Conn) error {
+	// the faults are injected above the authenticated connection
+	if fc, ok := conn.(*faultConn); ok {
+		conn = fc.unwrap()
+	}
+	ac, ok := conn.(*authConn)
+	if !ok || cp.Credentials == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultAuthTimeout)
+	defer cancel()
+	return ac.auth(ctx, cp.Credentials)
+}
+
+const defaultAuthTimeout = 3 * time.Second
+
+// auth sends AUTH if the credentials differ from the ones the connection is authenticated with
+func (ac *authConn) auth(ctx context.Context, p CredentialsProvider) error {
+	username, password, err := p.Credentials(ctx, ac.addr)
+	if err != nil {
+		return err
+	}
+	if username == ac.username && password == ac.password {
+		return nil
+	}
+	if len(password) > 0 {
+		args := []interface{}{password}
+		if len(username) > 0 {
+			args = []interface{}{username, password}
+		}
+		if _, err := connDoContext(ac.Conn, ctx, "AUTH", args...); err != nil {
+			return authErr(ac.addr, err)
+		}
+	}
+	ac.username, ac.password = username, password
+	return nil
+}
+
+// the redis.Pool requires the context and timeout methods of the connections it dials
+
+func (ac *authConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	return connDoContext(ac.Conn, ctx, cmd, args...)
+}
+
+func (ac *authConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return connDoWithTimeout(ac.Conn, timeout, cmd, args...)
+}
+
+func (ac *authConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return connReceiveWithContext(ac.Conn, ctx)
+}
+
+func (ac *authConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return connReceiveWithTimeout(ac.Conn, timeout)
+}
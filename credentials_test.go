@@ -0,0 +1,187 @@
+package redicluster
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveRedis serves the RESP commands on a loopback address by handle, which returns the raw reply. The state is
+// per connection
+func serveRedis(t *testing.T, handle func(state map[string]string, args []string) string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return serveRedisOn(t, ln, handle)
+}
+
+// serveRedisOn is like serveRedis but serves on the listener
+func serveRedisOn(t *testing.T, ln net.Listener, handle func(state map[string]string, args []string) string) string {
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				rc := redis.NewConn(c, 0, 0)
+				state := make(map[string]string)
+				for {
+					cmd, err := redis.Strings(rc.Receive())
+					if err != nil {
+						return
+					}
+					if _, err := c.Write([]byte(handle(state, cmd))); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestCredentialsRotation(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		valid = "p1"
+		auths []string
+		dials int
+	)
+	addr := serveRedis(t, func(state map[string]string, args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch args[0] {
+		case "AUTH":
+			if len(state) == 0 {
+				dials++
+			}
+			state["tried"] = "1"
+			auths = append(auths, args[1]+":"+args[2])
+			if args[1] != "app" || args[2] != valid {
+				return "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+			}
+			state["user"] = args[1]
+			return "+OK\r\n"
+		case "PING":
+			if len(state["user"]) == 0 {
+				return "-NOAUTH Authentication required.\r\n"
+			}
+			return "+PONG\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+
+	password := "p1"
+	creds := CredentialsFunc(func(ctx context.Context, a string) (string, string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, addr, a)
+		return "app", password, nil
+	})
+	cp := NewClusterPool([]string{addr}, WithCredentials(creds), WithHealthCheck(-1))
+	cp.CircuitFailures = 1
+	defer cp.Close()
+	ping := func() error {
+		conn, err := cp.getRedisConnByAddrContext(context.Background(), addr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Do("PING")
+		return err
+	}
+
+	require.NoError(t, ping())
+	require.NoError(t, ping())
+
+	// the idle connection is authenticated again with the rotated password
+	mu.Lock()
+	valid, password = "p2", "p2"
+	mu.Unlock()
+	require.NoError(t, ping())
+	mu.Lock()
+	assert.Equal(t, []string{"app:p1", "app:p2"}, auths)
+	assert.Equal(t, 1, dials)
+	password = "bad"
+	mu.Unlock()
+
+	err := ping()
+	var ae *AuthError
+	require.True(t, errors.As(err, &ae))
+	assert.True(t, errors.Is(err, ErrAuth))
+	assert.Equal(t, "WRONGPASS", ae.Kind)
+	assert.Equal(t, addr, ae.Addr)
+	assert.Equal(t, CircuitClosed, cp.NodeStats()[addr].Circuit)
+
+	// no credentials
+	cp2 := &ClusterPool{}
+	defer cp2.Close()
+	conn, err := cp2.getRedisConnByAddrContext(context.Background(), addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Do("PING")
+	require.True(t, errors.As(err, &ae))
+	assert.Equal(t, "NOAUTH", ae.Kind)
+}
+
+func TestCredentialsRotationWithFaults(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		valid = "p1"
+		auths []string
+	)
+	addr := serveRedis(t, func(state map[string]string, args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch args[0] {
+		case "AUTH":
+			auths = append(auths, args[2])
+			if args[2] != valid {
+				return "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+			}
+			state["user"] = args[1]
+			return "+OK\r\n"
+		case "PING":
+			if len(state["user"]) == 0 {
+				return "-NOAUTH Authentication required.\r\n"
+			}
+			return "+PONG\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+
+	creds := CredentialsFunc(func(ctx context.Context, a string) (string, string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return "app", valid, nil
+	})
+	cp := NewClusterPool([]string{addr}, WithCredentials(creds), WithFaults(NewFaultInjector()), WithHealthCheck(-1))
+	defer cp.Close()
+	ping := func() error {
+		conn, err := cp.getRedisConnByAddrContext(context.Background(), addr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Do("PING")
+		return err
+	}
+
+	require.NoError(t, ping())
+	// the idle connection beneath the faults is authenticated again with the rotated password
+	mu.Lock()
+	valid = "p2"
+	mu.Unlock()
+	require.NoError(t, ping())
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"p1", "p2"}, auths)
+}
@@ -0,0 +1,391 @@
+package redicluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Debug HTTP handler. DebugHandler serves the routing state of the ClusterPool for troubleshooting: the slot
+// mapping, nodes, stats, recent topology events and the routing explanation of a command, as JSON or HTML.
+
+// maxTopologyEvents is the count of the recent topology events kept for TopologyEvents
+const maxTopologyEvents = 100
+
+// Kinds of TopologyEvent
+const (
+	EventReloadFailed    = "reload_failed"
+	EventTopologyChanged = "topology_changed"
+	EventPoolCreated     = "pool_created"
+	EventPoolRemoved     = "pool_removed"
+	EventCircuitOpened   = "circuit_opened"
+	EventCircuitClosed   = "circuit_closed"
+)
+
+// TopologyEvent is a change of the slot mapping, pools or node health
+type TopologyEvent struct {
+	Time time.Time
+	Kind string
+
+	// Addr is the node address of the event, empty for the cluster-wide events
+	Addr   string
+	Detail string
+}
+
+// eventRing keeps the recent topology events
+type eventRing struct {
+	mu     sync.Mutex
+	events []TopologyEvent
+	next   int
+}
+
+func (r *eventRing) add(ev TopologyEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.events) < maxTopologyEvents {
+		r.events = append(r.events, ev)
+		return
+	}
+	r.events[r.next] = ev
+	r.next = (r.next + 1) % maxTopologyEvents
+}
+
+// list returns the events from the oldest
+func (r *eventRing) list() []TopologyEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	evs := make([]TopologyEvent, 0, len(r.events))
+	evs = append(evs, r.events[r.next:]...)
+	return append(evs, r.events[:r.next]...)
+}
+
+func (cp *ClusterPool) recordEvent(kind, addr, detail string) {
+	cp.events.add(TopologyEvent{Time: time.Now(), Kind: kind, Addr: addr, Detail: detail})
+}
+
+// TopologyEvents returns the recent topology events from the oldest
+func (cp *ClusterPool) TopologyEvents() []TopologyEvent {
+	return cp.events.list()
+}
+
+// SlotRange is a range of slots served by a shard
+type SlotRange struct {
+	Start, End int
+	Master     string
+	Replicas   []string
+}
+
+// SlotRanges returns the slot mapping
+func (cp *ClusterPool) SlotRanges() []SlotRange {
+	t := cp.topology()
+	srs := make([]SlotRange, 0, len(t.slots))
+	for _, si := range t.slots {
+		sr := SlotRange{Start: si.Start, End: si.End}
+		if len(si.Addrs) > 0 {
+			sr.Master = si.Addrs[0]
+			sr.Replicas = si.Addrs[1:]
+		}
+		srs = append(srs, sr)
+	}
+	return srs
+}
+
+// NodeStatus is a node in the slot mapping with its routing state
+type NodeStatus struct {
+	NodeInfo
+
+	// Slots is the count of slots the node serves as master or replica
+	Slots   int
+	Circuit CircuitState
+
+	// Pooled indicates the node has a connection pool
+	Pooled bool
+}
+
+// Nodes returns the nodes in the slot mapping ordered by address
+func (cp *ClusterPool) Nodes() []NodeStatus {
+	t := cp.topology()
+	slots := make(map[string]int, len(t.nodes))
+	for _, si := range t.slots {
+		for _, addr := range si.Addrs {
+			slots[addr] += si.End - si.Start + 1
+		}
+	}
+	nss := make([]NodeStatus, 0, len(t.nodes))
+	for addr, n := range t.nodes {
+		ns := NodeStatus{NodeInfo: *n, Slots: slots[addr], Pooled: cp.lookupPool(addr) != nil}
+		if st := cp.lookupNodeState(addr); st != nil {
+			ns.Circuit = st.breaker.getState()
+		}
+		nss = append(nss, ns)
+	}
+	sort.Slice(nss, func(i, j int) bool { return nss[i].Addr < nss[j].Addr })
+	return nss
+}
+
+// ExplainKey is a key that a command is routed by
+type ExplainKey struct {
+	// Pos is the index of the key in the arguments
+	Pos int
+	Key string
+
+	// HashTag is the part of the key hashed instead of the whole key, empty if there is none
+	HashTag string
+	Slot    int
+	Addr    string
+}
+
+// Explanation describes how a command is routed, see ClusterPool.Explain
+type Explanation struct {
+	Cmd      string
+	Args     []string
+	ReadOnly bool
+	Keys     []ExplainKey
+
+	// Slot is the slot the command is routed by, -1 if it has no key or it's split by slot
+	Slot int
+
+	// Addr and Role are the node the command is sent to, Addr is empty if it can't be routed to a single node
+	Addr string
+	Role string
+
+	// Reasons explain the routing step by step
+	Reasons []string
+}
+
+func (e *Explanation) reason(format string, args ...interface{}) {
+	e.Reasons = append(e.Reasons, fmt.Sprintf(format, args...))
+}
+
+// Explain describes how the command is routed by the current slot mapping, by the connection of GetReadonlyConn
+// if readOnly is true, otherwise by the one of Get. The command is not sent
+func (cp *ClusterPool) Explain(readOnly bool, cmd string, args ...interface{}) *Explanation {
+	e := &Explanation{Cmd: cmd, Args: make([]string, len(args)), ReadOnly: readOnly, Slot: -1}
+	for i, arg := range args {
+		e.Args[i] = fmt.Sprintf("%s", arg)
+	}
+	t := cp.topology()
+	switch cmd {
+	case "MSET", "MGET":
+		step := 1
+		if cmd == "MSET" {
+			step = 2
+		}
+		for i := 0; i < len(args); i += step {
+			e.Keys = append(e.Keys, cp.explainKey(t, i, e.Args[i], readOnly))
+		}
+		e.reason("%s is split by the slots of its keys, and sent to the nodes in a pipeline", cmd)
+		return e
+	}
+	sk := routingKeyIndex(cmd)
+	if len(args) <= sk {
+		e.reason("the command has no key at argument %d, it's sent to the node of the last command on the "+
+			"connection, or the master of a random slot", sk)
+		return e
+	}
+	k := cp.explainKey(t, sk, e.Args[sk], readOnly)
+	e.Keys = []ExplainKey{k}
+	e.Slot = k.Slot
+	if len(k.HashTag) > 0 {
+		e.reason("slot %d is computed from the hash tag %q of the key %q at argument %d", k.Slot, k.HashTag, k.Key, sk)
+	} else {
+		e.reason("slot %d is computed from the key %q at argument %d", k.Slot, k.Key, sk)
+	}
+	sa := t.addrs(k.Slot)
+	if len(sa) == 0 {
+		e.reason("slot %d is not in the slot mapping, it's reloaded before sending", k.Slot)
+		return e
+	}
+	e.reason("slot %d is served by the master %s and replicas %v", k.Slot, sa[0], sa[1:])
+	e.Addr = k.Addr
+	if n := t.nodes[e.Addr]; n != nil {
+		e.Role = n.Role
+	}
+	switch {
+	case !readOnly:
+		e.reason("the master is used by a read-write connection")
+	case len(sa) < 2:
+		e.reason("the master is used since there is no replica")
+	case e.Addr == sa[0]:
+		e.reason("the master is used since no replica is eligible in zones %v", cp.zoneTiers())
+	case cp.LatencyRouting:
+		e.reason("the replica %s is the fastest eligible one in zones %v", e.Addr, cp.zoneTiers())
+	default:
+		e.reason("the replica %s is picked at random from the eligible ones in zones %v", e.Addr, cp.zoneTiers())
+	}
+	if e.Addr != sa[0] && !isReadOnlyCommand(cmd) {
+		e.reason("%s modifies the dataset, it fails with READONLY on a replica", cmd)
+	}
+	if cp.circuitRejects(e.Addr) {
+		e.reason("the circuit of %s is open, the command fails fast with CircuitOpenError", e.Addr)
+	}
+	return e
+}
+
+// explainKey routes the key at the argument pos
+func (cp *ClusterPool) explainKey(t *topology, pos int, key string, readOnly bool) ExplainKey {
+	k := ExplainKey{Pos: pos, Key: key, HashTag: hashTag(key), Slot: Slot(key)}
+	if sa := t.addrs(k.Slot); len(sa) > 0 {
+		k.Addr = sa[0]
+		if readOnly {
+			k.Addr = cp.pickReplica(t, sa, nil)
+		}
+	}
+	return k
+}
+
+// DebugHandler returns the http.Handler serving the routing state by the last element of the request path:
+//
+//	slots    the slot mapping, see SlotRanges
+//	nodes    the nodes with their circuit state, see Nodes
+//	stats    the ClusterStats
+//	events   the recent topology events, see TopologyEvents
+//	explain  the routing of the command in the query q, like "GET key", see Explain. The readonly query
+//	         explains the routing of a read-only connection
+//
+// Other paths serve an HTML page of all of them. The responses are JSON unless the format query is "html" or
+// the request accepts text/html. It can be mounted at any prefix, e.g. "/debug/redicluster/"
+func (cp *ClusterPool) DebugHandler() http.Handler {
+	return &debugHandler{cp: cp}
+}
+
+type debugHandler struct {
+	cp *ClusterPool
+}
+
+// debugPage is the data of the HTML page
+type debugPage struct {
+	Section string
+	Slots   []SlotRange
+	Nodes   []NodeStatus
+	Stats   *ClusterStats
+	Events  []TopologyEvent
+	Query   string
+	Explain *Explanation
+}
+
+func (h *debugHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cp := h.cp
+	section := path.Base(r.URL.Path)
+	var data interface{}
+	page := &debugPage{Section: section}
+	switch section {
+	case "slots":
+		page.Slots = cp.SlotRanges()
+		data = page.Slots
+	case "nodes":
+		page.Nodes = cp.Nodes()
+		data = page.Nodes
+	case "stats":
+		cs := cp.ClusterStats()
+		page.Stats = &cs
+		data = page.Stats
+	case "events":
+		page.Events = cp.TopologyEvents()
+		data = page.Events
+	case "explain":
+		page.Query = r.URL.Query().Get("q")
+		fields := strings.Fields(page.Query)
+		if len(fields) == 0 {
+			http.Error(w, "missing command in query q", http.StatusBadRequest)
+			return
+		}
+		args := make([]interface{}, len(fields)-1)
+		for i, f := range fields[1:] {
+			args[i] = f
+		}
+		readOnly, _ := strconv.ParseBool(r.URL.Query().Get("readonly"))
+		page.Explain = cp.Explain(readOnly, fields[0], args...)
+		data = page.Explain
+	default:
+		page.Section = ""
+		page.Slots = cp.SlotRanges()
+		page.Nodes = cp.Nodes()
+		cs := cp.ClusterStats()
+		page.Stats = &cs
+		page.Events = cp.TopologyEvents()
+		data = page
+		if r.URL.Query().Get("format") != "json" {
+			writeDebugHTML(w, page)
+			return
+		}
+	}
+	if wantHTML(r) {
+		writeDebugHTML(w, page)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(data)
+}
+
+// wantHTML reports if the response should be HTML
+func wantHTML(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); len(format) > 0 {
+		return format == "html"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func writeDebugHTML(w http.ResponseWriter, page *debugPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := debugTemplate.Execute(w, page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var debugTemplate = template.Must(template.New("debug").Funcs(template.FuncMap{
+	"show": func(page *debugPage, section string) bool {
+		return page.Section == "" || page.Section == section
+	},
+}).Parse(`<!DOCTYPE html>
+<html><head><title>redicluster</title>
+<style>body{font-family:sans-serif}table{border-collapse:collapse}td,th{border:1px solid #ccc;padding:2px 6px}</style>
+</head><body>
+<h1>redicluster</h1>
+<form action="explain"><input name="q" size="60" placeholder="GET key" value="{{.Query}}">
+<label><input type="checkbox" name="readonly" value="true">read-only</label>
+<input type="hidden" name="format" value="html"><input type="submit" value="explain"></form>
+{{with .Explain}}
+<h2>Explain {{.Cmd}}</h2>
+<table><tr><th>Pos</th><th>Key</th><th>Hash tag</th><th>Slot</th><th>Node</th></tr>
+{{range .Keys}}<tr><td>{{.Pos}}</td><td>{{.Key}}</td><td>{{.HashTag}}</td><td>{{.Slot}}</td><td>{{.Addr}}</td></tr>{{end}}
+</table>
+<p>Node: {{.Addr}} {{.Role}}</p>
+<ol>{{range .Reasons}}<li>{{.}}</li>{{end}}</ol>
+{{end}}
+{{if show . "slots"}}{{with .Slots}}
+<h2>Slots</h2>
+<table><tr><th>Start</th><th>End</th><th>Master</th><th>Replicas</th></tr>
+{{range .}}<tr><td>{{.Start}}</td><td>{{.End}}</td><td>{{.Master}}</td><td>{{range .Replicas}}{{.}} {{end}}</td></tr>{{end}}
+</table>
+{{end}}{{end}}
+{{if show . "nodes"}}{{with .Nodes}}
+<h2>Nodes</h2>
+<table><tr><th>Addr</th><th>Id</th><th>Role</th><th>Zone</th><th>Slots</th><th>Circuit</th><th>Pooled</th></tr>
+{{range .}}<tr><td>{{.Addr}}</td><td>{{.Id}}</td><td>{{.Role}}</td><td>{{.Zone}}</td><td>{{.Slots}}</td><td>{{.Circuit}}</td><td>{{.Pooled}}</td></tr>{{end}}
+</table>
+{{end}}{{end}}
+{{if show . "stats"}}{{with .Stats}}
+<h2>Stats</h2>
+<p>Reloads: {{.Reloads}}, errors: {{.ReloadErrors}}, last: {{.LastReload}} {{.LastReloadError}}</p>
+<table><tr><th>Addr</th><th>Active</th><th>Idle</th><th>Commands</th><th>Reply errors</th><th>I/O errors</th><th>Timeouts</th><th>MOVED</th><th>ASK</th><th>Circuit</th></tr>
+{{range $addr, $st := .Nodes}}<tr><td>{{$addr}}</td><td>{{$st.ActiveCount}}</td><td>{{$st.IdleCount}}</td><td>{{$st.Commands}}</td><td>{{$st.Errors.Reply}}</td><td>{{$st.Errors.IO}}</td><td>{{$st.Errors.Timeout}}</td><td>{{$st.Moved}}</td><td>{{$st.Ask}}</td><td>{{$st.Circuit}}</td></tr>{{end}}
+</table>
+{{end}}{{end}}
+{{if show . "events"}}{{with .Events}}
+<h2>Recent topology events</h2>
+<table><tr><th>Time</th><th>Kind</th><th>Addr</th><th>Detail</th></tr>
+{{range .}}<tr><td>{{.Time.Format "2006-01-02 15:04:05.000"}}</td><td>{{.Kind}}</td><td>{{.Addr}}</td><td>{{.Detail}}</td></tr>{{end}}
+</table>
+{{end}}{{end}}
+</body></html>
+`))
@@ -0,0 +1,107 @@
+package redicluster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func debugTestPool() *ClusterPool {
+	cp := NewClusterPool([]string{"127.0.0.1:7000"})
+	cp.setSlots([]*slotInfo{
+		{Start: 0, End: 8191, Addrs: []string{"127.0.0.1:7000", "127.0.0.1:7001"},
+			Nodes: []*NodeInfo{{Addr: "127.0.0.1:7000", Role: "master"}, {Addr: "127.0.0.1:7001", Role: "replica"}}},
+		{Start: 8192, End: TotalSlots - 1, Addrs: []string{"127.0.0.1:7002"},
+			Nodes: []*NodeInfo{{Addr: "127.0.0.1:7002", Role: "master"}}},
+	})
+	return cp
+}
+
+func TestExplain(t *testing.T) {
+	cp := debugTestPool()
+	defer cp.Close()
+
+	e := cp.Explain(false, "GET", "{user1}.name")
+	require.Len(t, e.Keys, 1)
+	assert.Equal(t, "user1", e.Keys[0].HashTag)
+	assert.Equal(t, Slot("user1"), e.Slot)
+	assert.Equal(t, "127.0.0.1:7000", e.Addr)
+	assert.Equal(t, "master", e.Role)
+	assert.Contains(t, e.Reasons[0], `hash tag "user1"`)
+
+	e = cp.Explain(true, "GET", "{user1}.name")
+	assert.Equal(t, "127.0.0.1:7001", e.Addr)
+	assert.Equal(t, "replica", e.Role)
+
+	e = cp.Explain(false, "EVAL", "return 1", 1, "k")
+	require.Len(t, e.Keys, 1)
+	assert.Equal(t, 2, e.Keys[0].Pos)
+	assert.Equal(t, Slot("k"), e.Slot)
+
+	e = cp.Explain(false, "MSET", "a", 1, "b", 2)
+	require.Len(t, e.Keys, 2)
+	assert.Equal(t, 2, e.Keys[1].Pos)
+	assert.Equal(t, -1, e.Slot)
+	assert.Empty(t, e.Addr)
+
+	e = cp.Explain(false, "PING")
+	assert.Empty(t, e.Keys)
+	assert.Empty(t, e.Addr)
+}
+
+func TestDebugHandler(t *testing.T) {
+	cp := debugTestPool()
+	defer cp.Close()
+	h := cp.DebugHandler()
+
+	get := func(target string, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if len(accept) > 0 {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/debug/redicluster/slots", "")
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var slots []SlotRange
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &slots))
+	require.Len(t, slots, 2)
+	assert.Equal(t, []string{"127.0.0.1:7001"}, slots[0].Replicas)
+
+	var nodes []NodeStatus
+	require.NoError(t, json.Unmarshal(get("/debug/redicluster/nodes", "").Body.Bytes(), &nodes))
+	require.Len(t, nodes, 3)
+	assert.Equal(t, 8192, nodes[0].Slots)
+	assert.Equal(t, "replica", nodes[1].Role)
+
+	var events []TopologyEvent
+	require.NoError(t, json.Unmarshal(get("/debug/redicluster/events", "").Body.Bytes(), &events))
+	require.Len(t, events, 1)
+	assert.Equal(t, EventTopologyChanged, events[0].Kind)
+
+	var e Explanation
+	require.NoError(t, json.Unmarshal(get("/debug/redicluster/explain?q=GET+foo&readonly=1", "").Body.Bytes(), &e))
+	assert.Equal(t, Slot("foo"), e.Slot)
+	assert.True(t, e.ReadOnly)
+	assert.Equal(t, http.StatusBadRequest, get("/debug/redicluster/explain", "").Code)
+
+	rec = get("/debug/redicluster/stats?format=html", "")
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, rec.Body.String(), "<h2>Stats</h2>")
+	assert.NotContains(t, rec.Body.String(), "<h2>Slots</h2>")
+
+	rec = get("/debug/redicluster/", "text/html")
+	body := rec.Body.String()
+	for _, section := range []string{"Slots", "Nodes", "Stats", "Recent topology events"} {
+		assert.True(t, strings.Contains(body, "<h2>"+section+"</h2>"), section)
+	}
+	assert.Contains(t, body, "127.0.0.1:7002")
+}
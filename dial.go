@@ -0,0 +1,137 @@
+package redicluster
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// dial connects to the node address with the dial options, over TLS if TLSConfig is set, authenticates the
+// connection by Credentials and sets its identity. The bytes are counted if the dialer d is not nil, which connects
+// instead of the connect timeout and keep-alive of dialOpts. All the connections dialed by the cluster pool go
+// through it
+func (cp *ClusterPool) dial(ctx context.Context, addr string, d *net.Dialer, dialOpts []redis.DialOption) (
+	redis.Conn, error) {
+	if d != nil {
+		// the dial function of dialOpts takes precedence over the counting one, if any
+		dialOpts = append([]redis.DialOption{cp.countingDialOption(addr, d)}, dialOpts...)
+	}
+	if cp.TLSConfig != nil {
+		dialOpts = append(dialOpts, cp.tlsDialOptions(addr)...)
+	}
+	conn, err := redis.DialContext(ctx, "tcp", addr, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	if conn, err = cp.authenticate(ctx, conn, addr); err != nil {
+		return nil, err
+	}
+	if err := cp.setIdentity(ctx, conn, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// defaultDialer returns a dialer with the default connect timeout and keep-alive period of redigo
+func defaultDialer() *net.Dialer {
+	return &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 5 * time.Minute}
+}
+
+// setIdentity sets the client name and library info of the connection to the node address in one round trip.
+// The error replies of CLIENT SETINFO are ignored, since it's not supported before redis 7.2
+func (cp *ClusterPool) setIdentity(ctx context.Context, conn redis.Conn, addr string) error {
+	var cmds [][]interface{}
+	if len(cp.ClientName) > 0 {
+		cmds = append(cmds, []interface{}{"SETNAME", strings.ReplaceAll(cp.ClientName, "{addr}", addr)})
+	}
+	if len(cp.LibName) > 0 {
+		cmds = append(cmds, []interface{}{"SETINFO", "LIB-NAME", cp.LibName})
+	}
+	if len(cp.LibVersion) > 0 {
+		cmds = append(cmds, []interface{}{"SETINFO", "LIB-VER", cp.LibVersion})
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	for _, args := range cmds {
+		if err := conn.Send("CLIENT", args...); err != nil {
+			return err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	var firstErr error
+	for _, args := range cmds {
+		_, err := connReceiveWithContext(conn, ctx)
+		if _, ok := err.(redis.Error); ok && args[0] == "SETINFO" {
+			err = nil
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// tlsDialOptions returns the dial options for connecting to the node address over TLS
+func (cp *ClusterPool) tlsDialOptions(addr string) []redis.DialOption {
+	cfg := cp.TLSConfig.Clone()
+	cfg.ServerName = cp.tlsServerName(addr)
+	return []redis.DialOption{redis.DialUseTLS(true), redis.DialTLSConfig(cfg)}
+}
+
+// tlsServerName returns the server name of the node address for TLS, see ClusterPool.TLSServerName
+func (cp *ClusterPool) tlsServerName(addr string) string {
+	hostname := cp.nodeInfo(addr).Hostname
+	if cp.TLSServerName != nil {
+		if name := cp.TLSServerName(addr, hostname); len(name) > 0 {
+			return name
+		}
+	}
+	if len(cp.TLSConfig.ServerName) > 0 {
+		return cp.TLSConfig.ServerName
+	}
+	if len(hostname) > 0 {
+		return hostname
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// WithTLS enables TLS for the connections to all nodes. See ClusterPool.TLSConfig
+func WithTLS(cfg *tls.Config) Option {
+	return optionFunc(func(cp *ClusterPool) {
+		cp.TLSConfig = cfg
+	})
+}
+
+// WithClientName sets the name of the connections to nodes. See ClusterPool.ClientName
+func WithClientName(name string) Option {
+	return optionFunc(func(cp *ClusterPool) {
+		cp.ClientName = name
+	})
+}
+
+// WithLibInfo sets the library name and version of the connections to nodes. See ClusterPool.LibName
+func WithLibInfo(name, version string) Option {
+	return optionFunc(func(cp *ClusterPool) {
+		cp.LibName = name
+		cp.LibVersion = version
+	})
+}
+
+// WithTLSServerName sets the function returning the TLS server name of nodes. See ClusterPool.TLSServerName
+func WithTLSServerName(f func(addr, hostname string) string) Option {
+	return optionFunc(func(cp *ClusterPool) {
+		cp.TLSServerName = f
+	})
+}
@@ -0,0 +1,153 @@
+package redicluster
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCert issues a certificate for the DNS name signed by ca, it's self-signed if ca is nil
+func testCert(t *testing.T, name string, ca *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  ca == nil,
+	}
+	parent, signer := tmpl, interface{}(key)
+	if ca != nil {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestTLSServerName(t *testing.T) {
+	ca := testCert(t, "ca", nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	serverCert := testCert(t, "node1.example", &ca)
+	clientCert := testCert(t, "client", &ca)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+	})
+	require.NoError(t, err)
+	addr := serveRedisOn(t, ln, func(state map[string]string, args []string) string {
+		return "+PONG\r\n"
+	})
+	_, port, _ := net.SplitHostPort(addr)
+	tlsPort, _ := strconv.Atoi(port)
+
+	cp := NewClusterPool(nil, WithTLS(&tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}}))
+	defer cp.Close()
+	// the node announces the hostname and TLS port, the plaintext port is not used with TLS
+	node := shardNode("m1", "127.0.0.1", 1, "master", "")
+	node = append(node, []byte("hostname"), []byte("node1.example"), []byte("tls-port"), int64(tlsPort))
+	require.NoError(t, cp.updateShardMap([]interface{}{
+		[]interface{}{
+			[]byte("slots"), []interface{}{int64(0), int64(16383)},
+			[]byte("nodes"), []interface{}{node},
+		},
+	}))
+	require.Equal(t, addr, cp.topology().addrs(0)[0])
+	assert.Equal(t, "node1.example", cp.tlsServerName(addr))
+
+	reply, err := cp.Get().Do("PING")
+	require.NoError(t, err)
+	assert.Equal(t, "PONG", reply)
+
+	// the certificate doesn't match the mapped server name
+	cp.TLSServerName = func(addr, hostname string) string { return "node2.example" }
+	_, err = cp.dial(context.Background(), addr, nil, nil)
+	assert.Error(t, err)
+
+	// the client certificate is required
+	cp.TLSServerName = nil
+	cp.TLSConfig = &tls.Config{RootCAs: roots}
+	c, err := cp.dial(context.Background(), addr, nil, nil)
+	if err == nil {
+		// the server rejects the handshake after the client completes it with TLS 1.3
+		_, err = c.Do("PING")
+		c.Close()
+	}
+	assert.Error(t, err)
+}
+
+func TestTLSPortIgnoredWithoutTLS(t *testing.T) {
+	cp := &ClusterPool{}
+	node := shardNode("m1", "10.0.0.1", 6379, "master", "")
+	n, err := cp.parseShardNode(append(node, []byte("tls-port"), int64(6380)))
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:6379", n.Addr)
+}
+
+func TestClientIdentity(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		names []string
+		infos []string
+	)
+	addr := serveRedis(t, func(state map[string]string, args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if args[0] != "CLIENT" {
+			return "+PONG\r\n"
+		}
+		switch args[1] {
+		case "SETNAME":
+			names = append(names, args[2])
+			return "+OK\r\n"
+		case "SETINFO":
+			infos = append(infos, args[2]+"="+args[3])
+			// redis before 7.2
+			return "-ERR unknown subcommand 'SETINFO'.\r\n"
+		}
+		return "-ERR unknown subcommand\r\n"
+	})
+
+	cp := NewClusterPool([]string{addr}, WithClientName("billing-{addr}"), WithLibInfo("redicluster", "1.2.0"))
+	defer cp.Close()
+	conn, err := cp.getRedisConnByAddrContext(context.Background(), addr)
+	require.NoError(t, err)
+	_, err = conn.Do("PING")
+	require.NoError(t, err)
+	conn.Close()
+
+	// without pool
+	cp2 := &ClusterPool{ClientName: "worker"}
+	defer cp2.Close()
+	conn, err = cp2.getRedisConnByAddrContext(context.Background(), addr)
+	require.NoError(t, err)
+	conn.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"billing-" + addr, "worker"}, names)
+	assert.Equal(t, []string{"LIB-NAME=redicluster", "LIB-VER=1.2.0"}, infos)
+}
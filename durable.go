@@ -0,0 +1,98 @@
+package redicluster
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Synchronous replication for critical writes. After every write, the durable conn issues WAIT or WAITAOF on the
+// same node connection the write used, and returns an *AckError if the acknowledgements are not enough.
+
+// DurableOptions are the options for the durable conn
+type DurableOptions struct {
+	// NumReplicas is the count of replicas that must acknowledge the writes
+	NumReplicas int
+
+	// AOF uses WAITAOF instead of WAIT, which waits the writes to be fsynced to AOF
+	AOF bool
+
+	// NumLocal is the numlocal argument of WAITAOF, it should be 0 or 1
+	NumLocal int
+
+	// Timeout is the timeout of WAIT or WAITAOF, zero means blocking until enough acknowledgements received
+	Timeout time.Duration
+}
+
+// AckError is returned by the durable conn if the writes are not acknowledged by enough replicas or local AOF
+type AckError struct {
+	// Addr is the address of the master
+	Addr string
+
+	// NumLocal and NumReplicas are the requested acknowledgements
+	NumLocal    int
+	NumReplicas int
+
+	// AckedLocal and AckedReplicas are the acknowledgements received
+	AckedLocal    int
+	AckedReplicas int
+}
+
+func (e *AckError) Error() string {
+	if e.NumLocal > 0 {
+		return fmt.Sprintf("redicluster: %s acknowledged by %d/%d local and %d/%d replicas",
+			e.Addr, e.AckedLocal, e.NumLocal, e.AckedReplicas, e.NumReplicas)
+	}
+	return fmt.Sprintf("redicluster: %s acknowledged by %d/%d replicas", e.Addr, e.AckedReplicas, e.NumReplicas)
+}
+
+// GetDurableConn gets the redis.Conn interface that waits every write to be acknowledged as opts requires. An
+// *AckError is returned along with the reply if the acknowledgements are not enough, for pipeline it's returned by Flush
+func (cp *ClusterPool) GetDurableConn(opts DurableOptions) redis.Conn {
+	return &redirconn{cp: cp, redir: true, readOnly: false, durable: &opts}
+}
+
+// command returns the WAIT or WAITAOF command
+func (d *DurableOptions) command() (string, []interface{}) {
+	timeout := d.Timeout.Milliseconds()
+	if d.AOF {
+		return "WAITAOF", []interface{}{d.NumLocal, d.NumReplicas, timeout}
+	}
+	return "WAIT", []interface{}{d.NumReplicas, timeout}
+}
+
+// check checks the reply of the WAIT or WAITAOF command
+func (d *DurableOptions) check(addr string, reply interface{}, err error) error {
+	if err != nil {
+		return err
+	}
+	ae := &AckError{Addr: addr, NumReplicas: d.NumReplicas}
+	if d.AOF {
+		acks, err := redis.Ints(reply, nil)
+		if err != nil {
+			return err
+		}
+		if len(acks) != 2 {
+			return fmt.Errorf("redicluster: unexpected WAITAOF reply %v", reply)
+		}
+		ae.NumLocal = d.NumLocal
+		ae.AckedLocal, ae.AckedReplicas = acks[0], acks[1]
+	} else {
+		if ae.AckedReplicas, err = redis.Int(reply, nil); err != nil {
+			return err
+		}
+	}
+	if ae.AckedLocal < ae.NumLocal || ae.AckedReplicas < ae.NumReplicas {
+		return ae
+	}
+	return nil
+}
+
+// wait waits the writes on the conn to be acknowledged
+func (d *DurableOptions) wait(ctx context.Context, conn redis.Conn, addr string) error {
+	cmd, args := d.command()
+	reply, err := connDoContext(conn, ctx, cmd, args...)
+	return d.check(addr, reply, err)
+}
@@ -0,0 +1,115 @@
+package redicluster
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDurableCheck(t *testing.T) {
+	d := &DurableOptions{NumReplicas: 2, Timeout: 100 * time.Millisecond}
+	cmd, args := d.command()
+	assert.Equal(t, "WAIT", cmd)
+	assert.Equal(t, []interface{}{2, int64(100)}, args)
+	assert.NoError(t, d.check("a:1", int64(2), nil))
+
+	err := d.check("a:1", int64(1), nil)
+	var ae *AckError
+	assert.True(t, errors.As(err, &ae))
+	assert.Equal(t, 1, ae.AckedReplicas)
+
+	d = &DurableOptions{AOF: true, NumLocal: 1, NumReplicas: 1}
+	cmd, _ = d.command()
+	assert.Equal(t, "WAITAOF", cmd)
+	assert.NoError(t, d.check("a:1", []interface{}{int64(1), int64(1)}, nil))
+	assert.Error(t, d.check("a:1", []interface{}{int64(0), int64(1)}, nil))
+	assert.Equal(t, redis.Error("ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled."),
+		d.check("a:1", nil, redis.Error("ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled.")))
+}
+
+func TestDurableConn(t *testing.T) {
+	c := newTestCluster(t)
+	cp := NewClusterPool(c.Addrs()[:1])
+	defer cp.Close()
+	require.NoError(t, cp.ReloadSlotMapping())
+
+	// every master has a replica
+	conn := cp.GetDurableConn(DurableOptions{NumReplicas: 1, Timeout: time.Second})
+	defer conn.Close()
+	v, err := redis.String(conn.Do("SET", "foo", "1"))
+	require.NoError(t, err)
+	assert.Equal(t, "OK", v)
+	for _, k := range []string{"a", "b", "c"} {
+		require.NoError(t, conn.Send("SET", k, "1"))
+	}
+	require.NoError(t, conn.Flush())
+	for i := 0; i < 3; i++ {
+		v, err = redis.String(conn.Receive())
+		require.NoError(t, err)
+		assert.Equal(t, "OK", v)
+	}
+
+	conn2 := cp.GetDurableConn(DurableOptions{NumReplicas: 2, Timeout: time.Second})
+	defer conn2.Close()
+	var ae *AckError
+	reply, err := conn2.Do("SET", "foo", "2")
+	require.ErrorAs(t, err, &ae)
+	assert.Equal(t, c.OwnerOf("foo").Addr, ae.Addr)
+	assert.Equal(t, 1, ae.AckedReplicas)
+	assert.Equal(t, "OK", reply)
+	require.NoError(t, conn2.Send("SET", "a", "2"))
+	require.NoError(t, conn2.Send("GET", "b"))
+	assert.ErrorAs(t, conn2.Flush(), &ae)
+	v, err = redis.String(conn2.Receive())
+	require.NoError(t, err)
+	assert.Equal(t, "OK", v)
+	v, err = redis.String(conn2.Receive())
+	require.NoError(t, err)
+	assert.Equal(t, "1", v)
+}
+
+func TestDurableTransaction(t *testing.T) {
+	c := newTestCluster(t)
+	cp := NewClusterPool(c.Addrs()[:1])
+	defer cp.Close()
+	require.NoError(t, cp.ReloadSlotMapping())
+
+	// the master of foo has a replica only, so every WAIT fails with *AckError
+	conn := cp.GetDurableConn(DurableOptions{NumReplicas: 2, Timeout: time.Second})
+	defer conn.Close()
+	_, err := conn.Do("GET", "foo")
+	require.NoError(t, err)
+	for _, cmd := range [][]interface{}{{"WATCH", "foo"}, {"UNWATCH"}, {"MULTI"}, {"SET", "foo", "1"}, {"INCR", "foo"}} {
+		_, err = conn.Do(cmd[0].(string), cmd[1:]...)
+		require.NoError(t, err, cmd[0])
+	}
+	var ae *AckError
+	reply, err := conn.Do("EXEC")
+	assert.ErrorAs(t, err, &ae)
+	assert.Equal(t, []interface{}{"OK", int64(2)}, reply)
+
+	// no WAIT after the transactions without writes
+	for _, cmd := range [][]interface{}{{"MULTI"}, {"GET", "foo"}, {"EXEC"}, {"MULTI"}, {"SET", "foo", "1"}, {"DISCARD"}} {
+		_, err = conn.Do(cmd[0].(string), cmd[1:]...)
+		require.NoError(t, err, cmd[0])
+	}
+}
+
+func TestBatchHasWrites(t *testing.T) {
+	bt := func(cmds ...string) *batch {
+		b := &batch{}
+		for _, c := range cmds {
+			b.cmds = append(b.cmds, &cmd{commandName: c})
+		}
+		return b
+	}
+	assert.False(t, bt("GET", "PING", "INFO").hasWrites())
+	assert.True(t, bt("GET", "set").hasWrites())
+	assert.False(t, bt("MULTI", "SET").hasWrites())
+	assert.True(t, bt("MULTI", "SET", "EXEC").hasWrites())
+	assert.False(t, bt("MULTI", "SET", "DISCARD", "WATCH", "MULTI", "GET", "EXEC").hasWrites())
+}
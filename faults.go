@@ -0,0 +1,404 @@
+package redicluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// ErrConnDropped is returned by the connections dropped by a FaultInjector, it counts as a node failure
+var ErrConnDropped = errors.New("redicluster: connection dropped by fault injection")
+
+// FaultError is the kind of the synthetic error replies of a FaultRule
+type FaultError string
+
+const (
+	FaultMoved       FaultError = "MOVED"
+	FaultAsk         FaultError = "ASK"
+	FaultTryAgain    FaultError = "TRYAGAIN"
+	FaultClusterDown FaultError = "CLUSTERDOWN"
+	FaultLoading     FaultError = "LOADING"
+)
+
+// reply returns the error reply of the kind as if it's sent by the node, MOVED and ASK redirect to addr
+func (fe FaultError) reply(cmd string, args []interface{}, addr string) error {
+	switch fe {
+	case FaultMoved, FaultAsk:
+		slot := CmdSlot(cmd, args...)
+		if slot < 0 {
+			slot = 0
+		}
+		return redis.Error(fmt.Sprintf("%s %d %s", fe, slot, addr))
+	case FaultTryAgain:
+		return redis.Error("TRYAGAIN Multiple keys request during rehashing of slot")
+	case FaultClusterDown:
+		return redis.Error("CLUSTERDOWN The cluster is down")
+	case FaultLoading:
+		return redis.Error("LOADING Redis is loading the dataset in memory")
+	}
+	return redis.Error("ERR " + string(fe))
+}
+
+// FaultRule describes the faults injected into the commands to a node
+type FaultRule struct {
+	// Addr is the node address the rule applies to, empty means all nodes
+	Addr string
+
+	// Commands are the command names the rule applies to case-insensitively, empty means all commands
+	Commands []string
+
+	// Rate is the probability the rule fires for a matching command, zero means 1
+	Rate float64
+
+	// Times is the maximum count the rule fires, zero means no limit
+	Times int
+
+	// Latency is added before the reply of the command
+	Latency time.Duration
+
+	// Drop drops the connection after the command is sent, so the reply is lost and the command may be executed
+	Drop bool
+
+	// Error replies the command with the synthetic error instead of sending it to the node
+	Error FaultError
+
+	// RedirectAddr is the address of the MOVED and ASK errors, empty means the node itself
+	RedirectAddr string
+}
+
+// matches reports if the rule applies to the command to the node address
+func (r *FaultRule) matches(addr, cmd string) bool {
+	if len(r.Addr) > 0 && r.Addr != addr {
+		return false
+	}
+	if len(r.Commands) == 0 {
+		return true
+	}
+	for _, c := range r.Commands {
+		if strings.EqualFold(c, cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+type faultRule struct {
+	FaultRule
+	id    int
+	fired int
+}
+
+// FaultInjector injects latency, dropped connections and synthetic error replies into the connections to nodes by
+// rules, for testing how the callers survive partial cluster failures. The rules can be changed and the injector
+// can be toggled at runtime. See ClusterPool.Faults
+type FaultInjector struct {
+	enabled atomic.Bool
+
+	// mu protects the following members
+	mu     sync.Mutex
+	rules  []*faultRule
+	nextID int
+	rnd    *rand.Rand
+}
+
+// NewFaultInjector returns an enabled FaultInjector without rules
+func NewFaultInjector() *FaultInjector {
+	fi := &FaultInjector{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))} //nolint:gosec
+	fi.enabled.Store(true)
+	return fi
+}
+
+// WithFaults injects the faults of fi into the connections to nodes. See ClusterPool.Faults
+func WithFaults(fi *FaultInjector) Option {
+	return optionFunc(func(cp *ClusterPool) {
+		cp.Faults = fi
+	})
+}
+
+// AddRule adds the rule and returns its id for RemoveRule. Every rule that fires adds its latency, the first one
+// that drops or errors decides the result of the command
+func (fi *FaultInjector) AddRule(r FaultRule) int {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.nextID++
+	r.Commands = append([]string(nil), r.Commands...)
+	fi.rules = append(fi.rules, &faultRule{FaultRule: r, id: fi.nextID})
+	return fi.nextID
+}
+
+// RemoveRule removes the rule by the id returned by AddRule
+func (fi *FaultInjector) RemoveRule(id int) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	for i, r := range fi.rules {
+		if r.id == id {
+			fi.rules = append(fi.rules[:i:i], fi.rules[i+1:]...)
+			return
+		}
+	}
+}
+
+// Reset removes all rules
+func (fi *FaultInjector) Reset() {
+	fi.mu.Lock()
+	fi.rules = nil
+	fi.mu.Unlock()
+}
+
+// Enable starts injecting the faults
+func (fi *FaultInjector) Enable() {
+	fi.enabled.Store(true)
+}
+
+// Disable stops injecting the faults, the rules are kept
+func (fi *FaultInjector) Disable() {
+	fi.enabled.Store(false)
+}
+
+// Enabled reports if the faults are injected
+func (fi *FaultInjector) Enabled() bool {
+	return fi.enabled.Load()
+}
+
+// Seed seeds the random source deciding if the rules fire, for reproducible runs
+func (fi *FaultInjector) Seed(seed int64) {
+	fi.mu.Lock()
+	fi.rnd = rand.New(rand.NewSource(seed)) //nolint:gosec
+	fi.mu.Unlock()
+}
+
+// fault is the decision of a FaultInjector on a command
+type fault struct {
+	latency time.Duration
+	drop    bool
+	err     error
+}
+
+// decide returns the faults injected into the command to the node address
+func (fi *FaultInjector) decide(addr, cmd string, args []interface{}) fault {
+	var f fault
+	if !fi.enabled.Load() {
+		return f
+	}
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	for _, r := range fi.rules {
+		if !r.matches(addr, cmd) || (r.Times > 0 && r.fired >= r.Times) {
+			continue
+		}
+		decided := f.drop || f.err != nil
+		if decided && r.Latency == 0 {
+			// the rule has nothing to add
+			continue
+		}
+		if r.Rate > 0 && r.Rate < 1 && fi.rnd.Float64() >= r.Rate {
+			continue
+		}
+		r.fired++
+		f.latency += r.Latency
+		if decided {
+			continue
+		}
+		switch {
+		case r.Drop:
+			f.drop = true
+		case len(r.Error) > 0:
+			to := r.RedirectAddr
+			if len(to) == 0 {
+				to = addr
+			}
+			f.err = r.Error.reply(cmd, args, to)
+		}
+	}
+	return f
+}
+
+// faultConn injects the faults decided by the FaultInjector into the connection to a node, beneath the pool. The
+// commands are sent by Send and their replies received in order, so the faults of the pipelined commands line up
+// with the replies
+type faultConn struct {
+	redis.Conn
+	fi   *FaultInjector
+	addr string
+
+	// pending are the outcomes of the sent commands whose replies are not received yet
+	pending []fault
+
+	// delay is the latency to inject before the next reply
+	delay time.Duration
+
+	// dropped is set once the connection is dropped, everything fails with ErrConnDropped since then
+	dropped bool
+}
+
+// injectFaults wraps the connection dialed to the node address by Faults once it's set up, so the dropped ones are
+// closed and discarded by the pool. The faults are seen by the stats and the circuit breaker like the real ones
+func (cp *ClusterPool) injectFaults(addr string, conn redis.Conn) redis.Conn {
+	if cp.Faults == nil {
+		return conn
+	}
+	return &faultConn{Conn: conn, fi: cp.Faults, addr: addr}
+}
+
+// unwrap returns the connection beneath the faults, e.g. the one to authenticate again on borrowing
+func (fc *faultConn) unwrap() redis.Conn {
+	return fc.Conn
+}
+
+func (fc *faultConn) Err() error {
+	if fc.dropped {
+		return ErrConnDropped
+	}
+	return fc.Conn.Err()
+}
+
+func (fc *faultConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return fc.do(context.Background(), fc.Conn.Receive, cmd, args...)
+}
+
+func (fc *faultConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	return fc.do(ctx, func() (interface{}, error) {
+		return connReceiveWithContext(fc.Conn, ctx)
+	}, cmd, args...)
+}
+
+func (fc *faultConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return fc.do(ctx, func() (interface{}, error) {
+		return connReceiveWithTimeout(fc.Conn, timeout)
+	}, cmd, args...)
+}
+
+// do mimics redis.Conn.Do by Send, Flush and receiving all pending replies, Do("") returns all of them
+func (fc *faultConn) do(ctx context.Context, recv func() (interface{}, error), cmd string, args ...interface{}) (
+	interface{}, error) {
+	if len(cmd) > 0 {
+		if err := fc.Send(cmd, args...); err != nil {
+			return nil, err
+		}
+	}
+	if err := fc.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, 0, len(fc.pending))
+	var first error
+	for len(fc.pending) > 0 {
+		reply, err := fc.receive(ctx, recv)
+		var re redis.Error
+		if errors.As(err, &re) {
+			reply = re
+			if first == nil {
+				first = re
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		replies = append(replies, reply)
+	}
+	if len(cmd) == 0 {
+		return replies, nil
+	}
+	if len(replies) == 0 {
+		return nil, first
+	}
+	return replies[len(replies)-1], first
+}
+
+func (fc *faultConn) Send(cmd string, args ...interface{}) error {
+	if fc.dropped {
+		return ErrConnDropped
+	}
+	f := fc.fi.decide(fc.addr, cmd, args)
+	fc.delay += f.latency
+	if f.err == nil {
+		// the dropped command is still sent, the node may execute it
+		if err := fc.Conn.Send(cmd, args...); err != nil {
+			return err
+		}
+	}
+	fc.pending = append(fc.pending, f)
+	return nil
+}
+
+func (fc *faultConn) Flush() error {
+	if fc.dropped {
+		return ErrConnDropped
+	}
+	return fc.Conn.Flush()
+}
+
+func (fc *faultConn) Receive() (interface{}, error) {
+	return fc.receive(context.Background(), fc.Conn.Receive)
+}
+
+func (fc *faultConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return fc.receive(ctx, func() (interface{}, error) {
+		return connReceiveWithContext(fc.Conn, ctx)
+	})
+}
+
+func (fc *faultConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return fc.receive(ctx, func() (interface{}, error) {
+		return connReceiveWithTimeout(fc.Conn, timeout)
+	})
+}
+
+// receive returns the next reply by recv with the faults of its command. The replies without a sent command, e.g.
+// the messages of pubsub, are received directly
+func (fc *faultConn) receive(ctx context.Context, recv func() (interface{}, error)) (interface{}, error) {
+	if fc.dropped {
+		return nil, ErrConnDropped
+	}
+	if fc.delay > 0 {
+		d := fc.delay
+		fc.delay = 0
+		if err := sleepContext(ctx, d); err != nil {
+			return nil, err
+		}
+	}
+	if len(fc.pending) == 0 {
+		return recv()
+	}
+	f := fc.pending[0]
+	fc.pending = fc.pending[1:]
+	switch {
+	case f.drop:
+		// the node sees the connection closed, and the pool discards it by Err
+		fc.dropped = true
+		fc.Conn.Close()
+		return nil, ErrConnDropped
+	case f.err != nil:
+		return nil, f.err
+	}
+	return recv()
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,160 @@
+package redicluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rmker/redicluster/clustertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFaultPool(t *testing.T) (*ClusterPool, *FaultInjector) {
+	cp, fi, _ := newFaultCluster(t)
+	return cp, fi
+}
+
+func newFaultCluster(t *testing.T) (*ClusterPool, *FaultInjector, *clustertest.Cluster) {
+	fi := NewFaultInjector()
+	fi.Seed(1)
+	c := newTestCluster(t)
+	cp := NewClusterPool(c.Addrs()[:1], WithFaults(fi))
+	t.Cleanup(cp.Close)
+	require.NoError(t, cp.ReloadSlotMapping())
+	return cp, fi, c
+}
+
+func TestFaultErrors(t *testing.T) {
+	cp, fi := newFaultPool(t)
+	conn := cp.Get()
+	defer conn.Close()
+	_, err := conn.Do("SET", "foo", "v")
+	require.NoError(t, err)
+
+	for fe, want := range map[FaultError]string{
+		FaultTryAgain:    "TRYAGAIN Multiple keys request during rehashing of slot",
+		FaultClusterDown: "CLUSTERDOWN The cluster is down",
+		FaultLoading:     "LOADING Redis is loading the dataset in memory",
+	} {
+		id := fi.AddRule(FaultRule{Commands: []string{"get"}, Error: fe})
+		_, err = conn.Do("GET", "foo")
+		assert.EqualError(t, err, want)
+		fi.RemoveRule(id)
+	}
+	v, err := redis.String(conn.Do("GET", "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, "v", v)
+
+	// the redirect to the node itself is retried once
+	addr := cp.topology().addrs(Slot("foo"))[0]
+	for _, fe := range []FaultError{FaultMoved, FaultAsk} {
+		fi.AddRule(FaultRule{Addr: addr, Error: fe, Times: 1})
+		v, err = redis.String(conn.Do("GET", "foo"))
+		require.NoError(t, err)
+		assert.Equal(t, "v", v)
+	}
+	st := cp.NodeStats()[addr]
+	assert.Equal(t, int64(1), st.Moved)
+	assert.Equal(t, int64(1), st.Ask)
+
+	// the rules of other addresses and commands don't fire
+	fi.Reset()
+	fi.AddRule(FaultRule{Addr: "127.0.0.1:1", Error: FaultClusterDown})
+	fi.AddRule(FaultRule{Commands: []string{"SET"}, Error: FaultClusterDown})
+	_, err = conn.Do("GET", "foo")
+	assert.NoError(t, err)
+	_, err = conn.Do("SET", "foo", "v")
+	assert.Error(t, err)
+
+	fi.Disable()
+	assert.False(t, fi.Enabled())
+	_, err = conn.Do("SET", "foo", "v")
+	assert.NoError(t, err)
+	fi.Enable()
+	_, err = conn.Do("SET", "foo", "v")
+	assert.Error(t, err)
+}
+
+func TestFaultRate(t *testing.T) {
+	cp, fi := newFaultPool(t)
+	conn := cp.Get()
+	defer conn.Close()
+	fi.AddRule(FaultRule{Commands: []string{"PING"}, Rate: 0.5, Error: FaultLoading})
+	failed := 0
+	for i := 0; i < 200; i++ {
+		if _, err := conn.Do("PING"); err != nil {
+			failed++
+		}
+	}
+	assert.InDelta(t, 100, failed, 40)
+}
+
+func TestFaultLatency(t *testing.T) {
+	cp, fi := newFaultPool(t)
+	fi.AddRule(FaultRule{Commands: []string{"GET"}, Latency: 50 * time.Millisecond})
+	conn := cp.Get()
+	defer conn.Close()
+	_, err := conn.Do("MSET", "a", "1", "b", "2")
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = conn.Do("GET", "foo")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// the pipelined commands wait once
+	start = time.Now()
+	assert.Equal(t, []string{"1", "2"}, getAll(t, conn, "a", "b"))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = redis.DoContext(conn, ctx, "GET", "foo")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestFaultDrop(t *testing.T) {
+	cp, fi, c := newFaultCluster(t)
+	conn := cp.Get()
+	defer conn.Close()
+	id := fi.AddRule(FaultRule{Commands: []string{"INCR"}, Drop: true})
+	addr := cp.topology().addrs(Slot("n"))[0]
+	_, err := conn.Do("PING")
+	require.NoError(t, err)
+	clients := c.Node(addr).Clients()
+	_, err = conn.Do("INCR", "n")
+	assert.ErrorIs(t, err, ErrConnDropped)
+	fi.RemoveRule(id)
+
+	// the node sees the connection closed
+	require.Eventually(t, func() bool {
+		return c.Node(addr).Clients() == clients-1
+	}, time.Second, time.Millisecond)
+
+	// the dropped command is executed by the node before it sees the connection closed
+	require.Eventually(t, func() bool {
+		v, err := redis.String(conn.Do("GET", "n"))
+		return err == nil && v == "1"
+	}, time.Second, time.Millisecond)
+	n, err := redis.Int(conn.Do("INCR", "n"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	st := cp.NodeStats()[addr]
+	assert.Equal(t, int64(1), st.Errors.IO)
+
+	// the pipeline fails from the dropped command on
+	fi.AddRule(FaultRule{Commands: []string{"GET"}, Drop: true, Times: 1})
+	for _, k := range []string{"x", "{x}.1"} {
+		require.NoError(t, conn.Send("SET", k, "v"))
+		require.NoError(t, conn.Send("GET", k))
+	}
+	require.NoError(t, conn.Flush())
+	_, err = conn.Receive()
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = conn.Receive()
+		assert.ErrorIs(t, err, ErrConnDropped)
+	}
+}
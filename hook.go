@@ -0,0 +1,193 @@
+package redicluster
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Command hooks. The Hooks of ClusterPool are called around the single commands, the pipelines, the redirects and
+// the slot mapping reloads, for tracing, logging and metrics. The Before callbacks are called in order and can
+// annotate the context or short-circuit the request, the After callbacks are called in reverse order.
+
+// ErrHandled is returned by BeforeCommand or BeforePipeline to short-circuit the request with the replies set in
+// the info, e.g. the ones from a local cache. It can be wrapped
+var ErrHandled = errors.New("redicluster: handled by hook")
+
+// CommandInfo describes a command for the hooks
+type CommandInfo struct {
+	Cmd  string
+	Args []interface{}
+
+	// Slot is the hash slot of the command, -1 if it has no key
+	Slot int
+
+	// Addr is the node address the command is sent to, the last one if it's redirected
+	Addr string
+
+	// Redirects is the count of MOVED or ASK redirects of the command
+	Redirects int
+
+	// Reply and Err are the result of the command, they are set before AfterCommand
+	Reply interface{}
+	Err   error
+
+	// Duration is the time the command takes, including the redirects
+	Duration time.Duration
+}
+
+// BatchInfo describes a batch of a pipeline, which is a real pipeline request to a node
+type BatchInfo struct {
+	Addr string
+
+	// Cmds is the count of the commands in the batch
+	Cmds int
+
+	// Err is the error of the batch, e.g. the connection error. The error replies of commands are in CommandInfo
+	Err error
+
+	Duration time.Duration
+
+	// Redirect indicates the batch sends the redirected commands
+	Redirect bool
+}
+
+// PipelineInfo describes a pipeline for the hooks
+type PipelineInfo struct {
+	Cmds []*CommandInfo
+
+	// Batches are the batches the pipeline runs, they are set before AfterPipeline
+	Batches []BatchInfo
+
+	// Err is the error returned by Flush
+	Err error
+
+	Duration time.Duration
+}
+
+// ReloadInfo describes a reload of the slot mapping
+type ReloadInfo struct {
+	// Addr is the node address the slot mapping is loaded from, empty if it fails
+	Addr string
+
+	Err      error
+	Duration time.Duration
+}
+
+// Hook is called by the ClusterPool around the requests, see ClusterPool.Hooks. Embed NoopHook to implement part
+// of the callbacks only. The callbacks can be called concurrently
+type Hook interface {
+	// BeforeCommand is called before a command is sent by Do, the returned context is used by the command and
+	// passed to AfterCommand. The command fails with the error if it's not nil, and ErrHandled makes it return the
+	// Reply and Err of ci instead. MSET and MGET are split into a pipeline by slot, which is not seen by the
+	// pipeline hooks
+	BeforeCommand(ctx context.Context, ci *CommandInfo) (context.Context, error)
+
+	// AfterCommand is called after the command of BeforeCommand, even if it's short-circuited
+	AfterCommand(ctx context.Context, ci *CommandInfo)
+
+	// BeforePipeline is called before a pipeline is flushed, like BeforeCommand. The commands of the pipeline get
+	// the Reply and Err of pi.Cmds if ErrHandled is returned
+	BeforePipeline(ctx context.Context, pi *PipelineInfo) (context.Context, error)
+
+	// AfterPipeline is called after the pipeline of BeforePipeline
+	AfterPipeline(ctx context.Context, pi *PipelineInfo)
+
+	// OnRedirect is called when a command sent to the from address is redirected by MOVED or ASK
+	OnRedirect(ctx context.Context, ri *RedirInfo, from string)
+
+	// OnReload is called after the slot mapping is reloaded
+	OnReload(ctx context.Context, ri *ReloadInfo)
+}
+
+// NoopHook implements Hook with no-op callbacks
+type NoopHook struct{}
+
+func (NoopHook) BeforeCommand(ctx context.Context, ci *CommandInfo) (context.Context, error) {
+	return ctx, nil
+}
+
+func (NoopHook) AfterCommand(ctx context.Context, ci *CommandInfo) {}
+
+func (NoopHook) BeforePipeline(ctx context.Context, pi *PipelineInfo) (context.Context, error) {
+	return ctx, nil
+}
+
+func (NoopHook) AfterPipeline(ctx context.Context, pi *PipelineInfo) {}
+
+func (NoopHook) OnRedirect(ctx context.Context, ri *RedirInfo, from string) {}
+
+func (NoopHook) OnReload(ctx context.Context, ri *ReloadInfo) {}
+
+// WithHooks appends the hooks to the ClusterPool. See ClusterPool.Hooks
+func WithHooks(hooks ...Hook) Option {
+	return optionFunc(func(cp *ClusterPool) {
+		cp.Hooks = append(cp.Hooks, hooks...)
+	})
+}
+
+// hookCommand runs do between the command hooks
+func (cp *ClusterPool) hookCommand(ctx context.Context, ci *CommandInfo, do func(ctx context.Context, ci *CommandInfo)) {
+	start := time.Now()
+	n := 0
+	var err error
+	for _, h := range cp.Hooks {
+		ctx, err = h.BeforeCommand(ctx, ci)
+		n++
+		if err != nil {
+			break
+		}
+	}
+	switch {
+	case err == nil:
+		do(ctx, ci)
+	case errors.Is(err, ErrHandled):
+	default:
+		ci.Reply, ci.Err = nil, err
+	}
+	ci.Duration = time.Since(start)
+	for i := n - 1; i >= 0; i-- {
+		cp.Hooks[i].AfterCommand(ctx, ci)
+	}
+}
+
+// hookPipeline runs flush between the pipeline hooks
+func (cp *ClusterPool) hookPipeline(ctx context.Context, pi *PipelineInfo, flush func(ctx context.Context, pi *PipelineInfo)) {
+	start := time.Now()
+	n := 0
+	var err error
+	for _, h := range cp.Hooks {
+		ctx, err = h.BeforePipeline(ctx, pi)
+		n++
+		if err != nil {
+			break
+		}
+	}
+	switch {
+	case err == nil:
+		flush(ctx, pi)
+	case errors.Is(err, ErrHandled):
+	default:
+		pi.Err = err
+		for _, ci := range pi.Cmds {
+			ci.Reply, ci.Err = nil, err
+		}
+	}
+	pi.Duration = time.Since(start)
+	for i := n - 1; i >= 0; i-- {
+		cp.Hooks[i].AfterPipeline(ctx, pi)
+	}
+}
+
+func (cp *ClusterPool) hookRedirect(ctx context.Context, ri *RedirInfo, from string) {
+	cp.log(LogDebug, "redicluster: redirected", "kind", ri.Kind, "slot", ri.Slot, "from", from, "to", ri.Addr)
+	for _, h := range cp.Hooks {
+		h.OnRedirect(ctx, ri, from)
+	}
+}
+
+func (cp *ClusterPool) hookReload(ctx context.Context, ri *ReloadInfo) {
+	for _, h := range cp.Hooks {
+		h.OnReload(ctx, ri)
+	}
+}
@@ -0,0 +1,155 @@
+package redicluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type ctxKey struct{}
+
+type recordHook struct {
+	NoopHook
+	mu        sync.Mutex
+	commands  []CommandInfo
+	pipelines []PipelineInfo
+	redirects []string
+	reloads   []ReloadInfo
+	annotated int
+}
+
+func (h *recordHook) BeforeCommand(ctx context.Context, ci *CommandInfo) (context.Context, error) {
+	if len(ci.Args) > 0 {
+		switch ci.Args[0] {
+		case "cached":
+			ci.Reply = "hit"
+			return ctx, fmt.Errorf("cache: %w", ErrHandled)
+		case "denied":
+			return ctx, errors.New("denied")
+		}
+	}
+	return context.WithValue(ctx, ctxKey{}, "traced"), nil
+}
+
+func (h *recordHook) AfterCommand(ctx context.Context, ci *CommandInfo) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.commands = append(h.commands, *ci)
+	if ctx.Value(ctxKey{}) == "traced" {
+		h.annotated++
+	}
+}
+
+func (h *recordHook) AfterPipeline(ctx context.Context, pi *PipelineInfo) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pipelines = append(h.pipelines, *pi)
+}
+
+func (h *recordHook) OnRedirect(ctx context.Context, ri *RedirInfo, from string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.redirects = append(h.redirects, ri.Kind+" "+from+" -> "+ri.Addr)
+}
+
+func (h *recordHook) OnReload(ctx context.Context, ri *ReloadInfo) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reloads = append(h.reloads, *ri)
+}
+
+func TestHooks(t *testing.T) {
+	addr2 := serveRedis(t, func(state map[string]string, args []string) string {
+		return "$2\r\nv2\r\n"
+	})
+	addr1 := serveRedis(t, func(state map[string]string, args []string) string {
+		switch {
+		case args[0] == "CLUSTER":
+			return "-ERR This instance has cluster support disabled\r\n"
+		case len(args) > 1 && args[1] == "moved":
+			return fmt.Sprintf("-MOVED %d %s\r\n", Slot("moved"), addr2)
+		}
+		return "$1\r\nv\r\n"
+	})
+	h := &recordHook{}
+	cp := NewClusterPool([]string{addr1}, WithHooks(h))
+	defer cp.Close()
+	cp.setSlots([]*slotInfo{{Start: 0, End: TotalSlots - 1, Nodes: []*NodeInfo{{Addr: addr1, Role: "master"}}, Addrs: []string{addr1}}})
+
+	conn := cp.Get()
+	defer conn.Close()
+	v, err := redis.String(conn.Do("GET", "k"))
+	require.NoError(t, err)
+	assert.Equal(t, "v", v)
+	v, err = redis.String(conn.Do("GET", "cached"))
+	require.NoError(t, err)
+	assert.Equal(t, "hit", v)
+	_, err = conn.Do("GET", "denied")
+	assert.EqualError(t, err, "denied")
+	v, err = redis.String(conn.Do("GET", "moved"))
+	require.NoError(t, err)
+	assert.Equal(t, "v2", v)
+
+	h.mu.Lock()
+	require.Len(t, h.commands, 4)
+	assert.Equal(t, Slot("k"), h.commands[0].Slot)
+	assert.Equal(t, addr1, h.commands[0].Addr)
+	assert.Equal(t, []byte("v"), h.commands[0].Reply)
+	assert.Empty(t, h.commands[1].Addr)
+	assert.EqualError(t, h.commands[2].Err, "denied")
+	assert.Equal(t, addr2, h.commands[3].Addr)
+	assert.Equal(t, 1, h.commands[3].Redirects)
+	assert.Equal(t, 2, h.annotated)
+	assert.Equal(t, []string{"MOVED " + addr1 + " -> " + addr2}, h.redirects)
+	h.mu.Unlock()
+
+	// restore the slot mapping changed by MOVED
+	cp.setSlots([]*slotInfo{{Start: 0, End: TotalSlots - 1, Nodes: []*NodeInfo{{Addr: addr1, Role: "master"}}, Addrs: []string{addr1}}})
+
+	// MGET is seen by the command hooks only, not by the pipeline hooks
+	_, err = conn.Do("MGET", "k", "k2")
+	require.NoError(t, err)
+	h.mu.Lock()
+	require.Len(t, h.commands, 5)
+	assert.Equal(t, "MGET", h.commands[4].Cmd)
+	assert.Empty(t, h.pipelines)
+	h.mu.Unlock()
+	require.NoError(t, conn.Send("GET", "k"))
+	require.NoError(t, conn.Send("GET", "moved"))
+	require.NoError(t, conn.Flush())
+	for _, want := range []string{"v", "v2"} {
+		v, err = redis.String(conn.Receive())
+		require.NoError(t, err)
+		assert.Equal(t, want, v)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	require.Len(t, h.pipelines, 1)
+	pi := h.pipelines[0]
+	require.Len(t, pi.Cmds, 2)
+	assert.Equal(t, addr1, pi.Cmds[0].Addr)
+	assert.Equal(t, addr2, pi.Cmds[1].Addr)
+	assert.Equal(t, 1, pi.Cmds[1].Redirects)
+	require.Len(t, pi.Batches, 2)
+	assert.Equal(t, BatchInfo{Addr: addr1, Cmds: 2}, BatchInfo{Addr: pi.Batches[0].Addr, Cmds: pi.Batches[0].Cmds})
+	assert.True(t, pi.Batches[1].Redirect)
+	assert.Equal(t, addr2, pi.Batches[1].Addr)
+}
+
+func TestReloadHook(t *testing.T) {
+	h := &recordHook{}
+	cp := NewClusterPool([]string{"127.0.0.1:1"}, WithHooks(h), WithDialTimeout(100*time.Millisecond))
+	defer cp.Close()
+	assert.Error(t, cp.ReloadSlotMapping())
+	require.Len(t, h.reloads, 1)
+	assert.Error(t, h.reloads[0].Err)
+	assert.Empty(t, h.reloads[0].Addr)
+}
@@ -0,0 +1,232 @@
+package redicluster
+
+import (
+	"sync"
+	"time"
+)
+
+// Per-node latency tracking. Every round trip on a node connection is recorded by the nodeConn wrapper into
+// the latencyTracker of the node, which keeps an EWMA for routing and a windowed histogram for quantiles.
+
+const (
+	// weight of the newest sample in EWMA
+	latencyEWMAWeight = 0.2
+
+	// quantiles are computed over the current and the previous window
+	latencyWindow = time.Minute
+
+	// upper bound of the first histogram bucket, every next bucket doubles it
+	latencyFirstBucket = 10 * time.Microsecond
+
+	// 10us * 2^21 is about 21s, the last bucket holds everything above
+	latencyBuckets = 22
+)
+
+// LatencyStats is the round-trip latency statistics of a node
+type LatencyStats struct {
+	// EWMA is the exponentially weighted moving average of round-trip times
+	EWMA time.Duration
+
+	// P50 and P99 are estimated from the samples in the last one or two minutes
+	P50 time.Duration
+	P99 time.Duration
+
+	// Samples is the total count of samples
+	Samples uint64
+
+	// LastSample is the time of the last sample
+	LastSample time.Time
+
+	// Sum is the total of all samples
+	Sum time.Duration
+
+	// Histogram counts all samples by exponential buckets, the last bucket holds the samples above its bound too
+	Histogram []LatencyBucket
+}
+
+// LatencyBucket is a bucket of the latency histogram
+type LatencyBucket struct {
+	// UpperBound is the inclusive upper bound of the samples in the bucket
+	UpperBound time.Duration
+
+	// Count is the count of samples in the bucket, not including the ones in the lower buckets
+	Count uint64
+}
+
+// latencyHistogram counts the samples in exponential buckets
+type latencyHistogram [latencyBuckets]uint64
+
+func latencyBucket(d time.Duration) int {
+	b := 0
+	for ub := latencyFirstBucket; d > ub && b < latencyBuckets-1; ub *= 2 {
+		b++
+	}
+	return b
+}
+
+// latencyBucketBound returns the upper bound of the bucket
+func latencyBucketBound(b int) time.Duration {
+	return latencyFirstBucket << uint(b)
+}
+
+// quantile estimates the q quantile by interpolating inside the bucket that holds it
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	var total uint64
+	for _, n := range h {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	var cum uint64
+	for b, n := range h {
+		if n == 0 {
+			continue
+		}
+		if float64(cum+n) >= rank {
+			lower := time.Duration(0)
+			if b > 0 {
+				lower = latencyBucketBound(b - 1)
+			}
+			upper := latencyBucketBound(b)
+			frac := (rank - float64(cum)) / float64(n)
+			return lower + time.Duration(frac*float64(upper-lower))
+		}
+		cum += n
+	}
+	return latencyBucketBound(latencyBuckets - 1)
+}
+
+type latencyTracker struct {
+	mu         sync.Mutex
+	ewma       float64
+	samples    uint64
+	lastSample time.Time
+	windowAt   time.Time
+	cur, prev  latencyHistogram
+
+	// total and sum are all samples since the start
+	total latencyHistogram
+	sum   time.Duration
+}
+
+func (lt *latencyTracker) observe(d time.Duration) {
+	now := time.Now()
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if lt.samples == 0 {
+		lt.ewma = float64(d)
+	} else {
+		lt.ewma += latencyEWMAWeight * (float64(d) - lt.ewma)
+	}
+	lt.samples++
+	lt.lastSample = now
+	lt.rotate(now)
+	b := latencyBucket(d)
+	lt.cur[b]++
+	lt.total[b]++
+	lt.sum += d
+}
+
+// rotate starts a new window if the current one expires. lt.mu must be held by the caller
+func (lt *latencyTracker) rotate(now time.Time) {
+	if now.Sub(lt.windowAt) < latencyWindow {
+		return
+	}
+	if now.Sub(lt.windowAt) < 2*latencyWindow {
+		lt.prev = lt.cur
+	} else {
+		lt.prev = latencyHistogram{}
+	}
+	lt.cur = latencyHistogram{}
+	lt.windowAt = now
+}
+
+func (lt *latencyTracker) stats() LatencyStats {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.rotate(time.Now())
+	h := lt.prev
+	for b, n := range lt.cur {
+		h[b] += n
+	}
+	return LatencyStats{
+		EWMA:       time.Duration(lt.ewma),
+		P50:        h.quantile(0.5),
+		P99:        h.quantile(0.99),
+		Samples:    lt.samples,
+		LastSample: lt.lastSample,
+		Sum:        lt.sum,
+		Histogram:  lt.total.buckets(),
+	}
+}
+
+func (h *latencyHistogram) buckets() []LatencyBucket {
+	bs := make([]LatencyBucket, latencyBuckets)
+	for b, n := range h {
+		bs[b] = LatencyBucket{UpperBound: latencyBucketBound(b), Count: n}
+	}
+	return bs
+}
+
+// NodeLatency returns the latency statistics of the node address
+func (cp *ClusterPool) NodeLatency(addr string) (LatencyStats, bool) {
+	ns := cp.lookupNodeState(addr)
+	if ns == nil {
+		return LatencyStats{}, false
+	}
+	return ns.latency.stats(), true
+}
+
+// Latencies returns the latency statistics of all nodes that have been requested
+func (cp *ClusterPool) Latencies() map[string]LatencyStats {
+	ls := make(map[string]LatencyStats)
+	cp.rangeNodeStates(func(k string, ns *nodeState) bool {
+		ls[k] = ns.latency.stats()
+		return true
+	})
+	return ls
+}
+
+// fastest returns the address with the lowest EWMA in addrs, the addresses without samples go first so
+// that they get measured
+func (cp *ClusterPool) fastest(addrs []string) string {
+	best := ""
+	bestEWMA := 0.0
+	for _, addr := range addrs {
+		ewma := 0.0
+		if ns := cp.lookupNodeState(addr); ns != nil {
+			ns.latency.mu.Lock()
+			if ns.latency.samples > 0 {
+				ewma = ns.latency.ewma
+			}
+			ns.latency.mu.Unlock()
+		}
+		if len(best) == 0 || ewma < bestEWMA {
+			best, bestEWMA = addr, ewma
+		}
+	}
+	return best
+}
+
+// probeIdleNodes pings the nodes that have no samples in the last LatencyProbeInterval, so the stale
+// measurements of the nodes that are avoided by latency-based routing can recover
+func (cp *ClusterPool) probeIdleNodes() {
+	interval := cp.LatencyProbeInterval
+	var idle []string
+	for _, addr := range cp.getNodes(true) {
+		if ns := cp.lookupNodeState(addr); ns != nil {
+			ns.latency.mu.Lock()
+			last := ns.latency.lastSample
+			ns.latency.mu.Unlock()
+			if time.Since(last) < interval {
+				continue
+			}
+		}
+		idle = append(idle, addr)
+	}
+	for _, addr := range idle {
+		cp.ping(addr, interval)
+	}
+}
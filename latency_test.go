@@ -0,0 +1,79 @@
+package redicluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyTracker(t *testing.T) {
+	var lt latencyTracker
+	for i := 0; i < 98; i++ {
+		lt.observe(time.Millisecond)
+	}
+	lt.observe(100 * time.Millisecond)
+	lt.observe(100 * time.Millisecond)
+
+	st := lt.stats()
+	assert.Equal(t, uint64(100), st.Samples)
+	assert.True(t, st.P50 > 500*time.Microsecond && st.P50 <= 2*time.Millisecond, "p50: %s", st.P50)
+	assert.True(t, st.P99 > 50*time.Millisecond && st.P99 <= 200*time.Millisecond, "p99: %s", st.P99)
+	assert.True(t, st.EWMA > time.Millisecond, "ewma: %s", st.EWMA)
+}
+
+func TestLatencyRouting(t *testing.T) {
+	cp := &ClusterPool{LatencyRouting: true}
+	require.NoError(t, cp.updateShardMap(testShardsReply()))
+	cp.nodeState("10.0.0.2:6379").latency.observe(5 * time.Millisecond)
+	cp.nodeState("10.0.0.3:6379").latency.observe(time.Millisecond)
+
+	addrs, err := cp.GetAddrsBySlots([]int{0}, true)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.3:6379", addrs[0])
+
+	ls, ok := cp.NodeLatency("10.0.0.2:6379")
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Millisecond, ls.EWMA)
+	assert.Len(t, cp.Latencies(), 2)
+}
+
+func TestBlockingLatency(t *testing.T) {
+	assert.True(t, isBlockingCommand("blpop", []interface{}{"k", 0}))
+	assert.True(t, isBlockingCommand("XREAD", []interface{}{"COUNT", 1, []byte("block"), 0, "STREAMS", "s", "$"}))
+	assert.False(t, isBlockingCommand("XREAD", []interface{}{"STREAMS", "block", "$"}))
+	assert.False(t, isBlockingCommand("GET", []interface{}{"k"}))
+
+	cp := NewClusterPool(newTestCluster(t).Addrs()[:1])
+	defer cp.Close()
+	require.NoError(t, cp.ReloadSlotMapping())
+	addr := cp.topology().addrs(Slot("k"))[0]
+	conn, err := cp.getRedisConnByAddr(context.Background(), addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	ns := cp.nodeState(addr)
+	samples, commands := ns.latency.stats().Samples, ns.counters.commands.Load()
+
+	// the blocking commands are counted but not sampled, including the pipelines with them
+	_, err = conn.Do("WAIT", 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, conn.Send("GET", "k"))
+	require.NoError(t, conn.Send("WAIT", 0, 0))
+	require.NoError(t, conn.Flush())
+	for i := 0; i < 2; i++ {
+		_, err = conn.Receive()
+		require.NoError(t, err)
+	}
+	assert.Equal(t, samples, ns.latency.stats().Samples)
+
+	_, err = conn.Do("GET", "k")
+	require.NoError(t, err)
+	require.NoError(t, conn.Send("GET", "k"))
+	require.NoError(t, conn.Flush())
+	_, err = conn.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, samples+2, ns.latency.stats().Samples)
+	assert.Equal(t, commands+5, ns.counters.commands.Load())
+}
@@ -0,0 +1,129 @@
+package redicluster
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Structured logging of the cluster events. The records are sent to ClusterPool.Logger with alternating keys and
+// values as the args, like log/slog, so a *slog.Logger can be used as the Logger directly.
+
+// Logger receives the records of the cluster events, it's implemented by *slog.Logger
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// LogLevel is the level of the records, the values are the same as slog.Level
+type LogLevel int
+
+const (
+	LogDebug LogLevel = -4
+	LogInfo  LogLevel = 0
+	LogWarn  LogLevel = 4
+	LogError LogLevel = 8
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarn:
+		return "WARN"
+	case LogError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// WithLogger sends the records of the cluster events at level or above to l. See ClusterPool.Logger
+func WithLogger(l Logger, level LogLevel) Option {
+	return optionFunc(func(cp *ClusterPool) {
+		cp.Logger = l
+		cp.LogLevel = level
+	})
+}
+
+// logEnabled reports if the records at level are sent to the Logger
+func (cp *ClusterPool) logEnabled(level LogLevel) bool {
+	return cp.Logger != nil && level >= cp.LogLevel
+}
+
+func (cp *ClusterPool) log(level LogLevel, msg string, args ...interface{}) {
+	if !cp.logEnabled(level) {
+		return
+	}
+	switch {
+	case level >= LogError:
+		cp.Logger.Error(msg, args...)
+	case level >= LogWarn:
+		cp.Logger.Warn(msg, args...)
+	case level >= LogInfo:
+		cp.Logger.Info(msg, args...)
+	default:
+		cp.Logger.Debug(msg, args...)
+	}
+}
+
+// topologyDiff is the change between two topologies
+type topologyDiff struct {
+	added   []string
+	removed []string
+
+	// roles are the nodes whose role changes, like "addr master->replica"
+	roles []string
+
+	// movedSlots is the count of slots whose master changes
+	movedSlots int
+}
+
+func (d *topologyDiff) empty() bool {
+	return len(d.added) == 0 && len(d.removed) == 0 && len(d.roles) == 0 && d.movedSlots == 0
+}
+
+func (d *topologyDiff) String() string {
+	return fmt.Sprintf("added %v, removed %v, role changed %v, moved slots %d", d.added, d.removed, d.roles, d.movedSlots)
+}
+
+// args returns the diff as the args of a record
+func (d *topologyDiff) args() []interface{} {
+	return []interface{}{"added", d.added, "removed", d.removed, "role_changed", d.roles, "moved_slots", d.movedSlots}
+}
+
+// diffTopology compares the nodes and slot owners of the topologies
+func diffTopology(from, to *topology) *topologyDiff {
+	d := &topologyDiff{}
+	for addr, n := range to.nodes {
+		if o := from.nodes[addr]; o == nil {
+			d.added = append(d.added, addr)
+		} else if o.Role != n.Role {
+			d.roles = append(d.roles, addr+" "+o.Role+"->"+n.Role)
+		}
+	}
+	for addr := range from.nodes {
+		if to.nodes[addr] == nil {
+			d.removed = append(d.removed, addr)
+		}
+	}
+	for i := 0; i < TotalSlots; i++ {
+		if slotOwner(from, i) != slotOwner(to, i) {
+			d.movedSlots++
+		}
+	}
+	sort.Strings(d.added)
+	sort.Strings(d.removed)
+	sort.Strings(d.roles)
+	return d
+}
+
+// slotOwner returns the master address of the slot, empty if it's not served
+func slotOwner(t *topology, slot int) string {
+	if sa := t.addrs(slot); len(sa) > 0 {
+		return sa[0]
+	}
+	return ""
+}
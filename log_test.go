@@ -0,0 +1,155 @@
+package redicluster
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type logRecord struct {
+	level LogLevel
+	msg   string
+	attrs map[string]interface{}
+}
+
+type recordLogger struct {
+	mu      sync.Mutex
+	records []logRecord
+}
+
+func (l *recordLogger) record(level LogLevel, msg string, args []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	attrs := map[string]interface{}{}
+	for i := 0; i+1 < len(args); i += 2 {
+		attrs[args[i].(string)] = args[i+1]
+	}
+	l.records = append(l.records, logRecord{level: level, msg: msg, attrs: attrs})
+}
+
+func (l *recordLogger) Debug(msg string, args ...interface{}) { l.record(LogDebug, msg, args) }
+func (l *recordLogger) Info(msg string, args ...interface{})  { l.record(LogInfo, msg, args) }
+func (l *recordLogger) Warn(msg string, args ...interface{})  { l.record(LogWarn, msg, args) }
+func (l *recordLogger) Error(msg string, args ...interface{}) { l.record(LogError, msg, args) }
+
+// find returns the records with msg
+func (l *recordLogger) find(msg string) []logRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var rs []logRecord
+	for _, r := range l.records {
+		if r.msg == msg {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+func TestDiffTopology(t *testing.T) {
+	from := newTopology([]*slotInfo{
+		{Start: 0, End: 99, Nodes: []*NodeInfo{{Addr: "a", Role: "master"}, {Addr: "b", Role: "replica"}}, Addrs: []string{"a", "b"}},
+		{Start: 100, End: 199, Nodes: []*NodeInfo{{Addr: "c", Role: "master"}}, Addrs: []string{"c"}},
+	})
+	to := newTopology([]*slotInfo{
+		{Start: 0, End: 99, Nodes: []*NodeInfo{{Addr: "b", Role: "master"}, {Addr: "a", Role: "replica"}}, Addrs: []string{"b", "a"}},
+		{Start: 100, End: 199, Nodes: []*NodeInfo{{Addr: "d", Role: "master"}}, Addrs: []string{"d"}},
+	})
+	d := diffTopology(from, to)
+	assert.Equal(t, []string{"d"}, d.added)
+	assert.Equal(t, []string{"c"}, d.removed)
+	assert.Equal(t, []string{"a master->replica", "b replica->master"}, d.roles)
+	assert.Equal(t, 200, d.movedSlots)
+	assert.True(t, diffTopology(to, to).empty())
+}
+
+func TestLogger(t *testing.T) {
+	addr := serveRedis(t, func(state map[string]string, args []string) string {
+		if args[0] == "CLUSTER" {
+			return "-ERR This instance has cluster support disabled\r\n"
+		}
+		return "$1\r\nv\r\n"
+	})
+	l := &recordLogger{}
+	cp := NewClusterPool([]string{addr}, WithLogger(l, LogInfo), WithMaxIdle(1))
+	defer cp.Close()
+	cp.setSlots([]*slotInfo{{Start: 0, End: TotalSlots - 1, Nodes: []*NodeInfo{{Addr: addr, Role: "master"}}, Addrs: []string{addr}}})
+
+	rs := l.find("redicluster: topology changed")
+	require.Len(t, rs, 1)
+	assert.Equal(t, LogInfo, rs[0].level)
+	assert.Equal(t, []string{addr}, rs[0].attrs["added"])
+	assert.Equal(t, TotalSlots, rs[0].attrs["moved_slots"])
+
+	conn := cp.Get()
+	defer conn.Close()
+	_, err := redis.String(conn.Do("GET", "k"))
+	require.NoError(t, err)
+	rs = l.find("redicluster: pool created")
+	require.Len(t, rs, 1)
+	assert.Equal(t, addr, rs[0].attrs["addr"])
+	assert.Equal(t, "master", rs[0].attrs["role"])
+
+	assert.Error(t, cp.ReloadSlotMapping())
+	rs = l.find("redicluster: slot mapping reload failed")
+	require.Len(t, rs, 1)
+	assert.Equal(t, LogWarn, rs[0].level)
+	assert.EqualError(t, rs[0].attrs["err"].(error), "all nodes failed")
+
+	// the pipeline batch fails since the context is done
+	rc := conn.(*redirconn)
+	require.NoError(t, rc.Send("GET", "k"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rc.FlushContext(ctx)
+	_, err = rc.Receive()
+	assert.ErrorIs(t, err, context.Canceled)
+	rs = l.find("redicluster: pipeline batch failed")
+	require.Len(t, rs, 1)
+	assert.Equal(t, addr, rs[0].attrs["addr"])
+	assert.Equal(t, 1, rs[0].attrs["cmds"])
+
+	// the node leaves the cluster
+	other := "127.0.0.1:1"
+	cp.setSlots([]*slotInfo{{Start: 0, End: TotalSlots - 1, Nodes: []*NodeInfo{{Addr: other, Role: "master"}}, Addrs: []string{other}}})
+	rs = l.find("redicluster: topology changed")
+	require.Len(t, rs, 2)
+	assert.Equal(t, []string{other}, rs[1].attrs["added"])
+	assert.Equal(t, []string{addr}, rs[1].attrs["removed"])
+	assert.Empty(t, l.find("redicluster: pool removed"), "the entry address keeps its pool")
+
+	// debug records are dropped by the level
+	assert.Empty(t, l.find("redicluster: slot mapping reloaded"))
+	assert.Empty(t, l.find("redicluster: redirected"))
+}
+
+func TestLogCircuit(t *testing.T) {
+	l := &recordLogger{}
+	addr := "127.0.0.1:1"
+	cp := NewClusterPool([]string{addr}, WithLogger(l, LogDebug), WithDialTimeout(100*time.Millisecond))
+	defer cp.Close()
+	cp.CircuitFailures = 2
+
+	ns := cp.nodeState(addr)
+	ioErr := fmt.Errorf("read: connection reset")
+	cp.onResult(addr, ns, ioErr)
+	assert.Len(t, l.find("redicluster: node failure"), 1)
+	assert.Empty(t, l.find("redicluster: circuit opened"))
+	cp.onResult(addr, ns, ioErr)
+	rs := l.find("redicluster: circuit opened")
+	require.Len(t, rs, 1)
+	assert.Equal(t, LogError, rs[0].level)
+	assert.Equal(t, addr, rs[0].attrs["addr"])
+
+	cp.onResult(addr, ns, redis.Error("ERR wrong type"))
+	assert.Len(t, l.find("redicluster: node failure"), 2, "error replies are not node failures")
+	cp.onResult(addr, ns, nil)
+	rs = l.find("redicluster: circuit closed")
+	require.Len(t, rs, 1)
+	assert.Equal(t, LogInfo, rs[0].level)
+}
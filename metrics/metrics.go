@@ -0,0 +1,318 @@
+// Package metrics exports the statistics of a redicluster.ClusterPool in the Prometheus text exposition format,
+// without depending on the Prometheus client library.
+//
+//	cp := redicluster.NewClusterPool(addrs)
+//	http.Handle("/metrics", metrics.NewCollector(cp))
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rmker/redicluster"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the command latency histograms
+var DefaultBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Option configures the Collector
+type Option func(c *Collector)
+
+// WithNamespace sets the prefix of the metric names, "redicluster" by default
+func WithNamespace(ns string) Option {
+	return func(c *Collector) {
+		c.namespace = ns
+	}
+}
+
+// WithBuckets sets the upper bounds in seconds of the command latency histograms, in increasing order
+func WithBuckets(buckets ...float64) Option {
+	return func(c *Collector) {
+		c.buckets = buckets
+	}
+}
+
+// Collector reads the statistics of a ClusterPool, and serves them in the Prometheus text format as an
+// http.Handler. It's a redicluster.Hook as well, which records the latency of commands by command and node
+type Collector struct {
+	redicluster.NoopHook
+
+	cp        *redicluster.ClusterPool
+	namespace string
+	buckets   []float64
+
+	mu       sync.Mutex
+	commands map[commandKey]*histogram
+}
+
+type commandKey struct {
+	cmd  string
+	node string
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewCollector creates the Collector of the cluster pool, and appends it to the Hooks of the pool, so it should be
+// called before the pool is used
+func NewCollector(cp *redicluster.ClusterPool, opts ...Option) *Collector {
+	c := &Collector{
+		cp:        cp,
+		namespace: "redicluster",
+		buckets:   DefaultBuckets,
+		commands:  make(map[commandKey]*histogram),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	cp.Hooks = append(cp.Hooks, c)
+	return c
+}
+
+// AfterCommand records the latency of the command
+func (c *Collector) AfterCommand(ctx context.Context, ci *redicluster.CommandInfo) {
+	c.observe(ci.Cmd, ci.Addr, ci.Duration)
+}
+
+// AfterPipeline records the latency of the pipeline batches as the command "PIPELINE"
+func (c *Collector) AfterPipeline(ctx context.Context, pi *redicluster.PipelineInfo) {
+	for _, bi := range pi.Batches {
+		c.observe("PIPELINE", bi.Addr, bi.Duration)
+	}
+}
+
+func (c *Collector) observe(cmd, node string, d time.Duration) {
+	key := commandKey{cmd: strings.ToUpper(cmd), node: node}
+	v := d.Seconds()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := c.commands[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(c.buckets))}
+		c.commands[key] = h
+	}
+	for i, ub := range c.buckets {
+		if v <= ub {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if _, err := c.WriteTo(&buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// WriteTo writes the metrics in the Prometheus text format to w
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	c.write(&writer{w: cw, ns: c.namespace})
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+func (c *Collector) write(w *writer) {
+	cs := c.cp.ClusterStats()
+	nodes := make([]string, 0, len(cs.Nodes))
+	for addr := range cs.Nodes {
+		nodes = append(nodes, addr)
+	}
+	sort.Strings(nodes)
+
+	perNode := func(name, typ, help string, value func(st redicluster.NodeStats) float64) {
+		w.family(name, typ, help)
+		for _, addr := range nodes {
+			w.sample(name, labels{"node", addr}, value(cs.Nodes[addr]))
+		}
+	}
+	perNode("pool_active_connections", "gauge", "Connections borrowed from or idle in the pool of the node.",
+		func(st redicluster.NodeStats) float64 { return float64(st.ActiveCount) })
+	perNode("pool_idle_connections", "gauge", "Idle connections in the pool of the node.",
+		func(st redicluster.NodeStats) float64 { return float64(st.IdleCount) })
+	perNode("commands_total", "counter", "Commands sent to the node.",
+		func(st redicluster.NodeStats) float64 { return float64(st.Commands) })
+	perNode("pipeline_batches_total", "counter", "Pipeline batches sent to the node.",
+		func(st redicluster.NodeStats) float64 { return float64(st.Batches) })
+	perNode("read_bytes_total", "counter", "Bytes read from the node.",
+		func(st redicluster.NodeStats) float64 { return float64(st.BytesIn) })
+	perNode("written_bytes_total", "counter", "Bytes written to the node.",
+		func(st redicluster.NodeStats) float64 { return float64(st.BytesOut) })
+
+	w.family("redirects_total", "counter", "MOVED and ASK redirects replied by the node.")
+	for _, addr := range nodes {
+		st := cs.Nodes[addr]
+		w.sample("redirects_total", labels{"node", addr, "kind", "moved"}, float64(st.Moved))
+		w.sample("redirects_total", labels{"node", addr, "kind", "ask"}, float64(st.Ask))
+	}
+
+	w.family("errors_total", "counter", "Failed commands and connections of the node by class.")
+	for _, addr := range nodes {
+		es := cs.Nodes[addr].Errors
+		for _, e := range []struct {
+			class string
+			n     int64
+		}{
+			{"reply", es.Reply}, {"io", es.IO}, {"timeout", es.Timeout}, {"canceled", es.Canceled},
+			{"auth", es.Auth}, {"dial", es.Dial}, {"circuit", es.Circuit},
+		} {
+			w.sample("errors_total", labels{"node", addr, "class", e.class}, float64(e.n))
+		}
+	}
+
+	w.family("circuit_state", "gauge", "State of the circuit breaker of the node, 1 for the current state.")
+	for _, addr := range nodes {
+		cur := cs.Nodes[addr].Circuit
+		for _, s := range []redicluster.CircuitState{redicluster.CircuitClosed, redicluster.CircuitOpen, redicluster.CircuitHalfOpen} {
+			v := 0.0
+			if s == cur {
+				v = 1
+			}
+			w.sample("circuit_state", labels{"node", addr, "state", s.String()}, v)
+		}
+	}
+
+	w.family("node_latency_seconds", "histogram", "Round-trip latency of the node.")
+	for _, addr := range nodes {
+		lat := cs.Nodes[addr].Latency
+		var cum uint64
+		// the last bucket holds the samples above its bound too, so they are only counted by +Inf
+		for i, b := range lat.Histogram {
+			if i == len(lat.Histogram)-1 {
+				break
+			}
+			cum += b.Count
+			w.sample("node_latency_seconds_bucket", labels{"node", addr, "le", formatFloat(b.UpperBound.Seconds())}, float64(cum))
+		}
+		w.sample("node_latency_seconds_bucket", labels{"node", addr, "le", "+Inf"}, float64(lat.Samples))
+		w.sample("node_latency_seconds_sum", labels{"node", addr}, lat.Sum.Seconds())
+		w.sample("node_latency_seconds_count", labels{"node", addr}, float64(lat.Samples))
+	}
+
+	c.writeCommands(w)
+
+	w.family("reloads_total", "counter", "Slot mapping reloads.")
+	w.sample("reloads_total", nil, float64(cs.Reloads))
+	w.family("reload_failures_total", "counter", "Failed slot mapping reloads.")
+	w.sample("reload_failures_total", nil, float64(cs.ReloadErrors))
+	w.family("last_reload_timestamp_seconds", "gauge", "Unix time the last slot mapping reload finished.")
+	last := 0.0
+	if !cs.LastReload.IsZero() {
+		last = float64(cs.LastReload.UnixNano()) / 1e9
+	}
+	w.sample("last_reload_timestamp_seconds", nil, last)
+}
+
+func (c *Collector) writeCommands(w *writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]commandKey, 0, len(c.commands))
+	for k := range c.commands {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].cmd != keys[j].cmd {
+			return keys[i].cmd < keys[j].cmd
+		}
+		return keys[i].node < keys[j].node
+	})
+	w.family("command_duration_seconds", "histogram", "Latency of the commands by command and node, including redirects.")
+	for _, k := range keys {
+		h := c.commands[k]
+		for i, ub := range c.buckets {
+			w.sample("command_duration_seconds_bucket", labels{"command", k.cmd, "node", k.node, "le", formatFloat(ub)}, float64(h.counts[i]))
+		}
+		w.sample("command_duration_seconds_bucket", labels{"command", k.cmd, "node", k.node, "le", "+Inf"}, float64(h.count))
+		w.sample("command_duration_seconds_sum", labels{"command", k.cmd, "node", k.node}, h.sum)
+		w.sample("command_duration_seconds_count", labels{"command", k.cmd, "node", k.node}, float64(h.count))
+	}
+}
+
+// labels are the label names and values in pairs
+type labels []string
+
+type writer struct {
+	w  io.Writer
+	ns string
+}
+
+func (w *writer) name(name string) string {
+	if len(w.ns) == 0 {
+		return name
+	}
+	return w.ns + "_" + name
+}
+
+func (w *writer) family(name, typ, help string) {
+	fmt.Fprintf(w.w, "# HELP %s %s\n# TYPE %s %s\n", w.name(name), help, w.name(name), typ)
+}
+
+func (w *writer) sample(name string, ls labels, v float64) {
+	var sb strings.Builder
+	sb.WriteString(w.name(name))
+	if len(ls) > 0 {
+		sb.WriteByte('{')
+		for i := 0; i+1 < len(ls); i += 2 {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(ls[i])
+			sb.WriteString(`="`)
+			sb.WriteString(escapeLabel(ls[i+1]))
+			sb.WriteByte('"')
+		}
+		sb.WriteByte('}')
+	}
+	sb.WriteByte(' ')
+	sb.WriteString(formatFloat(v))
+	sb.WriteByte('\n')
+	io.WriteString(w.w, sb.String())
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// countWriter counts the written bytes and keeps the first error
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
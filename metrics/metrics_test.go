@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rmker/redicluster"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollector(t *testing.T) {
+	cp := redicluster.NewClusterPool([]string{"127.0.0.1:1"}, redicluster.WithDialTimeout(100*time.Millisecond))
+	defer cp.Close()
+	c := NewCollector(cp, WithBuckets(0.001, 0.01))
+	require.Len(t, cp.Hooks, 1)
+
+	// the reload fails, and the dial error is counted for the entry node
+	assert.Error(t, cp.ReloadSlotMapping())
+	ctx := context.Background()
+	c.AfterCommand(ctx, &redicluster.CommandInfo{Cmd: "get", Addr: "10.0.0.1:6379", Duration: 5 * time.Millisecond})
+	c.AfterCommand(ctx, &redicluster.CommandInfo{Cmd: "GET", Addr: "10.0.0.1:6379", Duration: 20 * time.Millisecond})
+	c.AfterPipeline(ctx, &redicluster.PipelineInfo{Batches: []redicluster.BatchInfo{{Addr: "10.0.0.2:6379", Duration: time.Millisecond / 2}}})
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	text := string(body)
+
+	// the last internal bucket holds the overflow, so it's only exported as +Inf
+	assert.Contains(t, text, `redicluster_node_latency_seconds_bucket{node="127.0.0.1:1",le="10.48576"} 0`+"\n")
+	assert.NotContains(t, text, `le="20.97152"`)
+	for _, line := range []string{
+		"# TYPE redicluster_command_duration_seconds histogram",
+		`redicluster_command_duration_seconds_bucket{command="GET",node="10.0.0.1:6379",le="0.01"} 1`,
+		`redicluster_command_duration_seconds_bucket{command="GET",node="10.0.0.1:6379",le="+Inf"} 2`,
+		`redicluster_command_duration_seconds_sum{command="GET",node="10.0.0.1:6379"} 0.025`,
+		`redicluster_command_duration_seconds_count{command="GET",node="10.0.0.1:6379"} 2`,
+		`redicluster_command_duration_seconds_bucket{command="PIPELINE",node="10.0.0.2:6379",le="0.001"} 1`,
+		`redicluster_errors_total{node="127.0.0.1:1",class="dial"} 1`,
+		`redicluster_circuit_state{node="127.0.0.1:1",state="closed"} 1`,
+		`redicluster_redirects_total{node="127.0.0.1:1",kind="moved"} 0`,
+		`redicluster_node_latency_seconds_count{node="127.0.0.1:1"} 0`,
+		"redicluster_reloads_total 1",
+		"redicluster_reload_failures_total 1",
+	} {
+		assert.Contains(t, text, line+"\n")
+	}
+
+	// every sample line is a name, optional labels and a value
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		assert.Regexp(t, `^[a-z_]+(\{.*\})? [-+0-9.eInf]+$`, line)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	cp := &redicluster.ClusterPool{}
+	c := NewCollector(cp, WithNamespace("cache"))
+	var sb strings.Builder
+	n, err := c.WriteTo(&sb)
+	require.NoError(t, err)
+	assert.Equal(t, int64(sb.Len()), n)
+	assert.Contains(t, sb.String(), "cache_reloads_total 0\n")
+	assert.Equal(t, `a\"b\\c\nd`, escapeLabel("a\"b\\c\nd"))
+}
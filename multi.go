@@ -32,7 +32,7 @@ func multiset(ctx context.Context, c *redirconn, args ...interface{}) (interface
 		}
 	}
 
-	pipeLiner := newPipeliner(c.cp)
+	pipeLiner := newPipeliner(c)
 	defer pipeLiner.close()
 	for slot := range cmdMap {
 		err := pipeLiner.send("MSET", cmdMap[slot]...)
@@ -41,9 +41,11 @@ func multiset(ctx context.Context, c *redirconn, args ...interface{}) (interface
 		}
 		orderSlots = append(orderSlots, slot)
 	}
-	err := pipeLiner.flush(ctx)
-	if err != nil {
-		return nil, err
+	// the replies are still available if the writes are not acknowledged enough by the durable conn. The command
+	// hooks are called around MSET, so the pipeline hooks are not
+	ackErr := pipeLiner.doFlush(ctx)
+	if _, ok := ackErr.(*AckError); ackErr != nil && !ok {
+		return nil, ackErr
 	}
 	for range orderSlots {
 		reply, err := pipeLiner.receive()
@@ -52,7 +54,7 @@ func multiset(ctx context.Context, c *redirconn, args ...interface{}) (interface
 		}
 		res = reply
 	}
-	return res, nil
+	return res, ackErr
 }
 
 // Supports MGET command for redis cluster through pipeLiner
@@ -77,7 +79,7 @@ func multiget(ctx context.Context, c *redirconn, args ...interface{}) (interface
 			cmdMap[slot] = append(cmdMap[slot], key)
 		}
 	}
-	pipeLiner := newPipeliner(c.cp)
+	pipeLiner := newPipeliner(c)
 	defer pipeLiner.close()
 	for slot := range cmdMap {
 		err := pipeLiner.send("MGET", cmdMap[slot]...)
@@ -86,7 +88,8 @@ func multiget(ctx context.Context, c *redirconn, args ...interface{}) (interface
 		}
 		orderSlots = append(orderSlots, slot)
 	}
-	err := pipeLiner.flush(ctx)
+	// the command hooks are called around MGET, so the pipeline hooks are not
+	err := pipeLiner.doFlush(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,166 @@
+package redicluster
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// nodeState holds the runtime state of a node, which is kept across topology reloads
+type nodeState struct {
+	latency  latencyTracker
+	repl     replState
+	breaker  circuitBreaker
+	counters nodeCounters
+}
+
+// nodeConn wraps the redis.Conn of a node to record the round-trip time and result of every request
+type nodeConn struct {
+	redis.Conn
+	cp   *ClusterPool
+	ns   *nodeState
+	addr string
+
+	// flushAt is the time of the last Flush, the first Receive after it completes a round trip
+	flushAt time.Time
+
+	// blocking is set if a blocking command is sent since the last round trip, subscribed is set once the
+	// connection subscribes. The round-trip time of both is not the latency of the node, see isBlockingCommand
+	blocking   bool
+	subscribed bool
+}
+
+func (cp *ClusterPool) wrapNodeConn(ns *nodeState, addr string, conn redis.Conn) (redis.Conn, error) {
+	nc := &nodeConn{Conn: conn, cp: cp, ns: ns, addr: addr}
+	if err := cp.borrow(nc); err != nil {
+		cp.releaseBudget(addr)
+		return nil, err
+	}
+	return nc, nil
+}
+
+// Close returns the connection to the pool
+func (nc *nodeConn) Close() error {
+	nc.cp.giveBack(nc)
+	return nc.Conn.Close()
+}
+
+// observe records the result of a round trip, and its time as the latency unless it's blocking
+func (nc *nodeConn) observe(start time.Time, err error, blocking bool) {
+	// a redis.Error is a valid reply, other errors (I/O, timeout) don't indicate the round-trip time
+	var re redis.Error
+	if !blocking && (err == nil || errors.As(err, &re)) {
+		nc.ns.latency.observe(time.Since(start))
+	}
+	nc.cp.onResult(nc.addr, nc.ns, err)
+}
+
+func (nc *nodeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if len(cmd) == 0 {
+		// Do("") flushes the pending commands and receives all replies
+		return nc.Conn.Do(cmd, args...)
+	}
+	start := time.Now()
+	nc.ns.counters.commands.Add(1)
+	reply, err := nc.Conn.Do(cmd, args...)
+	err = authErr(nc.addr, err)
+	nc.ns.counters.result(err)
+	nc.observe(start, err, nc.blockingDo(cmd, args))
+	return reply, err
+}
+
+func (nc *nodeConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := connDoContext(nc.Conn, ctx, cmd, args...)
+	err = authErr(nc.addr, err)
+	if len(cmd) > 0 {
+		nc.ns.counters.commands.Add(1)
+		nc.ns.counters.result(err)
+		nc.observe(start, err, nc.blockingDo(cmd, args))
+	}
+	return reply, err
+}
+
+func (nc *nodeConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := connDoWithTimeout(nc.Conn, timeout, cmd, args...)
+	err = authErr(nc.addr, err)
+	if len(cmd) > 0 {
+		nc.ns.counters.commands.Add(1)
+		nc.ns.counters.result(err)
+		nc.observe(start, err, nc.blockingDo(cmd, args))
+	}
+	return reply, err
+}
+
+func (nc *nodeConn) Send(cmd string, args ...interface{}) error {
+	err := nc.Conn.Send(cmd, args...)
+	if err == nil {
+		nc.ns.counters.commands.Add(1)
+		nc.blocking = nc.blocking || isBlockingCommand(cmd, args)
+		nc.subscribed = nc.subscribed || isSubscribeCommand(cmd)
+	}
+	return err
+}
+
+// blockingDo reports if the round trip of Do with the command is blocking, the pending commands sent before are
+// part of it
+func (nc *nodeConn) blockingDo(cmd string, args []interface{}) bool {
+	blocking := nc.blocking || nc.subscribed || isBlockingCommand(cmd, args)
+	nc.blocking = false
+	nc.subscribed = nc.subscribed || isSubscribeCommand(cmd)
+	return blocking
+}
+
+func (nc *nodeConn) Flush() error {
+	err := nc.Conn.Flush()
+	if err == nil {
+		nc.flushAt = time.Now()
+	}
+	return err
+}
+
+func (nc *nodeConn) received(err error) {
+	nc.ns.counters.result(err)
+	if !nc.flushAt.IsZero() {
+		nc.observe(nc.flushAt, err, nc.blocking || nc.subscribed)
+		nc.flushAt = time.Time{}
+		nc.blocking = false
+	}
+}
+
+func (nc *nodeConn) Receive() (interface{}, error) {
+	reply, err := nc.Conn.Receive()
+	err = authErr(nc.addr, err)
+	nc.received(err)
+	return reply, err
+}
+
+func (nc *nodeConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	reply, err := connReceiveWithContext(nc.Conn, ctx)
+	err = authErr(nc.addr, err)
+	nc.received(err)
+	return reply, err
+}
+
+func (nc *nodeConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	reply, err := connReceiveWithTimeout(nc.Conn, timeout)
+	err = authErr(nc.addr, err)
+	nc.received(err)
+	return reply, err
+}
+
+// ping sends a PING to the node address with timeout
+func (cp *ClusterPool) ping(addr string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := cp.getRedisConnByAddrContext(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = connDoContext(conn, ctx, "PING")
+	return err
+}
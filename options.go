@@ -0,0 +1,262 @@
+package redicluster
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Option configures the ClusterPool created by NewClusterPool
+type Option interface {
+	apply(cp *ClusterPool)
+}
+
+type optionFunc func(cp *ClusterPool)
+
+func (f optionFunc) apply(cp *ClusterPool) {
+	f(cp)
+}
+
+// PoolOption is an Option configuring the managed per-node pools, which can be applied to the masters or replicas
+// only by ForMasters or ForReplicas
+type PoolOption interface {
+	Option
+	applyPool(pc *poolConfig)
+}
+
+type poolOptionFunc func(pc *poolConfig)
+
+func (f poolOptionFunc) apply(cp *ClusterPool) {
+	cp.poolOpts = append(cp.poolOpts, f)
+}
+
+func (f poolOptionFunc) applyPool(pc *poolConfig) {
+	f(pc)
+}
+
+// ForMasters applies the pool options to the pools of masters only, they take precedence over the ones for all nodes
+func ForMasters(opts ...PoolOption) Option {
+	return optionFunc(func(cp *ClusterPool) {
+		cp.masterPoolOpts = append(cp.masterPoolOpts, opts...)
+	})
+}
+
+// ForReplicas applies the pool options to the pools of replicas only, they take precedence over the ones for all nodes
+func ForReplicas(opts ...PoolOption) Option {
+	return optionFunc(func(cp *ClusterPool) {
+		cp.replicaPoolOpts = append(cp.replicaPoolOpts, opts...)
+	})
+}
+
+// WithPrewarm establishes n connections to every master, and every replica if replicas is true, after the slot
+// mapping is loaded. See ClusterPool.WaitReady
+func WithPrewarm(n int, replicas bool) Option {
+	return optionFunc(func(cp *ClusterPool) {
+		cp.PrewarmConns = n
+		cp.PrewarmReplicas = replicas
+	})
+}
+
+// WithConnBudget bounds the connections borrowed from all nodes by maxTotal, and reserves minPerNode connections
+// for every node. See ClusterPool.MaxTotalActive
+func WithConnBudget(maxTotal, minPerNode int) Option {
+	return optionFunc(func(cp *ClusterPool) {
+		cp.MaxTotalActive = maxTotal
+		cp.MinActivePerNode = minPerNode
+	})
+}
+
+// poolConfig is the config of the managed per-node pools
+type poolConfig struct {
+	maxIdle      int
+	maxActive    int
+	wait         bool
+	idleTimeout  time.Duration
+	dialTimeout  time.Duration
+	keepAlive    time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	healthCheck  time.Duration
+	dialOptions  []redis.DialOption
+}
+
+func defaultPoolConfig() poolConfig {
+	return poolConfig{
+		maxIdle:      10,
+		maxActive:    10,
+		idleTimeout:  10 * time.Minute,
+		dialTimeout:  3 * time.Second,
+		keepAlive:    5 * time.Minute,
+		readTimeout:  3 * time.Second,
+		writeTimeout: 3 * time.Second,
+		healthCheck:  time.Minute,
+	}
+}
+
+// NewClusterPool creates a ClusterPool with the entry addresses, which manages a redis.Pool for every node configured
+// by the options. The defaults are 10 max idle and active connections per node, 10 minutes idle timeout, 3 seconds
+// dial/read/write timeouts and a PING on borrowing the connections idle for more than 1 minute.
+// The slot mapping is loaded on the first request, or call ReloadSlotMapping to load it in advance.
+func NewClusterPool(entryAddrs []string, opts ...Option) *ClusterPool {
+	cp := &ClusterPool{
+		EntryAddrs: entryAddrs,
+	}
+	for _, opt := range opts {
+		opt.apply(cp)
+	}
+	cp.poolCfg = buildPoolConfig(cp.poolOpts, cp.masterPoolOpts)
+	cp.replicaPoolCfg = buildPoolConfig(cp.poolOpts, cp.replicaPoolOpts)
+	cp.CreateNodePool = cp.createManagedPool
+	return cp
+}
+
+func buildPoolConfig(common []PoolOption, role []PoolOption) poolConfig {
+	pc := defaultPoolConfig()
+	for _, opt := range common {
+		opt.applyPool(&pc)
+	}
+	for _, opt := range role {
+		opt.applyPool(&pc)
+	}
+	return pc
+}
+
+// WithMaxIdle sets the maximum number of idle connections per node
+func WithMaxIdle(n int) PoolOption {
+	return poolOptionFunc(func(pc *poolConfig) {
+		pc.maxIdle = n
+	})
+}
+
+// WithMaxActive sets the maximum number of connections per node, zero means no limit
+func WithMaxActive(n int) PoolOption {
+	return poolOptionFunc(func(pc *poolConfig) {
+		pc.maxActive = n
+	})
+}
+
+// WithWait makes borrowing wait for a connection returned if the node reaches the max active limit, otherwise
+// redis.ErrPoolExhausted is returned
+func WithWait(wait bool) PoolOption {
+	return poolOptionFunc(func(pc *poolConfig) {
+		pc.wait = wait
+	})
+}
+
+// WithIdleTimeout closes the connections idle for more than d, zero means never
+func WithIdleTimeout(d time.Duration) PoolOption {
+	return poolOptionFunc(func(pc *poolConfig) {
+		pc.idleTimeout = d
+	})
+}
+
+// WithDialTimeout sets the timeout for connecting to nodes
+func WithDialTimeout(d time.Duration) PoolOption {
+	return poolOptionFunc(func(pc *poolConfig) {
+		pc.dialTimeout = d
+	})
+}
+
+// WithDialKeepAlive sets the keep-alive period of the TCP connections to nodes, zero disables keep-alives
+func WithDialKeepAlive(d time.Duration) PoolOption {
+	return poolOptionFunc(func(pc *poolConfig) {
+		pc.keepAlive = d
+	})
+}
+
+// WithReadTimeout sets the timeout for reading a reply
+func WithReadTimeout(d time.Duration) PoolOption {
+	return poolOptionFunc(func(pc *poolConfig) {
+		pc.readTimeout = d
+	})
+}
+
+// WithWriteTimeout sets the timeout for writing a command
+func WithWriteTimeout(d time.Duration) PoolOption {
+	return poolOptionFunc(func(pc *poolConfig) {
+		pc.writeTimeout = d
+	})
+}
+
+// WithHealthCheck PINGs the connections idle for more than d on borrowing, zero PINGs on every borrowing and
+// negative disables the check
+func WithHealthCheck(d time.Duration) PoolOption {
+	return poolOptionFunc(func(pc *poolConfig) {
+		pc.healthCheck = d
+	})
+}
+
+// WithDialOptions appends the redis.DialOption for connecting to nodes, e.g. redis.DialPassword. Use WithDialTimeout
+// and WithDialKeepAlive instead of redis.DialConnectTimeout and redis.DialKeepAlive, which have no effect
+func WithDialOptions(opts ...redis.DialOption) PoolOption {
+	return poolOptionFunc(func(pc *poolConfig) {
+		pc.dialOptions = append(pc.dialOptions, opts...)
+	})
+}
+
+// dialer returns the dialer connecting to nodes
+func (pc *poolConfig) dialer() *net.Dialer {
+	return &net.Dialer{Timeout: pc.dialTimeout, KeepAlive: pc.keepAlive}
+}
+
+func (pc *poolConfig) redisDialOptions() []redis.DialOption {
+	opts := []redis.DialOption{
+		redis.DialReadTimeout(pc.readTimeout),
+		redis.DialWriteTimeout(pc.writeTimeout),
+	}
+	return append(opts, pc.dialOptions...)
+}
+
+// createManagedPool creates the redis.Pool of the node by the config of its role, it's the CreateNodePool of
+// NewClusterPool. The connections to replicas are set READONLY, so they can serve the replica reads
+func (cp *ClusterPool) createManagedPool(ctx context.Context, node NodeInfo) (*redis.Pool, error) {
+	pc := cp.poolCfg
+	if node.Role == "replica" {
+		pc = cp.replicaPoolCfg
+	}
+	addr := node.Addr
+	dialer, dialOpts := pc.dialer(), pc.redisDialOptions()
+	p := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return cp.dialNode(context.Background(), addr, node.Role, dialer, dialOpts)
+		},
+		DialContext: func(ctx context.Context) (redis.Conn, error) {
+			return cp.dialNode(ctx, addr, node.Role, dialer, dialOpts)
+		},
+		MaxIdle:     pc.maxIdle,
+		MaxActive:   pc.maxActive,
+		Wait:        pc.wait,
+		IdleTimeout: pc.idleTimeout,
+	}
+	if pc.healthCheck >= 0 || cp.Credentials != nil {
+		p.TestOnBorrow = func(c redis.Conn, t time.Time) error {
+			if err := cp.reauthenticate(c); err != nil {
+				return err
+			}
+			if pc.healthCheck < 0 || time.Since(t) < pc.healthCheck {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		}
+	}
+	return p, nil
+}
+
+// dialNode connects to the node, authenticates it by Credentials, and sets the connection READONLY for replicas
+func (cp *ClusterPool) dialNode(ctx context.Context, addr string, role string, dialer *net.Dialer,
+	dialOpts []redis.DialOption) (redis.Conn, error) {
+	conn, err := cp.dial(ctx, addr, dialer, dialOpts)
+	if err != nil {
+		return nil, err
+	}
+	if role == "replica" {
+		if _, err := connDoContext(conn, ctx, "READONLY"); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return cp.injectFaults(addr, conn), nil
+}
@@ -0,0 +1,142 @@
+package redicluster
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewClusterPool(t *testing.T) {
+	cp := NewClusterPool([]string{"127.0.0.1:6379"},
+		WithMaxIdle(3),
+		WithMaxActive(20),
+		WithWait(true),
+		WithIdleTimeout(time.Minute),
+		WithHealthCheck(-1))
+	assert.Equal(t, []string{"127.0.0.1:6379"}, cp.EntryAddrs)
+	require.NotNil(t, cp.CreateNodePool)
+
+	p, err := cp.CreateNodePool(context.Background(), NodeInfo{Addr: "127.0.0.1:6379"})
+	require.NoError(t, err)
+	assert.Equal(t, 3, p.MaxIdle)
+	assert.Equal(t, 20, p.MaxActive)
+	assert.True(t, p.Wait)
+	assert.Equal(t, time.Minute, p.IdleTimeout)
+	assert.Nil(t, p.TestOnBorrow)
+
+	p, err = NewClusterPool(nil).CreateNodePool(context.Background(), NodeInfo{Addr: "127.0.0.1:6379"})
+	require.NoError(t, err)
+	assert.Equal(t, 10, p.MaxActive)
+	assert.NotNil(t, p.TestOnBorrow)
+}
+
+func TestPoolByRole(t *testing.T) {
+	cp := NewClusterPool(nil,
+		ForReplicas(WithMaxActive(50)),
+		WithMaxActive(5),
+		ForMasters(WithMaxIdle(1)))
+	p, err := cp.CreateNodePool(context.Background(), NodeInfo{Addr: "10.0.0.1:6379", Role: "master"})
+	require.NoError(t, err)
+	assert.Equal(t, 5, p.MaxActive)
+	assert.Equal(t, 1, p.MaxIdle)
+	p, err = cp.CreateNodePool(context.Background(), NodeInfo{Addr: "10.0.0.2:6379", Role: "replica"})
+	require.NoError(t, err)
+	assert.Equal(t, 50, p.MaxActive)
+	assert.Equal(t, 10, p.MaxIdle)
+}
+
+func TestRebuildPoolOnRoleChange(t *testing.T) {
+	var created []NodeInfo
+	cp := &ClusterPool{
+		CreateNodePool: func(ctx context.Context, node NodeInfo) (*redis.Pool, error) {
+			created = append(created, node)
+			return &redis.Pool{Dial: func() (redis.Conn, error) { return nil, redis.ErrPoolExhausted }}, nil
+		},
+	}
+	// the pools of the entry nodes are created before the roles are known, only the replica is created again
+	cp.getRedisConnByAddrContext(context.Background(), "10.0.0.1:6379")
+	cp.getRedisConnByAddrContext(context.Background(), "10.0.0.2:6379")
+	require.Len(t, created, 2)
+	entry := cp.lookupPool("10.0.0.1:6379")
+	require.NoError(t, cp.updateShardMap(testShardsReply()))
+	assert.Same(t, entry, cp.lookupPool("10.0.0.1:6379"))
+	assert.Nil(t, cp.lookupPool("10.0.0.2:6379"))
+	created = nil
+	cp.getRedisConnByAddrContext(context.Background(), "10.0.0.2:6379")
+	require.Len(t, created, 1)
+	assert.Equal(t, "replica", created[0].Role)
+	assert.Equal(t, "m1", created[0].Shard)
+
+	// failover: 10.0.0.2 becomes the master
+	rep := []interface{}{
+		[]interface{}{
+			[]byte("slots"), []interface{}{int64(0), int64(16383)},
+			[]byte("nodes"), []interface{}{
+				shardNode("r1", "10.0.0.2", 6379, "master", "az-b"),
+				shardNode("m1", "10.0.0.1", 6379, "replica", "az-a"),
+			},
+		},
+	}
+	require.NoError(t, cp.updateShardMap(rep))
+	assert.Nil(t, cp.lookupPool("10.0.0.2:6379"))
+	cp.getRedisConnByAddrContext(context.Background(), "10.0.0.2:6379")
+	require.Len(t, created, 2)
+	assert.Equal(t, "master", created[1].Role)
+}
+
+func TestDialTimeout(t *testing.T) {
+	// the connect timeout expires before the local node accepts the connection
+	addr := newTestCluster(t).Addrs()[0]
+	cp := NewClusterPool([]string{addr}, WithDialTimeout(time.Nanosecond))
+	defer cp.Close()
+	p, err := cp.CreateNodePool(context.Background(), NodeInfo{Addr: addr})
+	require.NoError(t, err)
+	_, err = p.GetContext(context.Background())
+	var ne net.Error
+	require.ErrorAs(t, err, &ne)
+	assert.True(t, ne.Timeout())
+
+	// nobody answers at an unroutable address
+	cp = NewClusterPool([]string{"10.255.255.1:6379"}, WithDialTimeout(100*time.Millisecond))
+	defer cp.Close()
+	p, err = cp.CreateNodePool(context.Background(), NodeInfo{Addr: "10.255.255.1:6379"})
+	require.NoError(t, err)
+	start := time.Now()
+	c, err := p.GetContext(context.Background())
+	if err == nil {
+		c.Close()
+		t.Skip("the address is routable")
+	}
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestDialOptionsWithoutPool(t *testing.T) {
+	addr := newTestCluster(t).Addrs()[0]
+	cp := &ClusterPool{EntryAddrs: []string{addr}}
+	defer cp.Close()
+	_, err := cp.defaultDial(context.Background(), addr)
+	require.NoError(t, err)
+
+	// the connect timeout of the dial options is honored
+	cp.DialOptionsWithoutPool = []redis.DialOption{redis.DialConnectTimeout(time.Nanosecond)}
+	_, err = cp.defaultDial(context.Background(), addr)
+	var ne net.Error
+	require.ErrorAs(t, err, &ne)
+	assert.True(t, ne.Timeout())
+
+	// so is the dial function
+	dialed := false
+	cp.DialOptionsWithoutPool = []redis.DialOption{redis.DialNetDial(func(network, addr string) (net.Conn, error) {
+		dialed = true
+		return net.Dial(network, addr)
+	})}
+	c, err := cp.defaultDial(context.Background(), addr)
+	require.NoError(t, err)
+	c.Close()
+	assert.True(t, dialed)
+}
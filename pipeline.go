@@ -5,6 +5,7 @@ import (
 	"errors"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 )
@@ -26,12 +27,20 @@ type cmd struct {
 	ri          *RedirInfo
 }
 
+// asking reports if the command is redirected by ASK, which is sent after ASKING
+func (c *cmd) asking() bool {
+	return c.ri != nil && c.ri.Kind == "ASK"
+}
+
 // batch includes the commands corresponding a same redis node. A real redis pipeline will be run when a batch runs
 type batch struct {
 	addr string
 	conn redis.Conn
 	cmds []*cmd
 	err  error
+
+	// ackErr is the error of WAIT or WAITAOF after the writes in the batch
+	ackErr error
 }
 
 // pipeLiner is a struct that implements redis.Conn interface. It is used to handle pipeline command in a redis cluster
@@ -40,27 +49,51 @@ type pipeLiner struct {
 	cmds      []*cmd
 	forceDial bool
 	readOnly  bool
+	eligible  func(replica, master string) bool
+	session   *session
+	durable   *DurableOptions
 	flushed   bool
 	recvPos   int
 	batches   map[string]*batch
+
+	// batchInfos are the batches run by the flush for the hooks, nil if there is no hook
+	batchInfos []BatchInfo
 }
 
-func newPipeliner(cp *ClusterPool) *pipeLiner {
+func newPipeliner(c *redirconn) *pipeLiner {
 	return &pipeLiner{
-		cp:      cp,
-		recvPos: -1,
+		cp:       c.cp,
+		readOnly: c.readOnly,
+		eligible: c.eligible,
+		session:  c.session,
+		durable:  c.durable,
+		recvPos:  -1,
 	}
 }
 
+// onError records the error of the batch, and the commands fail with it since they get no reply
 func (bt *batch) onError(err error) {
 	if bt.err == nil {
 		bt.err = err
 	}
+	for _, cmd := range bt.cmds {
+		cmd.reply, cmd.reply_err = nil, err
+	}
 }
 
-// Run a batch that do the real redis pipeline request
+// Run a batch that do the real redis pipeline request. The conn is closed by the receiving if ctx is done, so
+// it will not be reused
 func (bt *batch) run(ctx context.Context, p *pipeLiner) error {
 	var err error
+	if p.cp.PipelineBatchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.cp.PipelineBatchTimeout)
+		defer cancel()
+	}
+	if err = ctx.Err(); err != nil {
+		bt.onError(err)
+		return err
+	}
 	if bt.conn == nil && len(bt.addr) > 0 {
 		bt.conn, err = p.cp.getRedisConnByAddrContext(ctx, bt.addr)
 		if err != nil {
@@ -71,19 +104,47 @@ func (bt *batch) run(ctx context.Context, p *pipeLiner) error {
 	if bt.conn == nil {
 		return errors.New("nil conn")
 	}
+	p.cp.nodeState(bt.addr).counters.batches.Add(1)
 	for _, cmd := range bt.cmds {
+		if cmd.asking() {
+			if err = bt.conn.Send("ASKING"); err != nil {
+				bt.onError(err)
+				return err
+			}
+		}
 		err = bt.conn.Send(cmd.commandName, cmd.args...)
 		if err != nil {
 			bt.onError(err)
 			return err
 		}
 	}
+	// wait the acknowledgements and query the master offset after the writes in the same pipeline
+	hasWrites := bt.hasWrites()
+	waitAcks := p.durable != nil && hasWrites
+	if waitAcks {
+		cmd, args := p.durable.command()
+		if err = bt.conn.Send(cmd, args...); err != nil {
+			bt.onError(err)
+			return err
+		}
+	}
+	recordWrites := p.session != nil && hasWrites
+	if recordWrites {
+		if err = bt.conn.Send("INFO", "replication"); err != nil {
+			bt.onError(err)
+			return err
+		}
+	}
 	err = bt.conn.Flush()
 	if err != nil {
 		bt.onError(err)
 		return err
 	}
 	for _, cmd := range bt.cmds {
+		if cmd.asking() {
+			// the reply of ASKING is OK, an I/O error fails the command as well
+			connReceiveWithContext(bt.conn, ctx)
+		}
 		cmd.reply, cmd.reply_err = connReceiveWithContext(bt.conn, ctx)
 		if cmd.reply_err != nil {
 			if ri := ParseRedirInfo(cmd.reply_err); ri != nil {
@@ -94,19 +155,41 @@ func (bt *batch) run(ctx context.Context, p *pipeLiner) error {
 			}
 		}
 	}
+	bt.ackErr = nil
+	if waitAcks {
+		reply, err := connReceiveWithContext(bt.conn, ctx)
+		bt.ackErr = p.durable.check(bt.addr, reply, err)
+	}
+	if recordWrites {
+		info, err := connReceiveWithContext(bt.conn, ctx)
+		p.session.record(bt.addr, info, err)
+	}
 	return nil
 }
 
+// hasWrites reports if there is any command modifying the dataset in the batch. The writes of a transaction
+// count only if the transaction is executed in the batch, nothing can be sent after the queued commands
+func (bt *batch) hasWrites() bool {
+	var ts txState
+	writes := false
+	for _, cmd := range bt.cmds {
+		if ts.wrote(cmd.commandName) {
+			writes = true
+		}
+	}
+	return writes && !ts.multi
+}
+
 // Build the batches into the batches map
 func (p *pipeLiner) buildBatches() error {
 	slots := make([]int, len(p.cmds))
 	for i, cmd := range p.cmds {
 		if cmd != nil {
-			cmd.slot = CmdSlot(cmd.commandName, cmd.args)
+			cmd.slot = CmdSlot(cmd.commandName, cmd.args...)
 			slots[i] = cmd.slot
 		}
 	}
-	addrs, err := p.cp.GetAddrsBySlots(slots, p.readOnly)
+	addrs, err := p.getAddrs(slots)
 	if err != nil {
 		return err
 	}
@@ -131,8 +214,25 @@ func (p *pipeLiner) buildBatches() error {
 	return nil
 }
 
+// getAddrs returns the node addresses of the commands slots. For the session, only the read commands are
+// sent to replicas
+func (p *pipeLiner) getAddrs(slots []int) ([]string, error) {
+	if p.session == nil {
+		return p.cp.getAddrsBySlots(slots, p.readOnly, p.eligible)
+	}
+	addrs := make([]string, len(slots))
+	for i, sl := range slots {
+		as, err := p.cp.getAddrsBySlots([]int{sl}, isReadOnlyCommand(p.cmds[i].commandName), p.eligible)
+		if err != nil {
+			return nil, err
+		}
+		addrs[i] = as[0]
+	}
+	return addrs, nil
+}
+
 // build the redirect batches to handling MOVED error
-func (p *pipeLiner) buildRedirectBatches() int {
+func (p *pipeLiner) buildRedirectBatches(ctx context.Context) int {
 	// clear all batches commands
 	for _, bt := range p.batches {
 		bt.cmds = nil
@@ -144,6 +244,7 @@ func (p *pipeLiner) buildRedirectBatches() int {
 			if !reload && p.cp.onRedir(cmd.ri) {
 				reload = true
 			}
+			p.cp.hookRedirect(ctx, cmd.ri, cmd.addr)
 			addr := cmd.ri.Addr
 			bt, exist := p.batches[addr]
 			if !exist || bt == nil {
@@ -160,31 +261,51 @@ func (p *pipeLiner) buildRedirectBatches() int {
 }
 
 func (p *pipeLiner) doRedirect(ctx context.Context) {
-	redir_count := p.buildRedirectBatches()
+	redir_count := p.buildRedirectBatches(ctx)
 	if redir_count > 0 {
-		p.runBatches(ctx)
+		p.runBatches(ctx, true)
 	}
 }
 
-// run all the batches in goroutines, and wait them returning
-func (p *pipeLiner) runBatches(ctx context.Context) {
+// run all the batches in goroutines, and wait them returning. redirect indicates the batches send the redirected
+// commands
+func (p *pipeLiner) runBatches(ctx context.Context, redirect bool) {
 	if len(p.batches) <= 0 {
 		return
 	}
-	var wg sync.WaitGroup
+	var bts []*batch
 	for _, bt := range p.batches {
 		if bt != nil && len(bt.cmds) > 0 {
-			wg.Add(1)
-			go func(b *batch) {
-				defer wg.Done()
-				err := b.run(ctx, p)
-				if err != nil {
-					return
-				}
-			}(bt)
+			bts = append(bts, bt)
 		}
 	}
+	hooked := len(p.cp.Hooks) > 0
+	infos := make([]BatchInfo, len(bts))
+	var wg sync.WaitGroup
+	for i, bt := range bts {
+		infos[i] = BatchInfo{Addr: bt.addr, Cmds: len(bt.cmds), Redirect: redirect}
+		wg.Add(1)
+		go func(b *batch, info *BatchInfo) {
+			defer wg.Done()
+			start := time.Now()
+			info.Err = b.run(ctx, p)
+			info.Duration = time.Since(start)
+			if p.cp.MaxTotalActive > 0 {
+				// the replies are received, return the conn so the other batches waiting for the budget can go on
+				b.closeConn()
+			}
+		}(bt, &infos[i])
+	}
 	wg.Wait()
+	for i := range infos {
+		if infos[i].Err != nil {
+			p.cp.log(LogWarn, "redicluster: pipeline batch failed", "addr", infos[i].Addr, "cmds", infos[i].Cmds,
+				"redirect", redirect, "err", infos[i].Err)
+		}
+	}
+	if hooked {
+		p.batchInfos = append(p.batchInfos, infos...)
+	}
 }
 
 // Just append the command in the p.cmds
@@ -205,17 +326,66 @@ func (p *pipeLiner) close() error {
 // All replies will be stored in every cmd struct once all requests respond.
 // The redirection will be handled if there is any MOVED error returned.
 func (p *pipeLiner) flush(ctx context.Context) error {
-	var err error
 	if p.flushed || len(p.cmds) == 0 {
 		return nil
 	}
-	err = p.buildBatches()
+	if len(p.cp.Hooks) == 0 {
+		return p.doFlush(ctx)
+	}
+
+	pi := &PipelineInfo{Cmds: make([]*CommandInfo, len(p.cmds))}
+	for i, cmd := range p.cmds {
+		pi.Cmds[i] = &CommandInfo{Cmd: cmd.commandName, Args: cmd.args, Slot: CmdSlot(cmd.commandName, cmd.args...)}
+	}
+	flushed := false
+	p.batchInfos = nil
+	p.cp.hookPipeline(ctx, pi, func(ctx context.Context, pi *PipelineInfo) {
+		flushed = true
+		pi.Err = p.doFlush(ctx)
+		pi.Batches = p.batchInfos
+		for i, cmd := range p.cmds {
+			ci := pi.Cmds[i]
+			ci.Addr, ci.Reply, ci.Err = cmd.addr, cmd.reply, cmd.reply_err
+			if cmd.ri != nil {
+				ci.Addr = cmd.ri.Addr
+				ci.Redirects = 1
+			}
+		}
+	})
+	p.batchInfos = nil
+	if !flushed {
+		// short-circuited by the hooks
+		for i, cmd := range p.cmds {
+			cmd.reply, cmd.reply_err = pi.Cmds[i].Reply, pi.Cmds[i].Err
+		}
+		p.flushed = true
+	}
+	return pi.Err
+}
+
+// doFlush runs the batches of the commands and redirects
+func (p *pipeLiner) doFlush(ctx context.Context) error {
+	err := p.buildBatches()
 	if err != nil {
 		return err
 	}
-	p.runBatches(ctx)
+	p.runBatches(ctx, false)
+	ackErr := p.ackErr()
 	p.doRedirect(ctx)
 	p.flushed = true
+	if ackErr == nil {
+		ackErr = p.ackErr()
+	}
+	return ackErr
+}
+
+// ackErr returns the first acknowledgement error of the batches
+func (p *pipeLiner) ackErr() error {
+	for _, bt := range p.batches {
+		if bt.ackErr != nil {
+			return bt.ackErr
+		}
+	}
 	return nil
 }
 
@@ -249,13 +419,19 @@ func (p *pipeLiner) reset() {
 	p.flushed = false
 	p.recvPos = -1
 	for k, bt := range p.batches {
-		if bt.conn != nil {
-			bt.conn.Close()
-		}
+		bt.closeConn()
 		delete(p.batches, k)
 	}
 }
 
+// closeConn returns the conn of the batch to the pool
+func (bt *batch) closeConn() {
+	if bt.conn != nil {
+		bt.conn.Close()
+		bt.conn = nil
+	}
+}
+
 func (p *pipeLiner) err() error {
 	var e []string
 	for _, bt := range p.batches {
@@ -0,0 +1,94 @@
+package redicluster
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Connection pre-warming. After the slot mapping is loaded, PrewarmConns connections are established to every node
+// in parallel and returned to the pools as idle connections.
+
+// WaitReady waits until the slot mapping is loaded and the pools are pre-warmed, the slot mapping is loaded if it's
+// not loaded yet. ErrPoolClosed is returned once the cluster pool is closed, since it will never be ready
+func (cp *ClusterPool) WaitReady(ctx context.Context) error {
+	if cp.closed.Load() {
+		return ErrPoolClosed
+	}
+	loaded := len(cp.topology().slots) > 0
+	cp.mu.Lock()
+	ready := cp.readyChan()
+	cp.mu.Unlock()
+	if !loaded {
+		if err := cp.ReloadSlotMappingContext(ctx); err != nil {
+			return err
+		}
+	}
+	select {
+	case <-ready:
+		if cp.closed.Load() {
+			return ErrPoolClosed
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// readyChan returns the channel closed when ready. cp.mu must be held by the caller
+func (cp *ClusterPool) readyChan() chan struct{} {
+	if cp.ready == nil {
+		cp.ready = make(chan struct{})
+	}
+	return cp.ready
+}
+
+func (cp *ClusterPool) setReady() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if !cp.readyClosed {
+		close(cp.readyChan())
+		cp.readyClosed = true
+	}
+}
+
+// prewarm establishes PrewarmConns connections to the nodes in parallel
+func (cp *ClusterPool) prewarm(ctx context.Context) {
+	defer cp.setReady()
+	if cp.PrewarmConns <= 0 || (cp.CreateConnPool == nil && cp.CreateNodePool == nil) {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, addr := range cp.getNodes(cp.PrewarmReplicas) {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			cp.prewarmNode(ctx, addr, cp.PrewarmConns)
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// prewarmNode borrows n connections of the node at the same time, so the pool dials the ones it lacks, then
+// returns them as idle connections
+func (cp *ClusterPool) prewarmNode(ctx context.Context, addr string, n int) {
+	conns := make([]redis.Conn, n)
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := cp.getRedisConnByAddr(ctx, addr)
+			if err == nil {
+				conns[i] = conn
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, conn := range conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
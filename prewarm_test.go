@@ -0,0 +1,74 @@
+package redicluster
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrewarm(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	var accepted int32
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				c.Close()
+			}
+		}()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conns = append(conns, c)
+		}
+	}()
+
+	addr := ln.Addr().String()
+	cp := NewClusterPool([]string{addr}, WithPrewarm(3, false), WithHealthCheck(-1))
+	cp.topo.Store(newTopology([]*slotInfo{{Start: 0, End: TotalSlots - 1, Nodes: []*NodeInfo{{Addr: addr, Role: "master"}}}}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, cp.WaitReady(ctx), context.DeadlineExceeded)
+
+	go cp.prewarm(context.Background())
+	require.NoError(t, cp.WaitReady(context.Background()))
+	assert.Equal(t, 3, cp.IdleCount())
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&accepted) == 3 }, time.Second, time.Millisecond)
+
+	// the idle connections are reused
+	cp.prewarmNode(context.Background(), addr, 2)
+	assert.Equal(t, 3, cp.IdleCount())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&accepted))
+}
+
+func TestWaitReadyClosed(t *testing.T) {
+	addr := "127.0.0.1:6379"
+	cp := NewClusterPool([]string{addr}, WithPrewarm(3, false))
+	cp.topo.Store(newTopology([]*slotInfo{{Start: 0, End: TotalSlots - 1, Nodes: []*NodeInfo{{Addr: addr, Role: "master"}}}}))
+
+	// the waiter is woken up by Close, the pre-warming never runs
+	errc := make(chan error, 1)
+	go func() {
+		errc <- cp.WaitReady(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cp.Close()
+	select {
+	case err := <-errc:
+		assert.ErrorIs(t, err, ErrPoolClosed)
+	case <-time.After(time.Second):
+		t.Fatal("WaitReady is not woken up by Close")
+	}
+	assert.ErrorIs(t, cp.WaitReady(context.Background()), ErrPoolClosed)
+}
@@ -3,6 +3,7 @@ package redicluster
 import (
 	"context"
 	"errors"
+	"net"
 	"strconv"
 	"strings"
 	"sync"
@@ -21,6 +22,9 @@ const (
 	OpPipeLine = 2
 )
 
+// maxCachedConns is the maximum count of node connections kept by a redirconn
+const maxCachedConns = 8
+
 type redirconn struct {
 
 	// cp is the pointer to the ClusterPool, immutable
@@ -32,20 +36,41 @@ type redirconn struct {
 	// if this is a read only conn, immutable
 	readOnly bool
 
+	// eligible filters the replicas for reading if it's not nil, immutable
+	eligible func(replica, master string) bool
+
+	// session tracks the writes for read-your-writes consistency if it's not nil, immutable
+	session *session
+
+	// durable waits the writes to be acknowledged if it's not nil, immutable
+	durable *DurableOptions
+
+	// ctx is the context of GetWithDefaultContext for the requests without context, like Do and Flush, immutable
+	ctx context.Context
+
 	// protect the following members
 	mu sync.Mutex
 
 	// ppl is the pipeLiner (specified by Send() API)
 	ppl *pipeLiner
 
-	// lastRc is the last redis.Conn used by Do() API
-	lastRc redis.Conn
+	// conns are the node connections borrowed by Do() API, addr -> conn. They are kept until Close, so the requests
+	// alternating between nodes don't return and borrow connections every time
+	conns map[string]redis.Conn
 
 	// lastAddr is the last node address used by Do() API
 	lastAddr string
 
 	// last operation
 	lastOp int
+
+	// tx tracks the transaction of Do() API, so the writes are acknowledged after EXEC instead of being queued
+	tx txState
+}
+
+// ConnWithFlushContext is implemented by the redis.Conn got from ClusterPool, which flushes the pipeline with context
+type ConnWithFlushContext interface {
+	FlushContext(ctx context.Context) error
 }
 
 type RedirInfo struct {
@@ -103,7 +128,20 @@ func connDoContext(conn redis.Conn, ctx context.Context, cmd string, args ...int
 	}
 	cwt, ok := conn.(redis.ConnWithContext)
 	if ok {
-		return cwt.DoContext(ctx, cmd, args...)
+		reply, err := cwt.DoContext(ctx, cmd, args...)
+		return reply, contextErr(ctx, err)
+	} else {
+		return conn.Do(cmd, args...)
+	}
+}
+
+func connDoWithTimeout(conn redis.Conn, timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	if conn == nil {
+		return nil, errors.New("invalid conn")
+	}
+	cwt, ok := conn.(redis.ConnWithTimeout)
+	if ok {
+		return cwt.DoWithTimeout(timeout, cmd, args...)
 	} else {
 		return conn.Do(cmd, args...)
 	}
@@ -115,12 +153,26 @@ func connReceiveWithContext(conn redis.Conn, ctx context.Context) (interface{},
 	}
 	cwt, ok := conn.(redis.ConnWithContext)
 	if ok {
-		return cwt.ReceiveContext(ctx)
+		reply, err := cwt.ReceiveContext(ctx)
+		return reply, contextErr(ctx, err)
 	} else {
 		return conn.Receive()
 	}
 }
 
+// contextErr returns context.DeadlineExceeded for the network timeout caused by the deadline of ctx, redigo sets
+// the read deadline of the connection by ctx, so it may fire before ctx is done
+func contextErr(ctx context.Context, err error) error {
+	var ne net.Error
+	if err == nil || !errors.As(err, &ne) || !ne.Timeout() {
+		return err
+	}
+	if dl, ok := ctx.Deadline(); ok && !time.Now().Before(dl) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
 func connReceiveWithTimeout(conn redis.Conn, timeout time.Duration) (interface{}, error) {
 	if conn == nil {
 		return nil, errors.New("invalid conn")
@@ -133,46 +185,60 @@ func connReceiveWithTimeout(conn redis.Conn, timeout time.Duration) (interface{}
 	}
 }
 
-// Close closes the connection.
+// Close closes the connection, and returns all node connections to the pools.
 func (c *redirconn) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	var err error
 	if c.ppl != nil {
-		return c.ppl.close()
-	}
-	if c.lastRc != nil {
-		c.lastRc.Close()
-		c.lastRc = nil
-		c.lastAddr = ""
+		err = c.ppl.close()
 	}
-	return nil
+	c.releaseConnsLocked()
+	c.lastAddr = ""
+	return err
 }
 
 // Err returns a non-nil value when the connection is not usable.
 func (c *redirconn) Err() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.lastOp == OpDO && c.lastRc != nil {
-		return c.lastRc.Err()
+	if c.lastOp == OpDO && c.conns[c.lastAddr] != nil {
+		return c.conns[c.lastAddr].Err()
 	} else if c.lastOp == OpPipeLine && c.ppl != nil {
 		return c.ppl.err()
 	}
 	return nil
 }
 
-// Do sends a command and return the reply with context.Background() by calling DoContext
+// defaultContext returns the context of GetWithDefaultContext, or context.Background()
+func (c *redirconn) defaultContext() context.Context {
+	if c.ctx != nil {
+		return c.ctx
+	}
+	return context.Background()
+}
+
+// Do sends a command and return the reply with the context of GetWithDefaultContext or context.Background() by calling DoContext
 func (c *redirconn) Do(cmd string, args ...interface{}) (reply interface{}, err error) {
-	return c.DoContext(context.Background(), cmd, args...)
+	return c.DoContext(c.defaultContext(), cmd, args...)
 }
 
 // DoWithTimeout sends a command and return the reply with timeout by calling DoContext
 func (c *redirconn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (reply interface{}, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(c.defaultContext(), timeout)
 	defer cancel()
 	return c.DoContext(ctx, cmd, args...)
 }
 
-func (c *redirconn) getConn(ctx context.Context, lastOp int, cmd string, args ...interface{}) (redis.Conn, error) {
+// readOnlyFor reports if the command can be sent to a replica, the commands of a transaction are sent to the master
+func (c *redirconn) readOnlyFor(cmd string) bool {
+	c.mu.Lock()
+	multi := c.tx.multi
+	c.mu.Unlock()
+	return c.readOnly && !multi && (c.session == nil || isReadOnlyCommand(cmd))
+}
+
+func (c *redirconn) getConn(ctx context.Context, lastOp int, cmd string, args ...interface{}) (redis.Conn, string, error) {
 	var addr string
 	slot := CmdSlot(cmd, args...)
 	if slot < 0 {
@@ -183,90 +249,196 @@ func (c *redirconn) getConn(ctx context.Context, lastOp int, cmd string, args ..
 	}
 
 	if len(addr) == 0 {
-		addrs, err := c.cp.GetAddrsBySlots([]int{slot}, c.readOnly)
+		addrs, err := c.cp.getAddrsBySlots([]int{slot}, c.readOnlyFor(cmd), c.eligible)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		if len(addrs) == 0 || len(addrs[0]) == 0 {
-			return nil, errors.New("empty node address")
+			return nil, "", errors.New("empty node address")
 		}
 		addr = addrs[0]
 	}
 
 	c.mu.Lock()
 	c.lastOp = lastOp
-	if addr != c.lastAddr || c.lastRc == nil {
-		conn, err := c.cp.getRedisConnByAddrContext(ctx, addr)
-		if conn == nil {
-			c.mu.Unlock()
-			return nil, errors.New("invalid conn")
-		}
-		if err != nil {
+	c.mu.Unlock()
+	conn, err := c.connFor(ctx, addr)
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, addr, nil
+}
+
+// connFor returns the cached connection of the node address, or borrows one if there is no usable one. c.mu is not
+// held while borrowing, which may wait for the budget. With MaxTotalActive set, the cached connections are returned
+// before borrowing, so a conn holds at most one connection of the budget and can't wait for itself
+func (c *redirconn) connFor(ctx context.Context, addr string) (redis.Conn, error) {
+	c.mu.Lock()
+	if conn := c.conns[addr]; conn != nil {
+		if conn.Err() == nil {
+			c.lastAddr = addr
 			c.mu.Unlock()
-			return nil, err
+			return conn, nil
 		}
-		c.lastAddr = addr
-		if c.lastRc != nil {
-			c.lastRc.Close()
-		}
-		c.lastRc = conn
+		conn.Close()
+		delete(c.conns, addr)
+	}
+	if c.cp.MaxTotalActive > 0 {
+		c.releaseConnsLocked()
 	}
-	conn := c.lastRc
 	c.mu.Unlock()
+
+	conn, err := c.cp.getRedisConnByAddrContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if conn == nil {
+		return nil, errors.New("invalid conn")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns == nil {
+		c.conns = make(map[string]redis.Conn)
+	}
+	if old := c.conns[addr]; old != nil {
+		old.Close()
+	}
+	// evict one of the others if the cache is full
+	if len(c.conns) >= maxCachedConns {
+		for a, rc := range c.conns {
+			if a != c.lastAddr && a != addr {
+				rc.Close()
+				delete(c.conns, a)
+				break
+			}
+		}
+	}
+	c.conns[addr] = conn
+	c.lastAddr = addr
 	return conn, nil
 }
 
+// evict returns the cached connection of the node address, e.g. the one redirected by MOVED, which is not READONLY
+// if the node has become a replica after failover
+func (c *redirconn) evict(addr string, conn redis.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns[addr] == conn {
+		delete(c.conns, addr)
+		conn.Close()
+	}
+}
+
+// releaseConnsLocked returns all the cached connections to the pools. c.mu must be held by the caller
+func (c *redirconn) releaseConnsLocked() {
+	for addr, conn := range c.conns {
+		conn.Close()
+		delete(c.conns, addr)
+	}
+}
+
 // DoContext sends a command to the server and returns the received reply.
 // Request will be sent to the node automatically that redirection error indicates if redir is true and redirecting occurs
 func (c *redirconn) DoContext(ctx context.Context, cmd string, args ...interface{}) (reply interface{}, err error) {
+	if err := c.cp.beginRequest(); err != nil {
+		return nil, err
+	}
+	defer c.cp.endRequest()
+	ci := &CommandInfo{Cmd: cmd, Args: args}
+	if len(c.cp.Hooks) == 0 {
+		c.do(ctx, ci)
+	} else {
+		ci.Slot = CmdSlot(cmd, args...)
+		c.cp.hookCommand(ctx, ci, c.do)
+	}
+	return ci.Reply, ci.Err
+}
+
+// do runs the command of ci, and sets the result and the target node to ci
+func (c *redirconn) do(ctx context.Context, ci *CommandInfo) {
+	cmd, args := ci.Cmd, ci.Args
+	c.mu.Lock()
+	wrote := c.tx.wrote(cmd)
+	c.mu.Unlock()
 	if repl, err, hooked := c.hookDo(ctx, cmd, args...); hooked {
-		return repl, err
+		ci.Reply, ci.Err = repl, err
+		return
 	}
-	conn, err := c.getConn(ctx, OpDO, cmd, args...)
+	conn, addr, err := c.getConn(ctx, OpDO, cmd, args...)
 	if err != nil {
-		return nil, err
+		ci.Err = err
+		return
 	}
+	ci.Addr = addr
 	repl, err1 := connDoContext(conn, ctx, cmd, args...)
 	if err1 != nil {
 		ri := ParseRedirInfo(err1)
 		if ri != nil {
 			c.cp.onRedir(ri)
-			conn, err := c.cp.getRedisConnByAddrContext(ctx, ri.Addr)
-			if conn != nil && err == nil {
+			c.cp.hookRedirect(ctx, ri, addr)
+			if ri.Kind == "MOVED" {
+				c.evict(addr, conn)
+			}
+			rc, err := c.connFor(ctx, ri.Addr)
+			if err == nil && ri.Kind == "ASK" {
+				// the importing node serves the command only if it's preceded by ASKING
+				_, err = connDoContext(rc, ctx, "ASKING")
+			}
+			if err == nil {
+				conn = rc
 				repl, err1 = connDoContext(conn, ctx, cmd, args...)
-				c.mu.Lock()
-				c.lastAddr = ri.Addr
-				c.lastRc = conn
-				c.mu.Unlock()
+				addr = ri.Addr
+				ci.Addr = addr
+				ci.Redirects++
 			}
 		}
 	}
-	reply = repl
-	err = err1
-	return
+	if err1 == nil && wrote && (c.session != nil || c.durable != nil) {
+		if c.durable != nil {
+			err1 = c.durable.wait(ctx, conn, addr)
+		}
+		if c.session != nil {
+			c.session.recordWrite(ctx, conn, addr)
+		}
+	}
+	ci.Reply, ci.Err = repl, err1
 }
 
 // Send writes the command to the pipeLiner
 func (c *redirconn) Send(cmd string, args ...interface{}) error {
 	c.mu.Lock()
 	if c.ppl == nil {
-		c.ppl = newPipeliner(c.cp)
+		c.ppl = newPipeliner(c)
 	}
 	c.lastOp = OpPipeLine
 	c.mu.Unlock()
 	return c.ppl.send(cmd, args...)
 }
 
-// Flush flushes the output buffer to the Redis server
+// Flush flushes the output buffer to the Redis server with the context of GetWithDefaultContext or context.Background()
 func (c *redirconn) Flush() error {
+	return c.FlushContext(c.defaultContext())
+}
+
+// FlushContext runs the pipeline with context, the batches of the pipeline are cancelled once ctx is done
+func (c *redirconn) FlushContext(ctx context.Context) error {
 	c.mu.Lock()
 	if c.ppl == nil {
 		c.mu.Unlock()
 		return nil
 	}
 	c.lastOp = OpPipeLine
+	if c.cp.MaxTotalActive > 0 {
+		// the batches borrow from the budget, the connections of Do() can't be held meanwhile
+		c.releaseConnsLocked()
+	}
 	c.mu.Unlock()
-	return c.ppl.flush(context.Background())
+	if err := c.cp.beginRequest(); err != nil {
+		return err
+	}
+	defer c.cp.endRequest()
+	return c.ppl.flush(ctx)
 }
 
 // Receive receives a single reply from the pipeLiner.
@@ -7,7 +7,9 @@ import (
 	"time"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/rmker/redicluster/clustertest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestPipeLine1(t *testing.T) {
@@ -114,3 +116,188 @@ func TestDoWithContext(t *testing.T) {
 	assert.NoError(t, err, "DoContext error")
 	t.Logf("get result:%s", rep)
 }
+
+func TestConnCache(t *testing.T) {
+	ln1, ln2 := listenLoopback(t), listenLoopback(t)
+	defer ln1.Close()
+	defer ln2.Close()
+	a1, a2 := ln1.Addr().String(), ln2.Addr().String()
+	cp := &ClusterPool{}
+	cp.setSlots([]*slotInfo{
+		{Start: 0, End: 8191, Nodes: []*NodeInfo{{Addr: a1, Role: "master"}}, Addrs: []string{a1}},
+		{Start: 8192, End: TotalSlots - 1, Nodes: []*NodeInfo{{Addr: a2, Role: "master"}}, Addrs: []string{a2}},
+	})
+	defer cp.Close()
+
+	// Slot("a") = 15495, Slot("b") = 3300
+	conn := cp.Get().(*redirconn)
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"a", "b"} {
+			_, addr, err := conn.getConn(context.Background(), OpDO, "GET", key)
+			assert.NoError(t, err)
+			if key == "a" {
+				assert.Equal(t, a2, addr)
+			} else {
+				assert.Equal(t, a1, addr)
+			}
+		}
+	}
+	cp.drainMu.Lock()
+	assert.Len(t, cp.borrowed, 2)
+	cp.drainMu.Unlock()
+
+	conn.Close()
+	cp.drainMu.Lock()
+	assert.Len(t, cp.borrowed, 0)
+	cp.drainMu.Unlock()
+}
+
+// getAll gets the keys in a pipeline
+func getAll(t *testing.T, conn redis.Conn, keys ...string) []string {
+	for _, k := range keys {
+		require.NoError(t, conn.Send("GET", k))
+	}
+	require.NoError(t, conn.Flush())
+	vs := make([]string, len(keys))
+	for i := range keys {
+		v, err := redis.String(conn.Receive())
+		require.NoError(t, err, keys[i])
+		vs[i] = v
+	}
+	return vs
+}
+
+func TestPipelineRouting(t *testing.T) {
+	c := newTestCluster(t)
+	cp := NewClusterPool(c.Addrs()[:1])
+	defer cp.Close()
+	require.NoError(t, cp.ReloadSlotMapping())
+	conn := cp.Get()
+	defer conn.Close()
+
+	// the pipelined commands are sent to the nodes serving their keys without redirects
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%d", i)
+		require.NoError(t, conn.Send("SET", keys[i], keys[i]))
+	}
+	require.NoError(t, conn.Flush())
+	for range keys {
+		_, err := conn.Receive()
+		require.NoError(t, err)
+	}
+	assert.Equal(t, keys, getAll(t, conn, keys...))
+	for addr, st := range cp.NodeStats() {
+		assert.Zero(t, st.Moved, addr)
+		assert.Zero(t, st.Ask, addr)
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	c := newTestCluster(t)
+	cp := NewClusterPool(c.Addrs()[:1])
+	defer cp.Close()
+	require.NoError(t, cp.ReloadSlotMapping())
+	conn := cp.Get()
+	defer conn.Close()
+
+	keys := []string{"a", "b", "foo"}
+	for _, k := range keys {
+		_, err := conn.Do("SET", k, "v-"+k)
+		require.NoError(t, err)
+	}
+	slot := Slot("foo")
+	owner := c.Owner(slot)
+	var target *clustertest.Node
+	for _, m := range c.Masters() {
+		if m != owner {
+			target = m
+			break
+		}
+	}
+
+	// ASK while the slot is migrating, the client mapping is kept
+	require.NoError(t, c.BeginMigration(slot, target))
+	require.NoError(t, c.MigrateKeys(slot))
+	v, err := redis.String(conn.Do("GET", "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, "v-foo", v)
+	assert.Equal(t, []string{"v-a", "v-b", "v-foo"}, getAll(t, conn, keys...))
+	assert.Equal(t, owner.Addr, cp.topology().addrs(slot)[0])
+
+	// MOVED after the migration, the client mapping is reloaded
+	require.NoError(t, c.FinishMigration(slot))
+	v, err = redis.String(conn.Do("GET", "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, "v-foo", v)
+	require.Eventually(t, func() bool {
+		return cp.topology().addrs(slot)[0] == target.Addr
+	}, time.Second, time.Millisecond)
+
+	// the pipeline is redirected by MOVED
+	require.NoError(t, c.MoveSlots(slot, slot, owner))
+	assert.Equal(t, []string{"v-a", "v-b", "v-foo"}, getAll(t, conn, keys...))
+	require.Eventually(t, func() bool {
+		return cp.topology().addrs(slot)[0] == owner.Addr
+	}, time.Second, time.Millisecond)
+}
+
+func TestFailover(t *testing.T) {
+	c := newTestCluster(t)
+	cp := NewClusterPool(c.Addrs())
+	defer cp.Close()
+	require.NoError(t, cp.ReloadSlotMapping())
+	conn := cp.Get()
+	defer conn.Close()
+	_, err := conn.Do("SET", "foo", "1")
+	require.NoError(t, err)
+
+	// the master dies and its replica is promoted
+	master := c.OwnerOf("foo")
+	master.Kill()
+	promoted, err := c.Failover(master)
+	require.NoError(t, err)
+	_, err = conn.Do("SET", "foo", "2")
+	assert.Error(t, err, "the connection to the dead master fails")
+	require.NoError(t, cp.ReloadSlotMapping())
+	assert.Equal(t, []string{promoted.Addr}, cp.topology().addrs(Slot("foo")))
+
+	n, err := redis.Int(conn.Do("INCR", "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
+func TestFailoverCachedConn(t *testing.T) {
+	c := newTestCluster(t)
+	h := &recordHook{}
+	cp := NewClusterPool(c.Addrs(), WithHooks(h))
+	defer cp.Close()
+	require.NoError(t, cp.ReloadSlotMapping())
+	conn := cp.GetReadonlyConn()
+	defer conn.Close()
+	last := func() CommandInfo {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.commands[len(h.commands)-1]
+	}
+
+	// the write is redirected to the master, whose connection is kept by the conn
+	master := c.OwnerOf("foo")
+	_, err := conn.Do("SET", "foo", "1")
+	require.NoError(t, err)
+	assert.Equal(t, master.Addr, last().Addr)
+
+	// the master becomes a replica, the kept connection is not READONLY and it's returned once redirected
+	promoted, err := c.Failover(master)
+	require.NoError(t, err)
+	require.NoError(t, cp.ReloadSlotMapping())
+	v, err := redis.String(conn.Do("GET", "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, "1", v)
+	assert.Equal(t, promoted.Addr, last().Addr)
+	v, err = redis.String(conn.Do("GET", "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, "1", v)
+	assert.Equal(t, master.Addr, last().Addr)
+	assert.Equal(t, 0, last().Redirects)
+}
@@ -0,0 +1,266 @@
+package redicluster
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Replication offsets tracking for bounded-staleness replica reads. The masters are polled by INFO replication
+// every ReplicationCheckInterval, the lag of a replica is computed by comparing its offset with the offset
+// history of its master.
+
+// replOffsetHistory is the count of offset samples kept for a master
+const replOffsetHistory = 64
+
+// ReplicationLag is the replication state of a replica
+type ReplicationLag struct {
+	// Master is the address of the master
+	Master string
+
+	// Offset is the replication offset of the replica
+	Offset int64
+
+	// LagBytes is the count of bytes that the replica falls behind the master
+	LagBytes int64
+
+	// Lag is the upper bound of the time that the replica falls behind the master
+	Lag time.Duration
+
+	// UpdatedAt is the time when the state is collected
+	UpdatedAt time.Time
+}
+
+// ReadOptions are the options for the read-only conn
+type ReadOptions struct {
+	// MaxLagBytes skips the replicas falling behind the master by more than MaxLagBytes, zero means no limit
+	MaxLagBytes int64
+
+	// MaxLag skips the replicas falling behind the master by more than MaxLag, zero means no limit
+	MaxLag time.Duration
+}
+
+type offsetSample struct {
+	at     time.Time
+	offset int64
+}
+
+// replState is the replication state of a node
+type replState struct {
+	mu sync.Mutex
+
+	// offsets of the node as a master, ordered by time
+	history []offsetSample
+
+	// state of the node as a replica
+	lag ReplicationLag
+}
+
+func (rs *replState) addSample(at time.Time, offset int64) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if len(rs.history) >= replOffsetHistory {
+		rs.history = append(rs.history[:0], rs.history[1:]...)
+	}
+	rs.history = append(rs.history, offsetSample{at: at, offset: offset})
+}
+
+// lagSince returns how long the offset has been behind, it's measured from the last sample that the master
+// offset was not greater than the offset
+func (rs *replState) lagSince(now time.Time, offset int64) time.Duration {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if len(rs.history) == 0 || offset >= rs.history[len(rs.history)-1].offset {
+		return 0
+	}
+	since := rs.history[0].at
+	for _, s := range rs.history {
+		if s.offset > offset {
+			break
+		}
+		since = s.at
+	}
+	return now.Sub(since)
+}
+
+func (rs *replState) setLag(lag ReplicationLag) {
+	rs.mu.Lock()
+	rs.lag = lag
+	rs.mu.Unlock()
+}
+
+func (rs *replState) getLag() ReplicationLag {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.lag
+}
+
+// ReplicationLags returns the replication state of the replicas that have been collected
+func (cp *ClusterPool) ReplicationLags() map[string]ReplicationLag {
+	lags := make(map[string]ReplicationLag)
+	cp.rangeNodeStates(func(addr string, ns *nodeState) bool {
+		if lag := ns.repl.getLag(); !lag.UpdatedAt.IsZero() {
+			lags[addr] = lag
+		}
+		return true
+	})
+	return lags
+}
+
+// GetReadonlyConnWithOptions gets the read-only redis.Conn interface, which skips the replicas violating the options
+func (cp *ClusterPool) GetReadonlyConnWithOptions(opts ReadOptions) redis.Conn {
+	c := &redirconn{cp: cp, redir: true, readOnly: true}
+	if opts.MaxLagBytes > 0 || opts.MaxLag > 0 {
+		c.eligible = func(replica, master string) bool {
+			return cp.lagWithin(replica, master, opts)
+		}
+	}
+	return c
+}
+
+// lagWithin reports if the replica lag is known and within the options
+func (cp *ClusterPool) lagWithin(replica, master string, opts ReadOptions) bool {
+	ns := cp.lookupNodeState(replica)
+	if ns == nil || cp.ReplicationCheckInterval <= 0 {
+		return false
+	}
+	lag := ns.repl.getLag()
+	// the state is too old to tell the lag
+	if lag.Master != master || time.Since(lag.UpdatedAt) > 2*cp.ReplicationCheckInterval {
+		return false
+	}
+	if opts.MaxLagBytes > 0 && lag.LagBytes > opts.MaxLagBytes {
+		return false
+	}
+	if opts.MaxLag > 0 && lag.Lag > opts.MaxLag {
+		return false
+	}
+	return true
+}
+
+// collectReplication collects the replication offsets of all shards
+func (cp *ClusterPool) collectReplication() {
+	var wg sync.WaitGroup
+	for _, addr := range cp.getNodes(false) {
+		wg.Add(1)
+		go func(master string) {
+			defer wg.Done()
+			cp.collectShardReplication(master)
+		}(addr)
+	}
+	wg.Wait()
+}
+
+func (cp *ClusterPool) collectShardReplication(master string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cp.ReplicationCheckInterval)
+	defer cancel()
+	conn, err := cp.getRedisConnByAddrContext(ctx, master)
+	if err != nil {
+		return
+	}
+	info, err := redis.String(connDoContext(conn, ctx, "INFO", "replication"))
+	conn.Close()
+	if err != nil {
+		return
+	}
+	cp.recordReplication(master, info, time.Now())
+}
+
+// recordReplication records the offsets of the master and its replicas from the reply of INFO replication. The
+// replicas are reported by IP, they are looked up in the topology since the addresses may be hostnames
+func (cp *ClusterPool) recordReplication(master string, info string, now time.Time) {
+	offset, reported := parseReplicationInfo(info)
+	if offset < 0 {
+		return
+	}
+
+	t := cp.topology()
+	ms := cp.nodeState(master)
+	replicas := make(map[string]int64, len(reported))
+	rss := make(map[string]*nodeState, len(reported))
+	for hostport, ro := range reported {
+		if addr := t.replicaAddr(master, hostport); len(addr) > 0 {
+			replicas[addr] = ro
+			rss[addr] = cp.nodeState(addr)
+		}
+	}
+
+	ms.repl.addSample(now, offset)
+	for addr, ro := range replicas {
+		lagBytes := offset - ro
+		if lagBytes < 0 {
+			lagBytes = 0
+		}
+		rss[addr].repl.setLag(ReplicationLag{
+			Master:    master,
+			Offset:    ro,
+			LagBytes:  lagBytes,
+			Lag:       ms.repl.lagSince(now, ro),
+			UpdatedAt: now,
+		})
+	}
+}
+
+// replicaAddr returns the address of the replica of the master at ip:port reported by INFO replication, which is
+// matched by the address or the IP and port of the replicas in the topology. Empty if it's not in the topology
+func (t *topology) replicaAddr(master, hostport string) string {
+	ip, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return ""
+	}
+	for _, si := range t.slots {
+		if len(si.Nodes) == 0 || si.Nodes[0].Addr != master {
+			continue
+		}
+		for _, n := range si.Nodes[1:] {
+			if n.Addr == hostport {
+				return n.Addr
+			}
+			if _, p, err := net.SplitHostPort(n.Addr); err == nil && n.IP == ip && p == port {
+				return n.Addr
+			}
+		}
+	}
+	return ""
+}
+
+// parseReplicationInfo parses the reply of INFO replication on a master, returns the master offset and
+// the replica offsets by address. The master offset is -1 if the reply is invalid
+func parseReplicationInfo(info string) (int64, map[string]int64) {
+	offset := int64(-1)
+	replicas := make(map[string]int64)
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		if k == "master_repl_offset" {
+			if o, err := strconv.ParseInt(v, 10, 64); err == nil {
+				offset = o
+			}
+			continue
+		}
+		// slave0:ip=127.0.0.1,port=30004,state=online,offset=12345,lag=0
+		if !strings.HasPrefix(k, "slave") {
+			continue
+		}
+		fields := make(map[string]string)
+		for _, kv := range strings.Split(v, ",") {
+			if fk, fv, ok := strings.Cut(kv, "="); ok {
+				fields[fk] = fv
+			}
+		}
+		o, err := strconv.ParseInt(fields["offset"], 10, 64)
+		if err != nil || fields["state"] != "online" {
+			continue
+		}
+		replicas[fields["ip"]+":"+fields["port"]] = o
+	}
+	return offset, replicas
+}
@@ -0,0 +1,82 @@
+package redicluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReplicationInfo(t *testing.T) {
+	info := "# Replication\r\nrole:master\r\nconnected_slaves:2\r\n" +
+		"slave0:ip=10.0.0.2,port=6379,state=online,offset=900,lag=0\r\n" +
+		"slave1:ip=10.0.0.3,port=6379,state=wait_bgsave,offset=0,lag=0\r\n" +
+		"master_repl_offset:1000\r\n"
+	offset, replicas := parseReplicationInfo(info)
+	assert.Equal(t, int64(1000), offset)
+	assert.Equal(t, map[string]int64{"10.0.0.2:6379": 900}, replicas)
+}
+
+func TestRecordReplicationHostnames(t *testing.T) {
+	node := func(id, host, ip, role string) []interface{} {
+		return []interface{}{
+			[]byte("id"), []byte(id), []byte("port"), int64(6379), []byte("ip"), []byte(ip),
+			[]byte("endpoint"), []byte(host), []byte("hostname"), []byte(host), []byte("role"), []byte(role),
+			[]byte("health"), []byte("online"),
+		}
+	}
+	cp := &ClusterPool{}
+	require.NoError(t, cp.updateShardMap([]interface{}{
+		[]interface{}{
+			[]byte("slots"), []interface{}{int64(0), int64(16383)},
+			[]byte("nodes"), []interface{}{
+				node("m1", "node1.example", "10.0.0.1", "master"),
+				node("r1", "node2.example", "10.0.0.2", "replica"),
+			},
+		},
+	}))
+	master := "node1.example:6379"
+	cp.recordReplication(master, "# Replication\r\nrole:master\r\nconnected_slaves:2\r\n"+
+		"slave0:ip=10.0.0.2,port=6379,state=online,offset=900,lag=0\r\n"+
+		"slave1:ip=10.0.0.9,port=6379,state=online,offset=900,lag=0\r\n"+
+		"master_repl_offset:1000\r\n", time.Now())
+
+	// the replica is reported by IP, and the one not in the topology is skipped
+	lags := cp.ReplicationLags()
+	require.Len(t, lags, 1)
+	assert.Equal(t, master, lags["node2.example:6379"].Master)
+	assert.Equal(t, int64(100), lags["node2.example:6379"].LagBytes)
+}
+
+func TestBoundedStaleness(t *testing.T) {
+	cp := &ClusterPool{ReplicationCheckInterval: time.Second}
+	require.NoError(t, cp.updateShardMap(testShardsReply()))
+	master := "10.0.0.1:6379"
+	now := time.Now()
+
+	ms := cp.nodeState(master)
+	ms.repl.addSample(now.Add(-3*time.Second), 100)
+	ms.repl.addSample(now.Add(-2*time.Second), 200)
+	ms.repl.addSample(now, 1000)
+	cp.nodeState("10.0.0.2:6379").repl.setLag(ReplicationLag{
+		Master: master, Offset: 200, LagBytes: 800, Lag: ms.repl.lagSince(now, 200), UpdatedAt: now,
+	})
+	cp.nodeState("10.0.0.3:6379").repl.setLag(ReplicationLag{
+		Master: master, Offset: 1000, UpdatedAt: now,
+	})
+
+	lags := cp.ReplicationLags()
+	assert.Equal(t, 2*time.Second, lags["10.0.0.2:6379"].Lag)
+
+	c := cp.GetReadonlyConnWithOptions(ReadOptions{MaxLag: time.Second}).(*redirconn)
+	for i := 0; i < 10; i++ {
+		addrs, err := cp.getAddrsBySlots([]int{i}, true, c.eligible)
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.3:6379", addrs[0])
+	}
+	c = cp.GetReadonlyConnWithOptions(ReadOptions{MaxLagBytes: 100}).(*redirconn)
+	addrs, err := cp.getAddrsBySlots([]int{0}, true, c.eligible)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.3:6379", addrs[0])
+}
@@ -0,0 +1,329 @@
+package redicluster
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Cluster-wide SCAN. SCAN iterates the keyspace of a single node, so the iterator scans a node of every shard with
+// its own cursor. Every shard scan is bound to the slots its node served when it started, and the keys of the other
+// slots are skipped. Once the topology changes, the slots a node no longer serves are scanned again from the nodes
+// serving them now, so the keys that exist during the whole iteration are returned at least once. Like SCAN, a key
+// may be returned more than once. The slots not served by any node are planned again once the topology changes, or
+// after reloading it at the end of the iteration, then they are skipped if they are still not served.
+
+// maxScanFailures is the count of consecutive failures of a node before the iteration fails
+const maxScanFailures = 3
+
+// ScanOptions are the options of ClusterPool.Scan
+type ScanOptions struct {
+	// Match, Count and Type are the MATCH, COUNT and TYPE options of SCAN, they are not sent if empty
+	Match string
+	Count int
+	Type  string
+
+	// ReadOnly scans a replica of every shard, or the master if the shard has no eligible replica
+	ReadOnly bool
+
+	// Parallel is the count of shards scanned at the same time, zero means 1
+	Parallel int
+}
+
+// scanShard is the scan of the slots served by a node
+type scanShard struct {
+	addr   string
+	cursor string
+	slots  []int
+	owned  [TotalSlots]bool
+
+	// done is set once the cursor returns to 0, failed is set if the last page fails
+	done   bool
+	failed bool
+}
+
+// ScanIterator iterates the keys of the whole cluster, it's not safe for concurrent use
+//
+//	it := cp.Scan(ScanOptions{Match: "user:*", Count: 100})
+//	for it.Next(ctx) {
+//		key := it.Key()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type ScanIterator struct {
+	cp   *ClusterPool
+	opts ScanOptions
+
+	// topo is the topology the shards are planned by, nil before the first page
+	topo   *topology
+	shards []*scanShard
+
+	// pending are the slots not served by any node when they are planned, retried is set once they are planned
+	// again after the other slots are scanned
+	pending []int
+	retried bool
+
+	// failures is the count of consecutive failures by node address
+	failures map[string]int
+
+	keys []string
+	key  string
+	err  error
+}
+
+// Scan returns an iterator of the keys of the whole cluster by SCAN. The iteration starts on the first Next
+func (cp *ClusterPool) Scan(opts ScanOptions) *ScanIterator {
+	return &ScanIterator{cp: cp, opts: opts, failures: make(map[string]int)}
+}
+
+// Next advances to the next key, which is returned by Key. False is returned once the iteration completes or fails,
+// see Err. The pages are requested with ctx
+func (it *ScanIterator) Next(ctx context.Context) bool {
+	for len(it.keys) == 0 {
+		if it.err != nil {
+			return false
+		}
+		if it.topo == nil {
+			it.start(ctx)
+			continue
+		}
+		if len(it.shards) == 0 && !it.retryPending(ctx) {
+			return false
+		}
+		it.fetch(ctx)
+	}
+	it.key, it.keys = it.keys[0], it.keys[1:]
+	return true
+}
+
+// Key returns the current key
+func (it *ScanIterator) Key() string {
+	return it.key
+}
+
+// Err returns the error that stopped the iteration, nil if it completes
+func (it *ScanIterator) Err() error {
+	return it.err
+}
+
+// start plans the shards of all slots, the slot mapping is loaded if it's not loaded yet
+func (it *ScanIterator) start(ctx context.Context) {
+	if len(it.cp.topology().slots) == 0 {
+		if err := it.cp.ReloadSlotMappingContext(ctx); err != nil {
+			it.err = err
+			return
+		}
+	}
+	slots := make([]int, TotalSlots)
+	for i := range slots {
+		slots[i] = i
+	}
+	it.topo = it.cp.topology()
+	it.shards = it.plan(it.topo, slots, nil)
+}
+
+// plan groups the slots by the shards serving them in t, and picks the node to scan of every shard. The slots
+// served by the node of one of shards are merged into it rather than scanning the node twice, and its cursor
+// restarts since it has passed some keys of the merged slots. The slots not served by any node are kept pending
+func (it *ScanIterator) plan(t *topology, slots []int, shards []*scanShard) []*scanShard {
+	byMaster := make(map[string]*scanShard)
+	for _, s := range slots {
+		sa := t.addrs(s)
+		if len(sa) == 0 {
+			it.pending = append(it.pending, s)
+			continue
+		}
+		sh := byMaster[sa[0]]
+		if sh == nil {
+			for _, ex := range shards {
+				if it.serves(t, ex.addr, s) {
+					sh = ex
+					sh.cursor = "0"
+					break
+				}
+			}
+		}
+		if sh == nil {
+			addr := sa[0]
+			if it.opts.ReadOnly {
+				addr = it.cp.pickReplica(t, sa, nil)
+			}
+			sh = &scanShard{addr: addr, cursor: "0"}
+			shards = append(shards, sh)
+		}
+		byMaster[sa[0]] = sh
+		sh.slots = append(sh.slots, s)
+		sh.owned[s] = true
+	}
+	return shards
+}
+
+// retryPending reloads the slot mapping and plans the pending slots once the other slots are scanned, false is
+// returned if there is nothing to scan
+func (it *ScanIterator) retryPending(ctx context.Context) bool {
+	if len(it.pending) == 0 || it.retried {
+		return false
+	}
+	it.retried = true
+	if err := it.cp.ReloadSlotMappingContext(ctx); err != nil {
+		it.err = err
+		return false
+	}
+	it.replan(it.cp.topology())
+	return len(it.shards) > 0
+}
+
+// fetch scans a page of the first Parallel shards, then removes the completed ones and replans the others if the
+// topology changes or a node fails
+func (it *ScanIterator) fetch(ctx context.Context) {
+	n := it.opts.Parallel
+	if n <= 0 {
+		n = 1
+	}
+	if n > len(it.shards) {
+		n = len(it.shards)
+	}
+	type page struct {
+		cursor string
+		keys   []string
+		err    error
+	}
+	pages := make([]page, n)
+	if n == 1 {
+		p := &pages[0]
+		p.cursor, p.keys, p.err = it.scanPage(ctx, it.shards[0])
+	} else {
+		var wg sync.WaitGroup
+		for i := range pages {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				p := &pages[i]
+				p.cursor, p.keys, p.err = it.scanPage(ctx, it.shards[i])
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	failed := false
+	for i, p := range pages {
+		sh := it.shards[i]
+		var re redis.Error
+		switch {
+		case p.err == nil:
+			delete(it.failures, sh.addr)
+			for _, k := range p.keys {
+				if sh.owned[Slot(k)] {
+					it.keys = append(it.keys, k)
+				}
+			}
+			sh.cursor = p.cursor
+			sh.done = p.cursor == "0"
+		case errors.As(p.err, &re) || ctx.Err() != nil || errors.Is(p.err, ErrPoolClosed):
+			it.err = p.err
+			return
+		default:
+			it.failures[sh.addr]++
+			if it.failures[sh.addr] >= maxScanFailures {
+				it.err = p.err
+				return
+			}
+			sh.failed = true
+			failed = true
+		}
+	}
+	shards := it.shards[:0]
+	for _, sh := range it.shards {
+		if !sh.done {
+			shards = append(shards, sh)
+		}
+	}
+	it.shards = shards
+	if failed {
+		// the failed node may have been replaced, e.g. by failover
+		it.cp.ReloadSlotMappingContext(ctx)
+	}
+	if t := it.cp.topology(); failed || t != it.topo {
+		it.replan(t)
+	}
+}
+
+// replan moves the slots the nodes no longer serve in t and the pending slots to the shards of the nodes serving
+// them, the failed shards restart from scratch
+func (it *ScanIterator) replan(t *topology) {
+	it.topo = t
+	lost := it.pending
+	it.pending = nil
+	shards := it.shards[:0]
+	for _, sh := range it.shards {
+		kept := sh.slots[:0]
+		for _, s := range sh.slots {
+			if !sh.failed && it.serves(t, sh.addr, s) {
+				kept = append(kept, s)
+			} else {
+				lost = append(lost, s)
+				sh.owned[s] = false
+			}
+		}
+		sh.slots = kept
+		if len(kept) > 0 {
+			shards = append(shards, sh)
+		}
+	}
+	it.shards = it.plan(t, lost, shards)
+}
+
+// serves reports if the node address serves the slot in t
+func (it *ScanIterator) serves(t *topology, addr string, slot int) bool {
+	sa := t.addrs(slot)
+	if !it.opts.ReadOnly {
+		return len(sa) > 0 && sa[0] == addr
+	}
+	for _, a := range sa {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// scanPage sends a SCAN to the node of the shard, and returns the next cursor and the keys
+func (it *ScanIterator) scanPage(ctx context.Context, sh *scanShard) (string, []string, error) {
+	cp := it.cp
+	if err := cp.beginRequest(); err != nil {
+		return "", nil, err
+	}
+	defer cp.endRequest()
+	conn, err := cp.getRedisConnByAddr(ctx, sh.addr)
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+
+	args := []interface{}{sh.cursor}
+	if len(it.opts.Match) > 0 {
+		args = append(args, "MATCH", it.opts.Match)
+	}
+	if it.opts.Count > 0 {
+		args = append(args, "COUNT", strconv.Itoa(it.opts.Count))
+	}
+	if len(it.opts.Type) > 0 {
+		args = append(args, "TYPE", it.opts.Type)
+	}
+	reply, err := redis.Values(connDoContext(conn, ctx, "SCAN", args...))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(reply) != 2 {
+		return "", nil, errors.New("unexpected SCAN reply")
+	}
+	cursor, err := redis.String(reply[0], nil)
+	if err != nil {
+		return "", nil, err
+	}
+	keys, err := redis.Strings(reply[1], nil)
+	return cursor, keys, err
+}
@@ -0,0 +1,167 @@
+package redicluster
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/rmker/redicluster/clustertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fillKeys sets n string keys user:<i> and a hash, returns the string keys
+func fillKeys(t *testing.T, cp *ClusterPool, n int) []string {
+	conn := cp.Get()
+	defer conn.Close()
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user:%03d", i)
+		require.NoError(t, conn.Send("SET", keys[i], i))
+	}
+	require.NoError(t, conn.Send("HSET", "user:hash", "f", "v"))
+	require.NoError(t, conn.Flush())
+	for i := 0; i <= n; i++ {
+		_, err := conn.Receive()
+		require.NoError(t, err)
+	}
+	return keys
+}
+
+// scanAll returns the distinct keys of the iteration, step is called after every key
+func scanAll(t *testing.T, it *ScanIterator, step func(n int)) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for n := 0; it.Next(context.Background()); n++ {
+		if !seen[it.Key()] {
+			seen[it.Key()] = true
+			keys = append(keys, it.Key())
+		}
+		if step != nil {
+			step(n)
+		}
+	}
+	require.NoError(t, it.Err())
+	return keys
+}
+
+func TestScan(t *testing.T) {
+	c := newTestCluster(t)
+	cp := NewClusterPool(c.Addrs()[:1])
+	defer cp.Close()
+	require.NoError(t, cp.ReloadSlotMapping())
+	keys := fillKeys(t, cp, 100)
+
+	for _, opts := range []ScanOptions{
+		{Match: "user:*", Count: 7, Type: "string"},
+		{Match: "user:*", Type: "string", Parallel: 3},
+		{Match: "user:*", Type: "string", ReadOnly: true, Parallel: 2},
+	} {
+		assert.ElementsMatch(t, keys, scanAll(t, cp.Scan(opts), nil), "%+v", opts)
+	}
+	all := scanAll(t, cp.Scan(ScanOptions{Count: 1000}), nil)
+	assert.ElementsMatch(t, append(keys, "user:hash"), all)
+	assert.Empty(t, scanAll(t, cp.Scan(ScanOptions{Match: "order:*"}), nil))
+}
+
+func TestScanTopologyChange(t *testing.T) {
+	c := newTestCluster(t)
+	cp := NewClusterPool(c.Addrs()[:1])
+	defer cp.Close()
+	require.NoError(t, cp.ReloadSlotMapping())
+	keys := fillKeys(t, cp, 200)
+	masters := c.Masters()
+
+	// the slots of the second master move to the first one while the first one is being scanned
+	it := cp.Scan(ScanOptions{Match: "user:*", Count: 5, Type: "string"})
+	got := scanAll(t, it, func(n int) {
+		if n == 10 {
+			require.NoError(t, c.MoveSlots(5461, 10922, masters[0]))
+			require.NoError(t, cp.ReloadSlotMapping())
+		}
+		// the moved slots are merged into the shard of the first master
+		addrs := make(map[string]bool)
+		for _, sh := range it.shards {
+			assert.False(t, addrs[sh.addr], sh.addr)
+			addrs[sh.addr] = true
+		}
+	})
+	assert.ElementsMatch(t, keys, got)
+
+	// the failed master is replaced by its replica
+	var promoted *clustertest.Node
+	it = cp.Scan(ScanOptions{Match: "user:*", Count: 5, Type: "string", Parallel: 2})
+	got = scanAll(t, it, func(n int) {
+		if n == 10 {
+			var err error
+			promoted, err = c.Failover(masters[2])
+			require.NoError(t, err)
+			masters[2].Kill()
+		}
+	})
+	assert.ElementsMatch(t, keys, got)
+	assert.Equal(t, promoted.Addr, cp.topology().addrs(16383)[0])
+}
+
+func TestScanUnassignedSlots(t *testing.T) {
+	c := newTestCluster(t)
+	cp := NewClusterPool(c.Addrs()[:1])
+	defer cp.Close()
+	require.NoError(t, cp.ReloadSlotMapping())
+	keys := fillKeys(t, cp, 100)
+
+	// the slots of the first master are not served when the iteration starts, they are scanned after reloading
+	var sis []*slotInfo
+	for _, si := range cp.topology().slots {
+		if si.Start != 0 {
+			sis = append(sis, si)
+		}
+	}
+	cp.topo.Store(newTopology(sis))
+	it := cp.Scan(ScanOptions{Match: "user:*", Count: 5, Type: "string"})
+	assert.ElementsMatch(t, keys, scanAll(t, it, nil))
+	assert.Empty(t, it.pending)
+
+	// the slots still not served after reloading are skipped
+	c.DelSlots(0, 5460)
+	require.NoError(t, cp.ReloadSlotMapping())
+	var served []string
+	for _, k := range keys {
+		if Slot(k) > 5460 {
+			served = append(served, k)
+		}
+	}
+	it = cp.Scan(ScanOptions{Match: "user:*", Count: 5, Type: "string"})
+	assert.ElementsMatch(t, served, scanAll(t, it, nil))
+}
+
+func TestScanErrors(t *testing.T) {
+	c := newTestCluster(t)
+	fi := NewFaultInjector()
+	cp := NewClusterPool(c.Addrs()[:1], WithFaults(fi))
+	defer cp.Close()
+	require.NoError(t, cp.ReloadSlotMapping())
+	keys := fillKeys(t, cp, 50)
+
+	// the dropped page is scanned again
+	fi.AddRule(FaultRule{Commands: []string{"SCAN"}, Drop: true, Times: 1})
+	assert.ElementsMatch(t, keys, scanAll(t, cp.Scan(ScanOptions{Match: "user:*", Count: 5, Type: "string"}), nil))
+
+	fi.AddRule(FaultRule{Commands: []string{"SCAN"}, Error: FaultLoading})
+	it := cp.Scan(ScanOptions{})
+	assert.False(t, it.Next(context.Background()))
+	assert.EqualError(t, it.Err(), "LOADING Redis is loading the dataset in memory")
+
+	fi.Reset()
+	fi.AddRule(FaultRule{Commands: []string{"SCAN"}, Drop: true})
+	it = cp.Scan(ScanOptions{})
+	assert.False(t, it.Next(context.Background()))
+	assert.ErrorIs(t, it.Err(), ErrConnDropped)
+
+	fi.Reset()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	it = cp.Scan(ScanOptions{})
+	assert.False(t, it.Next(ctx))
+	assert.ErrorIs(t, it.Err(), context.Canceled)
+}
@@ -0,0 +1,98 @@
+package redicluster
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Read-your-writes session consistency. A session records the replication offset of the master after every write,
+// and the subsequent reads of the shard are sent to a replica only if the replica has caught up with the offset.
+// The replica offsets are collected every ReplicationCheckInterval, the reads go to the master if it's disabled.
+// The offsets are kept by shard, so the reads of a shard that fails over since the last write go to the new master.
+
+type session struct {
+	cp *ClusterPool
+
+	mu sync.Mutex
+
+	// shard -> the master and its offset after the last write, see shardOf
+	offsets map[string]sessionOffset
+}
+
+// sessionOffset is the replication offset of the master after the last write to a shard
+type sessionOffset struct {
+	master string
+	offset int64
+}
+
+// GetSessionConn gets the redis.Conn interface that guarantees read-your-writes consistency. Reads are served by
+// replicas that have replicated the writes of this conn, otherwise by the masters
+func (cp *ClusterPool) GetSessionConn() redis.Conn {
+	s := &session{cp: cp, offsets: make(map[string]sessionOffset)}
+	return &redirconn{cp: cp, redir: true, readOnly: true, eligible: s.caughtUp, session: s}
+}
+
+// shardOf returns the shard of the master address, which is named by the lowest slot range of the master in the
+// topology so it's kept after failover. It's the address itself if the master is not in the topology
+func (s *session) shardOf(master string) string {
+	var lowest *slotInfo
+	for _, si := range s.cp.topology().slots {
+		if len(si.Addrs) > 0 && si.Addrs[0] == master && (lowest == nil || si.Start < lowest.Start) {
+			lowest = si
+		}
+	}
+	if lowest == nil {
+		return master
+	}
+	return strconv.Itoa(lowest.Start) + "-" + strconv.Itoa(lowest.End)
+}
+
+// caughtUp reports if the replica has replicated the writes of the session to the master. The offset recorded on
+// another master doesn't apply after failover, no replica is caught up until the shard is written again
+func (s *session) caughtUp(replica, master string) bool {
+	shard := s.shardOf(master)
+	s.mu.Lock()
+	so, written := s.offsets[shard]
+	s.mu.Unlock()
+	if !written {
+		return true
+	}
+	if so.master != master {
+		return false
+	}
+	ns := s.cp.lookupNodeState(replica)
+	if ns == nil {
+		return false
+	}
+	lag := ns.repl.getLag()
+	return lag.Master == master && lag.Offset >= so.offset
+}
+
+// record records the master offset from the reply of INFO replication. The offset is unknown if the reply can't be
+// parsed, e.g. an error, then the last known offset is kept rather than sending the reads of the shard to the master
+// forever
+func (s *session) record(master string, info interface{}, err error) {
+	is, err := redis.String(info, err)
+	if err != nil {
+		return
+	}
+	offset, _ := parseReplicationInfo(is)
+	if offset < 0 {
+		return
+	}
+	shard := s.shardOf(master)
+	s.mu.Lock()
+	if so := s.offsets[shard]; so.master != master || offset > so.offset {
+		s.offsets[shard] = sessionOffset{master: master, offset: offset}
+	}
+	s.mu.Unlock()
+}
+
+// recordWrite queries the master offset after a write on the conn
+func (s *session) recordWrite(ctx context.Context, conn redis.Conn, master string) {
+	info, err := connDoContext(conn, ctx, "INFO", "replication")
+	s.record(master, info, err)
+}
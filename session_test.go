@@ -0,0 +1,139 @@
+package redicluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionCaughtUp(t *testing.T) {
+	cp := &ClusterPool{ReplicationCheckInterval: time.Second}
+	require.NoError(t, cp.updateShardMap(testShardsReply()))
+	master := "10.0.0.1:6379"
+	cp.nodeState("10.0.0.2:6379").repl.setLag(ReplicationLag{Master: master, Offset: 500, UpdatedAt: time.Now()})
+	cp.nodeState("10.0.0.3:6379").repl.setLag(ReplicationLag{Master: master, Offset: 900, UpdatedAt: time.Now()})
+
+	c := cp.GetSessionConn().(*redirconn)
+	assert.False(t, c.readOnlyFor("SET"))
+	assert.True(t, c.readOnlyFor("get"))
+
+	// no write yet, any replica can serve
+	assert.True(t, c.session.caughtUp("10.0.0.2:6379", master))
+
+	c.session.record(master, "# Replication\r\nmaster_repl_offset:800\r\n", nil)
+	for i := 0; i < 10; i++ {
+		addrs, err := cp.getAddrsBySlots([]int{i}, true, c.eligible)
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.3:6379", addrs[0])
+	}
+
+	c.session.record(master, "# Replication\r\nmaster_repl_offset:1000\r\n", nil)
+
+	// the unknown offsets don't change the recorded one
+	c.session.record(master, "QUEUED", nil)
+	c.session.record(master, nil, redis.ErrNil)
+	assert.Equal(t, sessionOffset{master: master, offset: 1000}, c.session.offsets["0-16383"])
+	addrs, err := cp.getAddrsBySlots([]int{0}, true, c.eligible)
+	require.NoError(t, err)
+	assert.Equal(t, master, addrs[0])
+}
+
+func TestSessionReadYourWrites(t *testing.T) {
+	c := newTestCluster(t)
+	h := &recordHook{}
+	cp := NewClusterPool(c.Addrs()[:1], WithHooks(h))
+	cp.ReplicationCheckInterval = 20 * time.Millisecond
+	defer cp.Close()
+	require.NoError(t, cp.ReloadSlotMapping())
+	master := c.OwnerOf("foo")
+	replica := master.Replicas()[0]
+	lastAddr := func() string {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.commands[len(h.commands)-1].Addr
+	}
+
+	conn := cp.GetSessionConn()
+	defer conn.Close()
+	_, err := conn.Do("SET", "foo", "1")
+	require.NoError(t, err)
+	assert.Equal(t, master.Addr, lastAddr())
+	s := conn.(*redirconn).session
+	offset := s.offsets[s.shardOf(master.Addr)].offset
+	assert.Greater(t, offset, int64(0))
+
+	// the read is served by the replica once it has caught up with the write
+	require.Eventually(t, func() bool {
+		v, err := redis.String(conn.Do("GET", "foo"))
+		return err == nil && v == "1" && lastAddr() == replica.Addr
+	}, time.Second, 10*time.Millisecond)
+
+	// the transaction is sent to the master even if the replica has caught up, and the offset is recorded after EXEC
+	_, err = conn.Do("SET", "foo", "2")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return s.caughtUp(replica.Addr, master.Addr)
+	}, time.Second, 10*time.Millisecond)
+	offset = s.offsets[s.shardOf(master.Addr)].offset
+	for _, cmd := range [][]interface{}{{"MULTI"}, {"GET", "foo"}, {"INCR", "foo"}} {
+		_, err = conn.Do(cmd[0].(string), cmd[1:]...)
+		require.NoError(t, err, cmd[0])
+		assert.Equal(t, master.Addr, lastAddr(), cmd[0])
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{[]byte("2"), int64(3)}, replies)
+	recorded := s.offsets[s.shardOf(master.Addr)].offset
+	assert.Greater(t, recorded, offset)
+	assert.Less(t, recorded, int64(1<<63-1))
+	require.Eventually(t, func() bool {
+		v, err := redis.String(conn.Do("GET", "foo"))
+		return err == nil && v == "3" && lastAddr() == replica.Addr
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSessionFailover(t *testing.T) {
+	c := newTestCluster(t)
+	h := &recordHook{}
+	cp := NewClusterPool(c.Addrs()[:1], WithHooks(h))
+	cp.ReplicationCheckInterval = 20 * time.Millisecond
+	defer cp.Close()
+	require.NoError(t, cp.ReloadSlotMapping())
+	master := c.OwnerOf("foo")
+	lastAddr := func() string {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.commands[len(h.commands)-1].Addr
+	}
+
+	conn := cp.GetSessionConn()
+	defer conn.Close()
+	_, err := conn.Do("SET", "foo", "1")
+	require.NoError(t, err)
+	s := conn.(*redirconn).session
+	shard := s.shardOf(master.Addr)
+
+	// the offset of the former master doesn't apply to the shard after failover, the reads go to the new master
+	promoted, err := c.Failover(master)
+	require.NoError(t, err)
+	require.NoError(t, cp.ReloadSlotMapping())
+	assert.Equal(t, shard, s.shardOf(promoted.Addr))
+	for i := 0; i < 10; i++ {
+		v, err := redis.String(conn.Do("GET", "foo"))
+		require.NoError(t, err)
+		assert.Equal(t, "1", v)
+		assert.Equal(t, promoted.Addr, lastAddr())
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the replica serves the reads once it has caught up with the write to the new master
+	_, err = conn.Do("SET", "foo", "2")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		v, err := redis.String(conn.Do("GET", "foo"))
+		return err == nil && v == "2" && lastAddr() == master.Addr
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,115 @@
+package redicluster
+
+import (
+	"context"
+	"errors"
+)
+
+// Graceful shutdown. Shutdown stops accepting new requests with ErrPoolClosed, waits the in-flight requests finishing
+// and the borrowed connections returned, then closes everything.
+
+// ErrPoolClosed is returned by the requests after the ClusterPool is closed
+var ErrPoolClosed = errors.New("redicluster: pool closed")
+
+// beginRequest registers an in-flight request, ErrPoolClosed is returned if the pool is closed
+func (cp *ClusterPool) beginRequest() error {
+	cp.inflight.Add(1)
+	if cp.closed.Load() {
+		cp.endRequest()
+		return ErrPoolClosed
+	}
+	return nil
+}
+
+func (cp *ClusterPool) endRequest() {
+	if cp.inflight.Add(-1) == 0 && cp.closed.Load() {
+		cp.drainMu.Lock()
+		cp.checkDrained()
+		cp.drainMu.Unlock()
+	}
+}
+
+// checkDrained notifies Shutdown if there is no in-flight request or borrowed connection. cp.drainMu must be held by
+// the caller
+func (cp *ClusterPool) checkDrained() {
+	if cp.drained != nil && cp.inflight.Load() == 0 && len(cp.borrowed) == 0 {
+		close(cp.drained)
+		cp.drained = nil
+	}
+}
+
+// borrow registers the borrowed connection, the connection is closed and ErrPoolClosed is returned if the pool
+// is closed
+func (cp *ClusterPool) borrow(nc *nodeConn) error {
+	cp.drainMu.Lock()
+	defer cp.drainMu.Unlock()
+	if cp.closed.Load() {
+		nc.Conn.Close()
+		return ErrPoolClosed
+	}
+	if cp.borrowed == nil {
+		cp.borrowed = make(map[*nodeConn]struct{})
+	}
+	cp.borrowed[nc] = struct{}{}
+	return nil
+}
+
+// giveBack unregisters the borrowed connection, and gives it back to the connection budget on the first call
+func (cp *ClusterPool) giveBack(nc *nodeConn) {
+	cp.drainMu.Lock()
+	_, borrowed := cp.borrowed[nc]
+	delete(cp.borrowed, nc)
+	cp.checkDrained()
+	cp.drainMu.Unlock()
+	if borrowed {
+		cp.releaseBudget(nc.addr)
+	}
+}
+
+// Shutdown closes the cluster pool gracefully. New requests fail with ErrPoolClosed immediately, and Shutdown waits
+// the in-flight Do/Flush calls finishing and the borrowed connections (including the ones of pipelines and pubsub
+// conns) returned, then stops the background goroutines and closes the pools. If ctx expires before that, the remaining
+// connections are closed forcibly and ctx.Err() is returned
+func (cp *ClusterPool) Shutdown(ctx context.Context) error {
+	cp.drainMu.Lock()
+	cp.closed.Store(true)
+	drained := make(chan struct{})
+	cp.drained = drained
+	cp.checkDrained()
+	cp.drainMu.Unlock()
+
+	cp.stopBackground()
+	// the pre-warming will not run, wake up the waiters of WaitReady
+	cp.setReady()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	cp.drainMu.Lock()
+	cp.drained = nil
+	borrowed := cp.borrowed
+	cp.borrowed = nil
+	cp.drainMu.Unlock()
+
+	cp.topo.Store(nil)
+	var pools []*nodePool
+	cp.poolMu.Lock()
+	cp.rangePools(func(addr string, np *nodePool) bool {
+		pools = append(pools, np)
+		cp.connPools.Delete(addr)
+		return true
+	})
+	cp.poolMu.Unlock()
+
+	for nc := range borrowed {
+		nc.Conn.Close()
+	}
+	for _, np := range pools {
+		np.pool.Close()
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package redicluster
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func listenLoopback(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				c.Close()
+			}
+		}()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, c)
+		}
+	}()
+	return ln
+}
+
+func TestShutdownDrains(t *testing.T) {
+	ln := listenLoopback(t)
+	defer ln.Close()
+	cp := &ClusterPool{}
+	conn, err := cp.getRedisConnByAddrContext(context.Background(), ln.Addr().String())
+	require.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		done <- cp.Shutdown(context.Background())
+	}()
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned with a borrowed connection")
+	case <-time.After(20 * time.Millisecond):
+	}
+	_, err = cp.getRedisConnByAddrContext(context.Background(), ln.Addr().String())
+	assert.ErrorIs(t, err, ErrPoolClosed)
+
+	conn.Close()
+	assert.NoError(t, <-done)
+
+	_, err = cp.Get().Do("GET", "abc")
+	assert.ErrorIs(t, err, ErrPoolClosed)
+}
+
+func TestShutdownForce(t *testing.T) {
+	ln := listenLoopback(t)
+	defer ln.Close()
+	cp := &ClusterPool{}
+	conn, err := cp.getRedisConnByAddrContext(context.Background(), ln.Addr().String())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, cp.Shutdown(ctx), context.DeadlineExceeded)
+	assert.Error(t, conn.Err())
+}
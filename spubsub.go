@@ -42,18 +42,25 @@ func (c *ShardedPubSubConn) Close() error {
 	return nil
 }
 
-// Subscribe subscribes the connection to the specified channels.
+// SSubscribe subscribes the connection to the specified channels.
 func (c *ShardedPubSubConn) SSubscribe(channel ...interface{}) error {
+	return c.SSubscribeContext(context.Background(), channel...)
+}
+
+// SSubscribeContext is like SSubscribe, ctx bounds getting the connection of the node
+func (c *ShardedPubSubConn) SSubscribeContext(ctx context.Context, channel ...interface{}) error {
 	slot, err := ChnSlot(channel...)
 	if err != nil {
 		return err
 	}
 	if c.conn != nil {
+		c.cp.log(LogInfo, "redicluster: sharded pubsub reconnecting", "slot", slot)
 		c.conn.Close()
 		c.conn = nil
 	}
-	c.conn, err = c.cp.getRedisConnBySlot(slot)
+	c.conn, err = c.cp.getRedisConnBySlot(ctx, slot)
 	if err != nil {
+		c.cp.log(LogWarn, "redicluster: sharded pubsub connection failed", "slot", slot, "err", err)
 		return err
 	}
 
@@ -0,0 +1,275 @@
+package redicluster
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Per-node statistics. The requests on node connections are counted by the nodeConn wrapper, and the bytes by
+// the network connections dialed by the cluster pool, so the bytes of the pools created by CreateConnPool or
+// CreateNodePool are not counted unless they dial by the managed pools. Without pool, the bytes are not counted
+// if DialOptionsWithoutPool is set.
+
+// NodeStats is the statistics of a node
+type NodeStats struct {
+	redis.PoolStats
+
+	// Circuit is the state of the circuit breaker
+	Circuit CircuitState
+
+	// Commands is the count of commands sent to the node
+	Commands int64
+
+	// Errors counts the failed commands and connections by class
+	Errors ErrorStats
+
+	// Moved and Ask are the counts of MOVED and ASK redirects replied by the node
+	Moved int64
+	Ask   int64
+
+	// BytesIn and BytesOut are the bytes read from and written to the node
+	BytesIn  int64
+	BytesOut int64
+
+	// Batches is the count of pipeline batches sent to the node
+	Batches int64
+
+	// Latency is the round-trip latency statistics of the node
+	Latency LatencyStats
+}
+
+// ErrorStats counts the errors by class
+type ErrorStats struct {
+	// Reply is the count of error replies other than redirects and authentication errors
+	Reply int64
+
+	// IO is the count of network and protocol errors
+	IO int64
+
+	// Timeout is the count of network timeouts and exceeded deadlines, Canceled is the count of cancelled contexts
+	Timeout  int64
+	Canceled int64
+
+	// Auth is the count of WRONGPASS and NOAUTH errors
+	Auth int64
+
+	// Dial is the count of failures to connect or borrow a connection, Circuit is the count of requests rejected by
+	// the open circuit
+	Dial    int64
+	Circuit int64
+}
+
+func (es *ErrorStats) add(o ErrorStats) {
+	es.Reply += o.Reply
+	es.IO += o.IO
+	es.Timeout += o.Timeout
+	es.Canceled += o.Canceled
+	es.Auth += o.Auth
+	es.Dial += o.Dial
+	es.Circuit += o.Circuit
+}
+
+// ClusterStats is the statistics of the cluster pool
+type ClusterStats struct {
+	// Nodes is the statistics of the nodes by address
+	Nodes map[string]NodeStats
+
+	// Total is the sum of the node statistics, its Circuit and latency EWMA and quantiles are not set
+	Total NodeStats
+
+	// Reloads is the count of slot mapping reloads, ReloadErrors is the count of the failed ones
+	Reloads      int64
+	ReloadErrors int64
+
+	// LastReload is the time the last reload finishes, LastReloadError is empty if it succeeds
+	LastReload         time.Time
+	LastReloadDuration time.Duration
+	LastReloadError    string
+}
+
+// nodeCounters counts the requests of a node
+type nodeCounters struct {
+	commands, moved, ask, batches atomic.Int64
+	bytesIn, bytesOut             atomic.Int64
+
+	reply, io, timeout, canceled, auth, dial, circuit atomic.Int64
+}
+
+// result counts the error of a command, nil is not counted
+func (nc *nodeCounters) result(err error) {
+	if err == nil {
+		return
+	}
+	var (
+		re redis.Error
+		ne net.Error
+	)
+	switch {
+	case errors.Is(err, ErrAuth):
+		nc.auth.Add(1)
+	case errors.As(err, &re):
+		switch {
+		case strings.HasPrefix(string(re), "MOVED "):
+			nc.moved.Add(1)
+		case strings.HasPrefix(string(re), "ASK "):
+			nc.ask.Add(1)
+		default:
+			nc.reply.Add(1)
+		}
+	case errors.Is(err, context.Canceled):
+		nc.canceled.Add(1)
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()):
+		nc.timeout.Add(1)
+	default:
+		nc.io.Add(1)
+	}
+}
+
+// connectFailed counts the failure to get a connection of the node
+func (nc *nodeCounters) connectFailed(err error) {
+	switch {
+	case errors.Is(err, ErrCircuitOpen):
+		nc.circuit.Add(1)
+	case errors.Is(err, ErrAuth):
+		nc.auth.Add(1)
+	case errors.Is(err, context.Canceled):
+		nc.canceled.Add(1)
+	case errors.Is(err, context.DeadlineExceeded):
+		nc.timeout.Add(1)
+	default:
+		nc.dial.Add(1)
+	}
+}
+
+// fillStats sets the statistics of the node state to st
+func (ns *nodeState) fillStats(st *NodeStats) {
+	c := &ns.counters
+	st.Circuit = ns.breaker.getState()
+	st.Commands = c.commands.Load()
+	st.Moved = c.moved.Load()
+	st.Ask = c.ask.Load()
+	st.BytesIn = c.bytesIn.Load()
+	st.BytesOut = c.bytesOut.Load()
+	st.Batches = c.batches.Load()
+	st.Errors = ErrorStats{
+		Reply:    c.reply.Load(),
+		IO:       c.io.Load(),
+		Timeout:  c.timeout.Load(),
+		Canceled: c.canceled.Load(),
+		Auth:     c.auth.Load(),
+		Dial:     c.dial.Load(),
+		Circuit:  c.circuit.Load(),
+	}
+	st.Latency = ns.latency.stats()
+}
+
+// countingConn counts the bytes read from and written to the node
+type countingConn struct {
+	net.Conn
+	c *nodeCounters
+}
+
+func (cc *countingConn) Read(b []byte) (int, error) {
+	n, err := cc.Conn.Read(b)
+	cc.c.bytesIn.Add(int64(n))
+	return n, err
+}
+
+func (cc *countingConn) Write(b []byte) (int, error) {
+	n, err := cc.Conn.Write(b)
+	cc.c.bytesOut.Add(int64(n))
+	return n, err
+}
+
+// countingDialOption dials the node by d and counts the bytes, the dial options after it can override it
+func (cp *ClusterPool) countingDialOption(addr string, d *net.Dialer) redis.DialOption {
+	c := &cp.nodeState(addr).counters
+	return redis.DialContextFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := d.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &countingConn{Conn: conn, c: c}, nil
+	})
+}
+
+// reloadStats is the statistics of the slot mapping reloads
+type reloadStats struct {
+	mu       sync.Mutex
+	count    int64
+	errors   int64
+	last     time.Time
+	duration time.Duration
+	err      string
+}
+
+func (rs *reloadStats) record(d time.Duration, err error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.count++
+	rs.last = time.Now()
+	rs.duration = d
+	rs.err = ""
+	if err != nil {
+		rs.errors++
+		rs.err = err.Error()
+	}
+}
+
+// ClusterStats returns the statistics of the nodes, their totals and the slot mapping reloads
+func (cp *ClusterPool) ClusterStats() ClusterStats {
+	cs := ClusterStats{Nodes: cp.NodeStats()}
+	hist := make([]LatencyBucket, latencyBuckets)
+	for b := range hist {
+		hist[b].UpperBound = latencyBucketBound(b)
+	}
+	t := &cs.Total
+	for _, st := range cs.Nodes {
+		t.ActiveCount += st.ActiveCount
+		t.IdleCount += st.IdleCount
+		t.WaitCount += st.WaitCount
+		t.WaitDuration += st.WaitDuration
+		t.Commands += st.Commands
+		t.Errors.add(st.Errors)
+		t.Moved += st.Moved
+		t.Ask += st.Ask
+		t.BytesIn += st.BytesIn
+		t.BytesOut += st.BytesOut
+		t.Batches += st.Batches
+		t.Latency.Samples += st.Latency.Samples
+		t.Latency.Sum += st.Latency.Sum
+		if st.Latency.LastSample.After(t.Latency.LastSample) {
+			t.Latency.LastSample = st.Latency.LastSample
+		}
+		for b, lb := range st.Latency.Histogram {
+			hist[b].Count += lb.Count
+		}
+	}
+	t.Latency.Histogram = hist
+
+	rs := &cp.reloadStats
+	rs.mu.Lock()
+	cs.Reloads = rs.count
+	cs.ReloadErrors = rs.errors
+	cs.LastReload = rs.last
+	cs.LastReloadDuration = rs.duration
+	cs.LastReloadError = rs.err
+	rs.mu.Unlock()
+	return cs
+}
+
+// PublishExpvar publishes the ClusterStats as an expvar variable with the name, which is served in JSON by
+// the /debug/vars handler of expvar. It panics if the name is already published, like expvar.Publish
+func (cp *ClusterPool) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return cp.ClusterStats()
+	}))
+}
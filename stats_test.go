@@ -0,0 +1,88 @@
+package redicluster
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClusterStats(t *testing.T) {
+	addr2 := serveRedis(t, func(state map[string]string, args []string) string {
+		return "$2\r\nv2\r\n"
+	})
+	addr1 := serveRedis(t, func(state map[string]string, args []string) string {
+		switch {
+		case args[0] == "CLUSTER":
+			return "-ERR This instance has cluster support disabled\r\n"
+		case len(args) > 1 && args[1] == "bad":
+			return "-ERR bad key\r\n"
+		case len(args) > 1 && args[1] == "moved":
+			return fmt.Sprintf("-MOVED %d %s\r\n", Slot("moved"), addr2)
+		}
+		return "$1\r\nv\r\n"
+	})
+	cp := NewClusterPool([]string{addr1})
+	defer cp.Close()
+	cp.setSlots([]*slotInfo{{Start: 0, End: TotalSlots - 1, Nodes: []*NodeInfo{{Addr: addr1, Role: "master"}}, Addrs: []string{addr1}}})
+
+	conn := cp.Get()
+	defer conn.Close()
+	_, err := conn.Do("GET", "k")
+	require.NoError(t, err)
+	_, err = conn.Do("GET", "bad")
+	assert.Error(t, err)
+	require.NoError(t, conn.Send("GET", "a"))
+	require.NoError(t, conn.Send("GET", "b"))
+	require.NoError(t, conn.Flush())
+	assert.Error(t, cp.ReloadSlotMapping())
+	_, err = conn.Do("GET", "moved")
+	require.NoError(t, err)
+	// wait the reload by MOVED
+	require.Eventually(t, func() bool {
+		return cp.ClusterStats().Reloads == 2
+	}, time.Second, time.Millisecond)
+
+	cs := cp.ClusterStats()
+	st := cs.Nodes[addr1]
+	// 3 Do, 2 in the pipeline, and CLUSTER SHARDS and SLOTS by the 2 reloads
+	assert.Equal(t, int64(9), st.Commands)
+	assert.Equal(t, int64(1), st.Batches)
+	assert.Equal(t, int64(1), st.Moved)
+	assert.Equal(t, int64(5), st.Errors.Reply)
+	assert.Greater(t, st.BytesIn, int64(0))
+	assert.Greater(t, st.BytesOut, int64(0))
+	assert.Equal(t, CircuitClosed, st.Circuit)
+	assert.Equal(t, int64(1), cs.Nodes[addr2].Commands)
+
+	total := cs.Total
+	assert.Equal(t, int64(10), total.Commands)
+	assert.Equal(t, st.BytesIn+cs.Nodes[addr2].BytesIn, total.BytesIn)
+	var samples uint64
+	for _, b := range total.Latency.Histogram {
+		samples += b.Count
+	}
+	assert.Equal(t, total.Latency.Samples, samples)
+	assert.Greater(t, samples, uint64(0))
+
+	assert.Equal(t, int64(2), cs.Reloads)
+	assert.Equal(t, int64(2), cs.ReloadErrors)
+	assert.Equal(t, "all nodes failed", cs.LastReloadError)
+	assert.False(t, cs.LastReload.IsZero())
+
+	name := fmt.Sprintf("redicluster_%p", cp)
+	cp.PublishExpvar(name)
+	var published struct {
+		Nodes map[string]struct {
+			Circuit  string
+			Commands int64
+		}
+	}
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get(name).String()), &published))
+	assert.Equal(t, "closed", published.Nodes[addr1].Circuit)
+	assert.Equal(t, int64(9), published.Nodes[addr1].Commands)
+}
@@ -0,0 +1,128 @@
+package redicluster
+
+// Lock-free routing. The slot mapping is published as an immutable topology snapshot behind an atomic pointer, which
+// is replaced as a whole on reloading, so the requests route without locking. The pools and runtime states of nodes
+// are kept in concurrent maps apart from the snapshot.
+
+// slotChunk is the count of slots in a chunk of the slot mapping, a redirect copies only the chunk of its slot
+const slotChunk = 256
+
+// topology is an immutable snapshot of the cluster topology, it must not be modified once published
+type topology struct {
+	// slot mapping in chunks of slotChunk slots, slot -> addrs, see addrs. The chunks are shared by the snapshots
+	slotChunks [TotalSlots / slotChunk]*[slotChunk][]string
+
+	// slot info, including slot range and corresponding nodes address and roles
+	slots []*slotInfo
+
+	// nodes in cluster, addr -> node
+	nodes map[string]*NodeInfo
+}
+
+var emptyTopology = newTopology(nil)
+
+// topology returns the current topology snapshot, which is empty before the slot mapping is loaded
+func (cp *ClusterPool) topology() *topology {
+	if t := cp.topo.Load(); t != nil {
+		return t
+	}
+	return emptyTopology
+}
+
+// newTopology builds the topology snapshot of the slot infos
+func newTopology(sis []*slotInfo) *topology {
+	t := &topology{
+		slots: sis,
+		nodes: make(map[string]*NodeInfo),
+	}
+	for i := range t.slotChunks {
+		t.slotChunks[i] = new([slotChunk][]string)
+	}
+	for _, si := range sis {
+		for _, n := range si.Nodes {
+			n.Shard = si.Nodes[0].Id
+			t.nodes[n.Addr] = n
+		}
+		for i := si.Start; i <= si.End; i++ {
+			t.slotChunks[i/slotChunk][i%slotChunk] = si.Addrs
+		}
+	}
+	return t
+}
+
+// addrs returns the addresses serving the slot, the 0 index address is the master
+func (t *topology) addrs(slot int) []string {
+	return t.slotChunks[slot/slotChunk][slot%slotChunk]
+}
+
+// redirectSlot publishes a copy of the current topology in which the slot is served by addr only, only the chunk of
+// the slot is copied. False is returned if the slot is served by addr already
+func (cp *ClusterPool) redirectSlot(slot int, addr string) bool {
+	for {
+		old := cp.topo.Load()
+		cur := emptyTopology
+		if old != nil {
+			cur = old
+		}
+		if sa := cur.addrs(slot); len(sa) > 0 && sa[0] == addr {
+			return false
+		}
+		t := *cur
+		chunk := *cur.slotChunks[slot/slotChunk]
+		chunk[slot%slotChunk] = []string{addr}
+		t.slotChunks[slot/slotChunk] = &chunk
+		if cp.topo.CompareAndSwap(old, &t) {
+			return true
+		}
+	}
+}
+
+// nodeState returns the state of the node address, creates it if not exist
+func (cp *ClusterPool) nodeState(addr string) *nodeState {
+	if v, ok := cp.states.Load(addr); ok {
+		return v.(*nodeState)
+	}
+	v, _ := cp.states.LoadOrStore(addr, &nodeState{})
+	return v.(*nodeState)
+}
+
+// lookupNodeState returns the state of the node address, nil if the node has not been requested
+func (cp *ClusterPool) lookupNodeState(addr string) *nodeState {
+	if v, ok := cp.states.Load(addr); ok {
+		return v.(*nodeState)
+	}
+	return nil
+}
+
+// rangeNodeStates calls fn for every node state until fn returns false
+func (cp *ClusterPool) rangeNodeStates(fn func(addr string, ns *nodeState) bool) {
+	cp.states.Range(func(k, v interface{}) bool {
+		return fn(k.(string), v.(*nodeState))
+	})
+}
+
+// removeStaleStates removes the states of the nodes that leave the cluster in t, the states of the entry nodes and
+// the nodes with pools are kept
+func (cp *ClusterPool) removeStaleStates(t *topology) {
+	cp.rangeNodeStates(func(addr string, ns *nodeState) bool {
+		if t.nodes[addr] == nil && !cp.isEntryAddr(addr) && cp.lookupPool(addr) == nil {
+			cp.states.Delete(addr)
+		}
+		return true
+	})
+}
+
+// lookupPool returns the pool of the node address, nil if it's not created yet
+func (cp *ClusterPool) lookupPool(addr string) *nodePool {
+	if v, ok := cp.connPools.Load(addr); ok {
+		return v.(*nodePool)
+	}
+	return nil
+}
+
+// rangePools calls fn for every node pool until fn returns false
+func (cp *ClusterPool) rangePools(fn func(addr string, np *nodePool) bool) {
+	cp.connPools.Range(func(k, v interface{}) bool {
+		return fn(k.(string), v.(*nodePool))
+	})
+}
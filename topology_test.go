@@ -0,0 +1,188 @@
+package redicluster
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedirectSlot(t *testing.T) {
+	cp := &ClusterPool{}
+	require.NoError(t, cp.updateShardMap(testShardsReply()))
+	old := cp.topology()
+
+	assert.False(t, cp.redirectSlot(100, "10.0.0.1:6379"))
+	assert.True(t, cp.redirectSlot(100, "10.0.0.9:6379"))
+	assert.Equal(t, []string{"10.0.0.9:6379"}, cp.topology().addrs(100))
+	assert.Equal(t, "10.0.0.1:6379", cp.topology().addrs(101)[0])
+
+	// the published snapshot is never modified, and only the chunk of the slot is copied
+	assert.Equal(t, "10.0.0.1:6379", old.addrs(100)[0])
+	assert.NotSame(t, old.slotChunks[0], cp.topology().slotChunks[0])
+	assert.Same(t, old.slotChunks[1], cp.topology().slotChunks[1])
+}
+
+func TestRouteWhileReloading(t *testing.T) {
+	cp := &ClusterPool{}
+	require.NoError(t, cp.updateShardMap(testShardsReply()))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				addrs, err := cp.GetAddrsBySlots([]int{j % TotalSlots}, j%2 == 0)
+				assert.NoError(t, err)
+				assert.Len(t, addrs, 1)
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		require.NoError(t, cp.updateShardMap(testShardsReply()))
+		cp.onRedir(&RedirInfo{Kind: "MOVED", Slot: i, Addr: "10.0.0.1:6379"})
+	}
+	wg.Wait()
+}
+
+func BenchmarkGetAddrsBySlots(b *testing.B) {
+	cp := &ClusterPool{}
+	require.NoError(b, cp.updateShardMap(testShardsReply()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		slot := 0
+		for pb.Next() {
+			cp.GetAddrsBySlots([]int{slot}, false)
+			slot = (slot + 1) % TotalSlots
+		}
+	})
+}
+
+func BenchmarkGetAddrsBySlotsReadOnly(b *testing.B) {
+	cp := &ClusterPool{}
+	require.NoError(b, cp.updateShardMap(testShardsReply()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		slot := 0
+		for pb.Next() {
+			cp.GetAddrsBySlots([]int{slot}, true)
+			slot = (slot + 1) % TotalSlots
+		}
+	})
+}
+
+// mutexRouting is the routing before the topology snapshots as the baseline of the benchmarks, the slot mapping is
+// guarded by the mutex of the cluster pool and copied as a whole on MOVED
+type mutexRouting struct {
+	mu          sync.Mutex
+	slotAddrMap [TotalSlots][]string
+}
+
+func newMutexRouting(b *testing.B) *mutexRouting {
+	cp := &ClusterPool{}
+	require.NoError(b, cp.updateShardMap(testShardsReply()))
+	r := &mutexRouting{}
+	for sl := 0; sl < TotalSlots; sl++ {
+		r.slotAddrMap[sl] = cp.topology().addrs(sl)
+	}
+	return r
+}
+
+func (r *mutexRouting) getAddrsBySlots(slots []int, readOnly bool) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var addrs []string
+	for _, sl := range slots {
+		sa := r.slotAddrMap[sl]
+		if len(sa) == 0 {
+			return nil, errors.New("bad slot mapping")
+		}
+		addr := sa[0]
+		if readOnly && len(sa) > 1 {
+			rnd.Lock()
+			addr = sa[rnd.Intn(len(sa)-1)+1]
+			rnd.Unlock()
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+func (r *mutexRouting) redirectSlot(slot int, addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := new([TotalSlots][]string)
+	*m = r.slotAddrMap
+	m[slot] = []string{addr}
+	r.slotAddrMap = *m
+}
+
+func BenchmarkGetAddrsBySlotsMutex(b *testing.B) {
+	for _, readOnly := range []bool{false, true} {
+		b.Run(fmt.Sprintf("readOnly=%v", readOnly), func(b *testing.B) {
+			r := newMutexRouting(b)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				slot := 0
+				for pb.Next() {
+					r.getAddrsBySlots([]int{slot}, readOnly)
+					slot = (slot + 1) % TotalSlots
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkRedirectSlot(b *testing.B) {
+	cp := &ClusterPool{}
+	require.NoError(b, cp.updateShardMap(testShardsReply()))
+	addrs := []string{"10.0.0.1:6379", "10.0.0.9:6379"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cp.redirectSlot(i%TotalSlots, addrs[(i/TotalSlots+1)%2])
+	}
+}
+
+func BenchmarkRedirectSlotMutex(b *testing.B) {
+	r := newMutexRouting(b)
+	addrs := []string{"10.0.0.1:6379", "10.0.0.9:6379"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.redirectSlot(i%TotalSlots, addrs[(i/TotalSlots+1)%2])
+	}
+}
+
+func TestRemoveStaleStates(t *testing.T) {
+	cp := &ClusterPool{EntryAddrs: []string{"10.0.0.8:6379"}}
+	require.NoError(t, cp.updateShardMap(testShardsReply()))
+	for _, addr := range []string{"10.0.0.1:6379", "10.0.0.3:6379", "10.0.0.8:6379", "10.0.0.9:6379"} {
+		cp.nodeState(addr)
+	}
+
+	// 10.0.0.3 leaves the cluster, and 10.0.0.9 was never part of it
+	rep := []interface{}{
+		[]interface{}{
+			[]byte("slots"), []interface{}{int64(0), int64(16383)},
+			[]byte("nodes"), []interface{}{
+				shardNode("m1", "10.0.0.1", 6379, "master", "az-a"),
+				shardNode("r1", "10.0.0.2", 6379, "replica", "az-b"),
+			},
+		},
+	}
+	require.NoError(t, cp.updateShardMap(rep))
+	var addrs []string
+	cp.rangeNodeStates(func(addr string, ns *nodeState) bool {
+		addrs = append(addrs, addr)
+		return true
+	})
+	assert.ElementsMatch(t, []string{"10.0.0.1:6379", "10.0.0.8:6379"}, addrs)
+}
@@ -0,0 +1,67 @@
+package redicluster
+
+// Availability zone affinity for replica reads. Replicas are tried by zone tiers: ClientZone first, then the
+// zones in ZoneFallback in order, and the master at last if no replica matches.
+
+// AnyZone matches the replicas in any zone when it's used in ClusterPool.ZoneFallback
+const AnyZone = "*"
+
+// zoneOf returns the zone of the node, ZoneOf takes precedence over the zone reported by the server
+func (cp *ClusterPool) zoneOf(addr string, reported string) string {
+	if cp.ZoneOf != nil {
+		if z := cp.ZoneOf(addr); len(z) > 0 {
+			return z
+		}
+	}
+	return reported
+}
+
+// zoneTiers returns the zones in the order they should be tried for replica reads
+func (cp *ClusterPool) zoneTiers() []string {
+	fallback := cp.ZoneFallback
+	if fallback == nil {
+		fallback = []string{AnyZone}
+	}
+	if len(cp.ClientZone) == 0 {
+		return fallback
+	}
+	return append([]string{cp.ClientZone}, fallback...)
+}
+
+// pickReplica picks a replica address for reading from the slot addresses, in which the master is at index 0.
+// The master address is returned if there is no eligible replica. The zones of the replicas are looked up in t
+func (cp *ClusterPool) pickReplica(t *topology, sa []string, eligible func(replica, master string) bool) string {
+	if len(sa) < 2 {
+		return sa[0]
+	}
+	var candidates []string
+	for _, zone := range cp.zoneTiers() {
+		candidates = candidates[:0]
+		for _, addr := range sa[1:] {
+			if cp.circuitRejects(addr) || (eligible != nil && !eligible(addr, sa[0])) {
+				continue
+			}
+			if zone == AnyZone || cp.nodeZone(t, addr) == zone {
+				candidates = append(candidates, addr)
+			}
+		}
+		if len(candidates) > 0 && cp.LatencyRouting {
+			return cp.fastest(candidates)
+		}
+		if len(candidates) > 0 {
+			rnd.Lock()
+			ix := rnd.Intn(len(candidates))
+			rnd.Unlock()
+			return candidates[ix]
+		}
+	}
+	return sa[0]
+}
+
+// nodeZone returns the zone of the node address in the topology
+func (cp *ClusterPool) nodeZone(t *topology, addr string) string {
+	if n := t.nodes[addr]; n != nil {
+		return n.Zone
+	}
+	return cp.zoneOf(addr, "")
+}
@@ -0,0 +1,75 @@
+package redicluster
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func shardNode(id, ip string, port int64, role, zone string) []interface{} {
+	n := []interface{}{
+		[]byte("id"), []byte(id),
+		[]byte("port"), port,
+		[]byte("ip"), []byte(ip),
+		[]byte("endpoint"), []byte(ip),
+		[]byte("role"), []byte(role),
+		[]byte("health"), []byte("online"),
+	}
+	if len(zone) > 0 {
+		n = append(n, []byte("availability-zone"), []byte(zone))
+	}
+	return n
+}
+
+func testShardsReply() interface{} {
+	return []interface{}{
+		[]interface{}{
+			[]byte("slots"), []interface{}{int64(0), int64(16383)},
+			[]byte("nodes"), []interface{}{
+				shardNode("r1", "10.0.0.2", 6379, "replica", "az-b"),
+				shardNode("m1", "10.0.0.1", 6379, "master", "az-a"),
+				shardNode("r2", "10.0.0.3", 6379, "replica", "az-c"),
+			},
+		},
+	}
+}
+
+func TestUpdateShardMap(t *testing.T) {
+	cp := &ClusterPool{}
+	require.NoError(t, cp.updateShardMap(testShardsReply()))
+	assert.Equal(t, []string{"10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379"}, cp.topology().addrs(100))
+	assert.Equal(t, "master", cp.topology().nodes["10.0.0.1:6379"].Role)
+	assert.Equal(t, "az-b", cp.topology().nodes["10.0.0.2:6379"].Zone)
+}
+
+func TestZoneAffinity(t *testing.T) {
+	cp := &ClusterPool{ClientZone: "az-c"}
+	require.NoError(t, cp.updateShardMap(testShardsReply()))
+	for i := 0; i < 10; i++ {
+		addrs, err := cp.GetAddrsBySlots([]int{i}, true)
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.3:6379", addrs[0])
+	}
+
+	cp.ClientZone = "az-x"
+	cp.ZoneFallback = []string{"az-b"}
+	addrs, err := cp.GetAddrsBySlots([]int{0}, true)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.2:6379", addrs[0])
+
+	cp.ZoneFallback = []string{}
+	addrs, err = cp.GetAddrsBySlots([]int{0}, true)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:6379", addrs[0])
+
+	cp.ZoneOf = func(addr string) string {
+		if addr == "10.0.0.1:6379" {
+			return "az-x"
+		}
+		return ""
+	}
+	require.NoError(t, cp.updateShardMap(testShardsReply()))
+	assert.Equal(t, "az-x", cp.topology().nodes["10.0.0.1:6379"].Zone)
+	assert.Equal(t, "az-c", cp.topology().nodes["10.0.0.3:6379"].Zone)
+}